@@ -114,6 +114,12 @@ provider = "{{ get "container.provider" }}"
 # default pull policy to apply if non was specified. Can be 'Always', 'IfNotExist' or 'Never'.
 # Default value: "{{ get "container.pull" }}"
 pull = "{{ get "container.pull" }}"
+
+[registry]
+# require_verified makes virter refuse to pull images over HTTP that cannot be
+# verified against a checksum from the image registry.
+# Default value: {{ get "registry.require_verified" }}
+require_verified = {{ get "registry.require_verified" }}
 `
 
 // initConfig reads in config file and ENV variables if set.
@@ -131,6 +137,7 @@ func initConfig() {
 	viper.SetDefault("auth.user_public_key", []string{})
 	viper.SetDefault("container.provider", "docker")
 	viper.SetDefault("container.pull", "IfNotExist")
+	viper.SetDefault("registry.require_verified", false)
 
 	viper.SetConfigType("toml")
 	if cfgFile != "" {
@@ -2,33 +2,31 @@ package cmd
 
 import (
 	"os"
+	"strings"
 
 	"github.com/spf13/pflag"
 )
 
-type FileVar struct {
-	File *os.File
+// FileListVar is a flag that can be given multiple times, each time naming an existing file
+type FileListVar struct {
+	Files []string
 }
 
-func (f *FileVar) Type() string {
+func (f *FileListVar) Type() string {
 	return "file"
 }
 
-func (f *FileVar) String() string {
-	if f.File == nil {
-		return ""
-	}
-	return f.File.Name()
+func (f *FileListVar) String() string {
+	return strings.Join(f.Files, ",")
 }
 
-func (f *FileVar) Set(s string) error {
-	fd, err := os.Open(s)
-	if err != nil {
+func (f *FileListVar) Set(s string) error {
+	if _, err := os.Stat(s); err != nil {
 		return err
 	}
 
-	f.File = fd
+	f.Files = append(f.Files, s)
 	return nil
 }
 
-var _ pflag.Value = &FileVar{}
+var _ pflag.Value = &FileListVar{}
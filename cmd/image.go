@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -13,12 +14,14 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
 	"golang.org/x/term"
 
 	"github.com/LINBIT/virter/internal/virter"
 	"github.com/LINBIT/virter/pkg/pullpolicy"
+	"github.com/LINBIT/virter/pkg/registry"
 )
 
 // LocalImageName returns the local name for the user-supplied image name.
@@ -65,9 +68,9 @@ func LocalImageName(img string) string {
 // If the image, given by the imageName is not found in local storage, it is pulled from source.
 // Image names are resolved according to LocalImageName. It is possible to specify:
 // * A local image name.
-// * A name matching an alias in the legacy image registry.
+// * A name matching an alias in the legacy image registry. The image for the given CPU architecture is pulled.
 // * A container registry reference, which will be converted into a compatible local volume name.
-func GetLocalImage(ctx context.Context, imageName string, source string, v *virter.Virter, policy pullpolicy.PullPolicy, p virter.ProgressOpt) (*virter.LocalImage, error) {
+func GetLocalImage(ctx context.Context, imageName string, source string, arch virter.CpuArch, v *virter.Virter, policy pullpolicy.PullPolicy, p virter.ProgressOpt) (*virter.LocalImage, error) {
 	localName := LocalImageName(imageName)
 
 	switch policy {
@@ -96,7 +99,7 @@ func GetLocalImage(ctx context.Context, imageName string, source string, v *virt
 	parsedRef, err := name.ParseReference(source, name.WithDefaultRegistry(""))
 	if isHttpUrl || err != nil || parsedRef.Context().Registry.Name() == "" {
 		log.Tracef("Source %s failed to parse or has no registry location, trying non-registry pull", source)
-		return pullNonContainerRegistry(ctx, v, localName, source, p)
+		return pullNonContainerRegistry(ctx, v, localName, source, arch, p)
 	}
 
 	srcImg, err := remote.Image(parsedRef, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
@@ -109,21 +112,49 @@ func GetLocalImage(ctx context.Context, imageName string, source string, v *virt
 
 // pullNonContainerRegistry tries to pull an image from a source.
 //
-// The source can be either a HTTP url or a alias in the built-in image registry.
-func pullNonContainerRegistry(ctx context.Context, v *virter.Virter, destination, source string, p virter.ProgressOpt) (*virter.LocalImage, error) {
+// The source can be either a HTTP url or a alias in the built-in image registry. For aliases, the defaults given in
+// the registry are recorded in the image.
+func pullNonContainerRegistry(ctx context.Context, v *virter.Virter, destination, source string, arch virter.CpuArch, p virter.ProgressOpt) (*virter.LocalImage, error) {
+	var entry registry.ImageEntry
+	imageSource := registry.ImageSource{URL: source}
 	parsedSource, err := url.Parse(source)
 	if err != nil || (parsedSource.Scheme != "http" && parsedSource.Scheme != "https") {
-		registry := loadRegistry()
+		reg := loadRegistry()
 
-		registryUrl, err := registry.Lookup(source)
+		entry, err = reg.LookupEntry(source)
 		if err != nil {
 			return nil, fmt.Errorf("failed to look up %s: %w", source, err)
 		}
 
-		parsedSource, err = url.Parse(registryUrl)
+		imageSource, err = entry.Source(string(arch))
 		if err != nil {
 			return nil, fmt.Errorf("failed to look up %s: %w", source, err)
 		}
+
+		parsedSource, err = url.Parse(imageSource.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up %s: %w", source, err)
+		}
+	}
+
+	defaults, err := registryImageDefaults(entry.Defaults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid defaults for %s in image registry: %w", source, err)
+	}
+
+	opts := []virter.LayerOperationOption{virter.WithProgress(p)}
+	checksum, err := imageSource.Checksum(ctx, http.DefaultClient)
+	switch {
+	case errors.Is(err, registry.ErrUnverified):
+		if viper.GetBool("registry.require_verified") {
+			return nil, fmt.Errorf("refusing to pull %s: no checksum to verify the image against and registry.require_verified is set", source)
+		}
+		log.WithField("source", source).Info("No checksum available, the pulled image is not verified")
+	case err != nil:
+		return nil, fmt.Errorf("failed to verify %s: %w", source, err)
+	default:
+		log.WithFields(log.Fields{"source": source, "algorithm": checksum.Algorithm}).Debug("verifying pulled image")
+		opts = append(opts, virter.WithExpectedChecksum(virter.ExpectedChecksum(*checksum)))
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsedSource.String(), nil)
@@ -157,7 +188,18 @@ func pullNonContainerRegistry(ctx context.Context, v *virter.Virter, destination
 		return nil, fmt.Errorf("bad http status: %v", response.Status)
 	}
 
-	return v.ImageImportFromReader(destination, proxyResponse, v.ProvisionStoragePool(), virter.WithProgress(p))
+	img, err := v.ImageImportFromReader(destination, proxyResponse, v.ProvisionStoragePool(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if labels := defaults.Labels(); len(labels) > 0 {
+		if err := v.SetImageLabels(img, labels); err != nil {
+			return nil, fmt.Errorf("failed to record image defaults: %w", err)
+		}
+	}
+
+	return img, nil
 }
 
 func imageCommand() *cobra.Command {
@@ -168,13 +210,19 @@ func imageCommand() *cobra.Command {
 	}
 
 	imageCmd.AddCommand(imageBuildCommand())
+	imageCmd.AddCommand(imageBuildMatrixCommand())
 	imageCmd.AddCommand(imagePullCommand())
 	imageCmd.AddCommand(imageLsCommand())
 	imageCmd.AddCommand(imageRmCommand())
 	imageCmd.AddCommand(imageLoadCommand())
 	imageCmd.AddCommand(imageSaveCommand())
+	imageCmd.AddCommand(imageExportCommand())
+	imageCmd.AddCommand(imageImportCommand())
 	imageCmd.AddCommand(imagePushCommand())
 	imageCmd.AddCommand(imagePruneCommand())
+	imageCmd.AddCommand(imageInspectCommand())
+	imageCmd.AddCommand(imageHistoryCommand())
+	imageCmd.AddCommand(imageTagCommand())
 
 	return imageCmd
 }
@@ -1,19 +1,21 @@
 package cmd
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/LINBIT/containerapi"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	regv1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/rck/unit"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/vbauerster/mpb/v8"
 
@@ -22,230 +24,400 @@ import (
 	"github.com/LINBIT/virter/pkg/pullpolicy"
 )
 
-func imageBuildCommand() *cobra.Command {
-	var vmID uint
-	var vmName string
-	var provFile FileVar
-	var provisionOverrides []string
+// imageBuildSettings are the settings that apply to every image built by "image build" and "image build-matrix"
+type imageBuildSettings struct {
+	provFiles          FileListVar
+	provisionOverrides []string
+	provisionFormat    virter.ProvisionFormat
 
-	var mem *unit.Value
-	var memKiB uint64
+	mem             *unit.Value
+	memKiB          uint64
+	bootCapacity    *unit.Value
+	bootCapacityKiB uint64
+	vcpus           uint
+	cpuArch         virter.CpuArch
 
-	var bootCapacity *unit.Value
-	var bootCapacityKiB uint64
+	consoleDir     string
+	resetMachineID bool
 
-	var vcpus uint
+	push          bool
+	noCache       bool
+	keepOnFailure bool
+	checkpointAll bool
 
-	var consoleDir string
-	var resetMachineID bool
+	mountStrings []string
+	mounts       []virter.Mount
 
-	var push bool
-	var noCache bool
-	var buildId string
-	cpuArch := virter.CpuArchNative
+	vmPullPolicy        pullpolicy.PullPolicy
+	containerPullPolicy pullpolicy.PullPolicy
 
-	var mountStrings []string
-	var mounts []virter.Mount
+	user               string
+	vncEnabled         bool
+	vncPort            int
+	vncIPv4BindAddress string
 
-	vmPullPolicy := pullpolicy.IfNotExist
-	var containerPullPolicy pullpolicy.PullPolicy
+	// flags are used to tell explicit settings from image defaults
+	flags *pflag.FlagSet
+}
 
-	var user string
-	var vncEnabled bool
-	var vncPort int
-	var vncIPv4BindAddress string
+func newImageBuildSettings() *imageBuildSettings {
+	return &imageBuildSettings{
+		cpuArch:      virter.CpuArchNative,
+		vmPullPolicy: pullpolicy.IfNotExist,
+	}
+}
 
-	buildCmd := &cobra.Command{
-		Use:   "build base_image new_image",
-		Short: "Build an image",
-		Long:  `Build an image by starting a VM, running a provisioning step, and then committing the resulting volume.`,
-		Args:  cobra.ExactArgs(2),
-		PreRunE: func(cmd *cobra.Command, args []string) error {
-			memKiB = uint64(mem.Value / unit.DefaultUnits["K"])
-			bootCapacityKiB = uint64(bootCapacity.Value / unit.DefaultUnits["K"])
+func (s *imageBuildSettings) addFlags(cmd *cobra.Command) {
+	s.flags = cmd.Flags()
+	cmd.Flags().VarP(&s.provFiles, "provision", "p", "name of file containing provisioning steps. Can be specified multiple times, the files are concatenated in order")
+	cmd.Flags().VarP(&s.provisionFormat, "provision-format", "", fmt.Sprintf("Format of the provisioning files. Detected from the file extension if not given. Valid values: [%s, %s, %s]", virter.ProvisionFormatTOML, virter.ProvisionFormatYAML, virter.ProvisionFormatJSON))
+	cmd.Flags().StringArrayVarP(&s.provisionOverrides, "set", "s", []string{}, "set/override provisioning steps")
+	cmd.Flags().UintVar(&s.vcpus, "vcpus", 1, "Number of virtual CPUs to allocate for the VM")
+	cmd.Flags().VarP(&s.cpuArch, "arch", "", "CPU architecture to use. Will use kvm if host and VM use the same architecture")
+	u := unit.MustNewUnit(sizeUnits)
+	s.mem = u.MustNewValue(1*sizeUnits["G"], unit.None)
+	cmd.Flags().VarP(s.mem, "memory", "m", "Set amount of memory for the VM")
+	s.bootCapacity = u.MustNewValue(10*sizeUnits["G"], unit.None)
+	cmd.Flags().VarP(s.bootCapacity, "boot-capacity", "", "Capacity of the boot volume (values smaller than base image capacity will be ignored)")
+	cmd.Flags().StringVarP(&s.consoleDir, "console", "c", "", "Directory to save the VMs console outputs to")
+	cmd.Flags().BoolVar(&s.resetMachineID, "reset-machine-id", true, "Whether or not to clear the /etc/machine-id file after provisioning")
+	cmd.Flags().VarP(&s.vmPullPolicy, "vm-pull-policy", "", fmt.Sprintf("Whether or not to pull the source image. Valid values: [%s, %s, %s]", pullpolicy.Always, pullpolicy.IfNotExist, pullpolicy.Never))
+	cmd.Flags().VarP(&s.containerPullPolicy, "container-pull-policy", "", fmt.Sprintf("Whether or not to pull container images used during provisioning. Overrides the `pull` value of every provision step. Valid values: [%s, %s, %s]", pullpolicy.Always, pullpolicy.IfNotExist, pullpolicy.Never))
+	cmd.Flags().BoolVarP(&s.push, "push", "", false, "Push the image after building")
+	cmd.Flags().BoolVarP(&s.noCache, "no-cache", "", false, "Disable caching for the image build")
+	cmd.Flags().StringArrayVarP(&s.mountStrings, "mount", "v", []string{}, `Mount a host path in the VM, like a bind mount. Format: "host=/path/on/host,vm=/path/in/vm"`)
+	cmd.Flags().StringVarP(&s.user, "user", "u", "root", "Remote user for ssh session. Defaults to the user recorded in the base image, if any")
+	cmd.Flags().BoolVar(&s.keepOnFailure, "keep-on-failure", false, "Keep the VM running if the build fails, so that it can be inspected")
+	cmd.Flags().BoolVar(&s.checkpointAll, "checkpoint-all", false, "Commit a checkpoint after every provisioning step, not only after steps with checkpoint set. Later builds resume from the last matching checkpoint")
+}
 
-			for _, m := range mountStrings {
-				var a MountArg
-				err := a.Set(m)
-				if err != nil {
-					return fmt.Errorf("invalid mount: %w", err)
-				}
-				mounts = append(mounts, &a)
-			}
+// parse converts the flag values that need checking. Meant to be called in PreRunE.
+func (s *imageBuildSettings) parse() error {
+	s.memKiB = uint64(s.mem.Value / unit.DefaultUnits["K"])
+	s.bootCapacityKiB = uint64(s.bootCapacity.Value / unit.DefaultUnits["K"])
+
+	for _, m := range s.mountStrings {
+		var a MountArg
+		err := a.Set(m)
+		if err != nil {
+			return fmt.Errorf("invalid mount: %w", err)
+		}
+		s.mounts = append(s.mounts, &a)
+	}
 
-			return nil
-		},
-		Run: func(cmd *cobra.Command, args []string) {
-			baseImageName := args[0]
-			newImageName := LocalImageName(args[1])
+	return nil
+}
 
-			if vmName == "" {
-				vmName = newImageName
-			}
+func (s *imageBuildSettings) provisionOption() virter.ProvisionOption {
+	return virter.ProvisionOption{
+		Overrides:          s.provisionOverrides,
+		DefaultPullPolicy:  getDefaultContainerPullPolicy(),
+		OverridePullPolicy: s.containerPullPolicy,
+		Format:             s.provisionFormat,
+	}
+}
 
-			ctx := cmd.Context()
+// imageBuild describes a single image to build
+type imageBuild struct {
+	baseImageName string
+	// newImageRef is the name of the new image. With push, this is the registry reference to push to.
+	newImageRef     string
+	vmName          string
+	vmID            uint
+	buildId         string
+	provisionConfig virter.ProvisionConfig
+	provisionOutput provisionOutputFlags
+}
 
-			v, err := InitVirter()
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer v.ForceDisconnect()
+// imageBuildStatus tells how an image build finished
+type imageBuildStatus string
 
-			var existingTargetImage regv1.Image
-			var existingTargetRef name.Reference
-			if push {
-				existingTargetRef, err = name.ParseReference(args[1], name.WithDefaultRegistry(""))
-				if err != nil {
-					log.WithError(err).Fatal("failed to parse destination ref")
-				}
+const (
+	imageBuildBuilt    imageBuildStatus = "built"
+	imageBuildUpToDate imageBuildStatus = "up-to-date"
+	imageBuildPulled   imageBuildStatus = "pulled"
+)
 
-				err = remote.CheckPushPermission(existingTargetRef, authn.DefaultKeychain, http.DefaultTransport)
-				if err != nil {
-					log.WithError(err).Fatal("not allowed to push")
-				}
+// run builds a single image. The progress bars are added to p, the caller has to wait for it.
+//
+// If the build failed and the VM was kept, a *virter.BuildVMKeptError is returned.
+func (s *imageBuildSettings) run(ctx context.Context, v *virter.Virter, b imageBuild, p *mpb.Progress) (imageBuildStatus, error) {
+	newImageName := LocalImageName(b.newImageRef)
+	vmName := b.vmName
+	if vmName == "" {
+		vmName = newImageName
+	}
 
-				// We deliberately ignore errors here, probably just tells us that the image doesn't exist yet.
-				existingTargetImage, _ = remote.Image(existingTargetRef, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
-			}
+	// The build ID is stored in the image history, so it must not leak secrets
+	if virter.RedactSecrets(b.buildId) != b.buildId {
+		return "", fmt.Errorf("the build ID must not contain the value of a provisioning secret")
+	}
 
-			extraAuthorizedKeys := extraAuthorizedKeys()
+	var existingTargetImage regv1.Image
+	var existingTargetRef name.Reference
+	if s.push {
+		var err error
+		existingTargetRef, err = name.ParseReference(b.newImageRef, name.WithDefaultRegistry(""))
+		if err != nil {
+			return "", fmt.Errorf("failed to parse destination ref: %w", err)
+		}
+
+		err = remote.CheckPushPermission(existingTargetRef, authn.DefaultKeychain, http.DefaultTransport)
+		if err != nil {
+			return "", fmt.Errorf("not allowed to push: %w", err)
+		}
+
+		// We deliberately ignore errors here, probably just tells us that the image doesn't exist yet.
+		existingTargetImage, _ = remote.Image(existingTargetRef, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
+	}
 
-			consoleDir, err = createConsoleDir(consoleDir)
-			if err != nil {
-				log.Fatalf("Error while creating console directory: %v", err)
-			}
+	extraAuthorizedKeys := extraAuthorizedKeys()
 
-			consolePath, err := createConsoleFile(consoleDir, newImageName)
-			if err != nil {
-				log.Fatalf("Error while creating console file: %v", err)
-			}
+	consoleDir, err := createConsoleDir(s.consoleDir)
+	if err != nil {
+		return "", fmt.Errorf("error while creating console directory: %w", err)
+	}
 
-			shutdownTimeout := viper.GetDuration("time.shutdown_timeout")
+	consolePath, err := createConsoleFile(consoleDir, newImageName)
+	if err != nil {
+		return "", fmt.Errorf("error while creating console file: %w", err)
+	}
 
-			p := mpb.NewWithContext(ctx, DefaultContainerOpt())
+	shutdownTimeout := viper.GetDuration("time.shutdown_timeout")
 
-			baseImage, err := GetLocalImage(ctx, baseImageName, baseImageName, v, vmPullPolicy, DefaultProgressFormat(p))
+	baseImage, err := GetLocalImage(ctx, b.baseImageName, b.baseImageName, s.cpuArch, v, s.vmPullPolicy, DefaultProgressFormat(p))
+	if err != nil {
+		return "", fmt.Errorf("error while getting image: %w", err)
+	}
+
+	// Paths virter writes to while building must not change the build cache key
+	cacheExcludes := []string{b.provisionOutput.logDir, b.provisionOutput.reportPath, consoleDir}
+
+	// Without an explicit build ID, the build inputs determine whether the image has to be rebuilt
+	cacheKey := b.buildId
+	if cacheKey == "" {
+		cacheKey, err = virter.BuildCacheKey(baseImage, b.provisionConfig, cacheExcludes...)
+		if err != nil {
+			return "", fmt.Errorf("failed to compute build cache key: %w", err)
+		}
+	}
+	log.WithFields(log.Fields{"image": newImageName, "key": cacheKey}).Debug("computed build cache key")
+
+	if !s.noCache {
+		localImg, err := v.FindImage(newImageName, v.ProvisionStoragePool())
+		if err != nil {
+			return "", fmt.Errorf("failed to check for existing image: %w", err)
+		}
+
+		if localImg != nil {
+			unchanged, err := virter.ImageBuildUpToDate(baseImage, localImg, cacheKey)
 			if err != nil {
-				log.Fatalf("Error while getting image: %v", err)
-			}
+				log.WithError(err).Warn("error comparing existing image, assuming provision steps changed")
+			} else if unchanged {
+				log.WithField("image", newImageName).Info("Image already up-to-date, skipping provision")
 
-			p.Wait()
+				if s.push {
+					if err := pushBuiltImage(ctx, v, newImageName, existingTargetRef, p); err != nil {
+						return "", err
+					}
+				}
 
-			provOpt := virter.ProvisionOption{
-				Overrides:          provisionOverrides,
-				DefaultPullPolicy:  getDefaultContainerPullPolicy(),
-				OverridePullPolicy: containerPullPolicy,
+				return imageBuildUpToDate, nil
 			}
+		}
+	}
 
-			provisionConfig, err := virter.NewProvisionConfig(provFile.File, provOpt)
+	if existingTargetImage != nil && !s.noCache {
+		unchanged, err := virter.ImageBuildUpToDate(baseImage, existingTargetImage, cacheKey)
+		if err != nil {
+			log.WithError(err).Warn("error comparing existing target image, assuming provision steps changed")
+		} else if unchanged {
+			log.WithField("image", newImageName).Info("Image already up-to-date, skipping provision, pulling instead")
+
+			_, err := GetLocalImage(ctx, newImageName, b.newImageRef, s.cpuArch, v, pullpolicy.Always, DefaultProgressFormat(p))
 			if err != nil {
-				log.Fatal(err)
+				return "", err
 			}
 
-			if push && buildId == "" {
-				log.Info("Pushing without providing a build ID. Images will always be rebuilt unless the same build ID is given.")
-			}
+			return imageBuildPulled, nil
+		}
+	}
 
-			if buildId != "" && existingTargetImage != nil && !noCache {
-				unchanged, err := provisionStepsUnchanged(baseImage, existingTargetImage, buildId)
-				if err != nil {
-					log.WithError(err).Warn("error comparing existing target image, assuming provision steps changed")
-				} else if unchanged {
-					log.Info("Image already up-to-date, skipping provision, pulling instead")
+	// ContainerProvider will be set later if needed
+	tools := virter.ImageBuildTools{
+		ShellClientBuilder: SSHClientBuilder{},
+		AfterNotifier:      actualtime.ActualTime{},
+	}
 
-					p := mpb.NewWithContext(ctx, DefaultContainerOpt())
+	vncPort := s.vncPort
+	if s.vncEnabled && vncPort == 0 {
+		vncPort = 6000 + int(b.vmID)
+	}
 
-					_, err := GetLocalImage(ctx, newImageName, args[1], v, pullpolicy.Always, DefaultProgressFormat(p))
-					if err != nil {
-						log.Fatal(err)
-					}
+	vmConfig := virter.VMConfig{
+		Image:              baseImage,
+		Name:               vmName,
+		CpuArch:            s.cpuArch,
+		MemoryKiB:          s.memKiB,
+		BootCapacityKiB:    s.bootCapacityKiB,
+		VCPUs:              s.vcpus,
+		ID:                 b.vmID,
+		StaticDHCP:         viper.GetBool("libvirt.static_dhcp"),
+		ExtraSSHPublicKeys: extraAuthorizedKeys,
+		ConsolePath:        consolePath,
+		DiskCache:          viper.GetString("libvirt.disk_cache"),
+		Mounts:             s.mounts,
+
+		VNCEnabled:         s.vncEnabled,
+		VNCPort:            vncPort,
+		VNCIPv4BindAddress: s.vncIPv4BindAddress,
+		SSHUserName:        s.user,
+	}
 
-					p.Wait()
+	defaults, err := imageDefaults(baseImage)
+	if err != nil {
+		return "", err
+	}
+	applyImageDefaults(s.flags, defaults, &vmConfig)
 
-					fmt.Printf("Built %s\n", newImageName)
-					return
-				}
-			}
+	containerName := "virter-build-" + newImageName
 
-			// ContainerProvider will be set later if needed
-			tools := virter.ImageBuildTools{
-				ShellClientBuilder: SSHClientBuilder{},
-				AfterNotifier:      actualtime.ActualTime{},
-			}
-			if vncEnabled && vncPort == 0 {
-				vncPort = 6000 + int(vmID)
-			}
+	if b.provisionConfig.NeedsContainers() {
+		containerProvider, err := containerapi.NewProvider(ctx, containerProvider())
+		if err != nil {
+			return "", err
+		}
+		defer containerProvider.Close()
+		tools.ContainerProvider = containerProvider
+	}
 
-			vmConfig := virter.VMConfig{
-				Image:              baseImage,
-				Name:               vmName,
-				CpuArch:            cpuArch,
-				MemoryKiB:          memKiB,
-				BootCapacityKiB:    bootCapacityKiB,
-				VCPUs:              vcpus,
-				ID:                 vmID,
-				StaticDHCP:         viper.GetBool("libvirt.static_dhcp"),
-				ExtraSSHPublicKeys: extraAuthorizedKeys,
-				ConsolePath:        consolePath,
-				DiskCache:          viper.GetString("libvirt.disk_cache"),
-				Mounts:             mounts,
-
-				VNCEnabled:         vncEnabled,
-				VNCPort:            vncPort,
-				VNCIPv4BindAddress: vncIPv4BindAddress,
-				SSHUserName:        user,
-			}
+	var provisionSHA256 string
+	if len(b.provisionConfig.Steps) > 0 {
+		provisionSHA256, err = b.provisionConfig.SHA256()
+		if err != nil {
+			return "", fmt.Errorf("failed to hash provisioning config: %w", err)
+		}
+	}
 
-			containerName := "virter-build-" + newImageName
+	buildHost, err := os.Hostname()
+	if err != nil {
+		log.WithError(err).Warn("could not determine host name, not recording it in the image")
+	}
 
-			if provisionConfig.NeedsContainers() {
-				containerProvider, err := containerapi.NewProvider(ctx, containerProvider())
+	buildConfig := virter.ImageBuildConfig{
+		ContainerName:   containerName,
+		ProvisionConfig: b.provisionConfig,
+		ProvisionLogDir: b.provisionOutput.logDir,
+		ProvisionReport: b.provisionOutput.newReport(),
+		KeepOnFailure:   s.keepOnFailure,
+		CacheKey:        cacheKey,
+
+		CheckpointAllSteps: s.checkpointAll,
+		IgnoreCheckpoints:  s.noCache,
+		CacheExcludes:      cacheExcludes,
+		Provenance: virter.ImageProvenance{
+			BaseRef:         b.baseImageName,
+			ProvisionSHA256: provisionSHA256,
+			VirterVersion:   virterVersion(),
+			BuildHost:       buildHost,
+		},
+		CommitConfig: virter.CommitConfig{
+			ImageName:       newImageName,
+			Shutdown:        true,
+			ShutdownTimeout: shutdownTimeout,
+			ResetMachineID:  s.resetMachineID,
+		},
+	}
+
+	err = v.ImageBuild(ctx, tools, vmConfig, getReadyConfig(), buildConfig, virter.WithProgress(DefaultProgressFormat(p)))
+	b.provisionOutput.writeReport(buildConfig.ProvisionReport)
+	if err != nil {
+		return "", err
+	}
+
+	if s.push {
+		if err := pushBuiltImage(ctx, v, newImageName, existingTargetRef, p); err != nil {
+			return "", err
+		}
+	}
+
+	return imageBuildBuilt, nil
+}
+
+func imageBuildCommand() *cobra.Command {
+	settings := newImageBuildSettings()
+
+	var vmID uint
+	var vmName string
+	var buildId string
+	var dryRun bool
+	var debugOnFailure bool
+	var provisionOutput provisionOutputFlags
+
+	buildCmd := &cobra.Command{
+		Use:   "build base_image new_image",
+		Short: "Build an image",
+		Long:  `Build an image by starting a VM, running a provisioning step, and then committing the resulting volume.`,
+		Args:  cobra.ExactArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return settings.parse()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			newImageName := LocalImageName(args[1])
+
+			ctx := cmd.Context()
+
+			provOpt := settings.provisionOption()
+
+			if dryRun {
+				provisionConfig, err := loadAndValidateProvisionConfig(settings.provFiles.Files, provOpt)
 				if err != nil {
+					log.Fatalf("Invalid provisioning configuration: %v", err)
+				}
+				warnContainerImagesUnchecked(provisionConfig)
+				if err := printProvisionConfig(os.Stdout, provisionConfig); err != nil {
 					log.Fatal(err)
 				}
-				defer containerProvider.Close()
-				tools.ContainerProvider = containerProvider
+				return
 			}
 
-			buildConfig := virter.ImageBuildConfig{
-				ContainerName:   containerName,
-				ProvisionConfig: provisionConfig,
-				CommitConfig: virter.CommitConfig{
-					ImageName:       newImageName,
-					Shutdown:        true,
-					ShutdownTimeout: shutdownTimeout,
-					ResetMachineID:  resetMachineID,
-				},
+			provisionConfig, err := virter.NewProvisionConfigFiles(settings.provFiles.Files, provOpt)
+			if err != nil {
+				log.Fatal(err)
 			}
 
-			p = mpb.NewWithContext(ctx, DefaultContainerOpt())
-
-			err = v.ImageBuild(ctx, tools, vmConfig, getReadyConfig(), buildConfig, virter.WithProgress(DefaultProgressFormat(p)))
+			v, err := InitVirter()
 			if err != nil {
-				logProvisioningErrorAndExit(err)
+				log.Fatal(err)
 			}
+			defer v.ForceDisconnect()
 
-			if push {
-				localImg, err := v.FindImage(newImageName, v.ProvisionStoragePool(), virter.WithProgress(DefaultProgressFormat(p)))
-				if err != nil {
-					log.Fatalf("failed to find built image: %v", err)
-				}
+			if debugOnFailure {
+				settings.keepOnFailure = true
+			}
 
-				if localImg == nil {
-					log.Fatal("failed to find built image: not found")
-				}
+			build := imageBuild{
+				baseImageName:   args[0],
+				newImageRef:     args[1],
+				vmName:          vmName,
+				vmID:            vmID,
+				buildId:         buildId,
+				provisionConfig: provisionConfig,
+				provisionOutput: provisionOutput,
+			}
 
-				imageWithHistory := &historyShimImage{
-					Image: localImg,
-					history: []regv1.History{
-						{Comment: buildId},
-					},
-				}
+			p := mpb.NewWithContext(ctx, DefaultContainerOpt())
 
-				err = remote.Write(existingTargetRef, imageWithHistory, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
-				if err != nil {
-					log.Fatalf("failed to push image: %v", err)
-				}
+			_, err = settings.run(ctx, v, build, p)
+			var keptErr *virter.BuildVMKeptError
+			if errors.As(err, &keptErr) {
+				// Stop the progress output, it would interfere with the SSH session
+				p.Shutdown()
+				handleKeptBuildVM(ctx, v, keptErr, debugOnFailure)
+				os.Exit(provisioningExitCode(err))
+			}
+			if err != nil {
+				logProvisioningErrorAndExit(err)
 			}
 
 			p.Wait()
@@ -262,123 +434,53 @@ func imageBuildCommand() *cobra.Command {
 		},
 	}
 
-	buildCmd.Flags().VarP(&provFile, "provision", "p", "name of toml file containing provisioning steps")
-	buildCmd.Flags().StringArrayVarP(&provisionOverrides, "set", "s", []string{}, "set/override provisioning steps")
+	settings.addFlags(buildCmd)
 	buildCmd.Flags().UintVarP(&vmID, "id", "", 0, "ID for VM which determines the IP address")
 	buildCmd.Flags().StringVarP(&vmName, "name", "", "", "Name to use for provisioning VM")
-	buildCmd.Flags().UintVar(&vcpus, "vcpus", 1, "Number of virtual CPUs to allocate for the VM")
-	buildCmd.Flags().VarP(&cpuArch, "arch", "", "CPU architecture to use. Will use kvm if host and VM use the same architecture")
-	u := unit.MustNewUnit(sizeUnits)
-	mem = u.MustNewValue(1*sizeUnits["G"], unit.None)
-	buildCmd.Flags().VarP(mem, "memory", "m", "Set amount of memory for the VM")
-	bootCapacity = u.MustNewValue(10*sizeUnits["G"], unit.None)
-	buildCmd.Flags().VarP(bootCapacity, "boot-capacity", "", "Capacity of the boot volume (values smaller than base image capacity will be ignored)")
-	buildCmd.Flags().StringVarP(&consoleDir, "console", "c", "", "Directory to save the VMs console outputs to")
-	buildCmd.Flags().BoolVar(&resetMachineID, "reset-machine-id", true, "Whether or not to clear the /etc/machine-id file after provisioning")
-	buildCmd.Flags().VarP(&vmPullPolicy, "vm-pull-policy", "", fmt.Sprintf("Whether or not to pull the source image. Valid values: [%s, %s, %s]", pullpolicy.Always, pullpolicy.IfNotExist, pullpolicy.Never))
-	buildCmd.Flags().VarP(&containerPullPolicy, "container-pull-policy", "", fmt.Sprintf("Whether or not to pull container images used during provisioning. Overrides the `pull` value of every provision step. Valid values: [%s, %s, %s]", pullpolicy.Always, pullpolicy.IfNotExist, pullpolicy.Never))
-	buildCmd.Flags().BoolVarP(&push, "push", "", false, "Push the image after building")
-	buildCmd.Flags().BoolVarP(&noCache, "no-cache", "", false, "Disable caching for the image build")
-	buildCmd.Flags().StringVarP(&buildId, "build-id", "", "", "Build ID used to determine if an image needs to be rebuild.")
-	buildCmd.Flags().StringArrayVarP(&mountStrings, "mount", "v", []string{}, `Mount a host path in the VM, like a bind mount. Format: "host=/path/on/host,vm=/path/in/vm"`)
-	buildCmd.Flags().StringVarP(&user, "user", "u", "root", "Remote user for ssh session")
-	buildCmd.Flags().BoolVarP(&vncEnabled, "vnc", "", false, "whether to configure VNC (remote GUI access) for the VM (defaults to false)")
-	buildCmd.Flags().IntVar(&vncPort, "vnc-port", 0, "VNC port. Defaults to 6000+id of this VM")
-	buildCmd.Flags().StringVar(&vncIPv4BindAddress, "vnc-bind-ip", "127.0.0.1", "VNC IPv4 address to bind VNC listening socket to")
+	buildCmd.Flags().StringVarP(&buildId, "build-id", "", "", "Build ID used to determine if an image needs to be rebuilt. By default, a key derived from the base image, the provisioning configuration and the files it uses is taken")
+	buildCmd.Flags().BoolVarP(&settings.vncEnabled, "vnc", "", false, "whether to configure VNC (remote GUI access) for the VM (defaults to false)")
+	buildCmd.Flags().IntVar(&settings.vncPort, "vnc-port", 0, "VNC port. Defaults to 6000+id of this VM")
+	buildCmd.Flags().StringVar(&settings.vncIPv4BindAddress, "vnc-bind-ip", "127.0.0.1", "VNC IPv4 address to bind VNC listening socket to")
+	provisionOutput.addFlags(buildCmd)
+	buildCmd.Flags().BoolVar(&debugOnFailure, "debug-on-failure", false, "Keep the VM running if the build fails and open an interactive SSH session in it. Implies --keep-on-failure")
+	buildCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only check the provisioning configuration and print the resolved steps, without connecting to libvirt or building the image")
 
 	return buildCmd
 }
 
-// historyShimImage adds history to an existing image
-type historyShimImage struct {
-	regv1.Image
-	history []regv1.History
-}
+// handleKeptBuildVM tells the user how to access and remove a VM that was kept after a failed build. With debug,
+// an interactive SSH session is opened in the VM first.
+func handleKeptBuildVM(ctx context.Context, v *virter.Virter, keptErr *virter.BuildVMKeptError, debug bool) {
+	log.Errorf("Failed to build image: %v", keptErr.Err)
 
-func (h *historyShimImage) Size() (int64, error) {
-	return partial.Size(h)
-}
-
-func (h *historyShimImage) ConfigName() (regv1.Hash, error) {
-	return partial.ConfigName(h)
-}
-
-func (h *historyShimImage) ConfigFile() (*regv1.ConfigFile, error) {
-	original, err := h.Image.ConfigFile()
-	if err != nil {
-		return nil, err
+	if debug {
+		log.Infof("Opening SSH session in %s, exit the shell to continue", keptErr.VMName)
+		if err := v.VMSSHSession(ctx, keptErr.VMName); err != nil {
+			log.WithError(err).Warn("SSH session failed")
+		}
 	}
 
-	original.History = h.history
-	return original, err
+	fmt.Fprintf(os.Stderr, "The VM %[1]s was kept for debugging.\n", keptErr.VMName)
+	fmt.Fprintf(os.Stderr, "Connect to it with:  virter vm ssh %[1]s\n", keptErr.VMName)
+	fmt.Fprintf(os.Stderr, "Remove it with:      virter vm rm %[1]s\n", keptErr.VMName)
 }
 
-func (h *historyShimImage) RawConfigFile() ([]byte, error) {
-	return partial.RawConfigFile(h)
-}
-
-func (h *historyShimImage) Digest() (regv1.Hash, error) {
-	return partial.Digest(h)
-}
-
-func (h *historyShimImage) Manifest() (*regv1.Manifest, error) {
-	original, err := h.Image.Manifest()
+// pushBuiltImage pushes the local image to ref. The image configuration carries the history, including the build
+// cache key, so that later builds can check whether the pushed image is up-to-date.
+func pushBuiltImage(ctx context.Context, v *virter.Virter, imageName string, ref name.Reference, p *mpb.Progress) error {
+	localImg, err := v.FindImage(imageName, v.ProvisionStoragePool(), virter.WithProgress(DefaultProgressFormat(p)))
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to find built image: %w", err)
 	}
 
-	raw, err := h.RawConfigFile()
-	if err != nil {
-		return nil, err
+	if localImg == nil {
+		return fmt.Errorf("failed to find built image: not found")
 	}
 
-	cfgHash, cfgSize, err := regv1.SHA256(bytes.NewReader(raw))
-	if err != nil {
-		return nil, err
-	}
-
-	original.Config = regv1.Descriptor{
-		MediaType: virter.ImageMediaType,
-		Size:      cfgSize,
-		Digest:    cfgHash,
-	}
-
-	return original, nil
-}
-
-func (h *historyShimImage) RawManifest() ([]byte, error) {
-	return partial.RawManifest(h)
-}
-
-var _ regv1.Image = &historyShimImage{}
-
-func provisionStepsUnchanged(baseImage *virter.LocalImage, targetImage regv1.Image, expectedHistory string) (bool, error) {
-	targetCfg, err := targetImage.ConfigFile()
-	if err != nil {
-		return false, err
-	}
-
-	if len(targetCfg.History) == 0 {
-		// No history information, image wasn't provision with (new) virter
-		return false, nil
-	}
-
-	lastHistoryEntry := targetCfg.History[len(targetCfg.History)-1]
-	if string(expectedHistory) != lastHistoryEntry.Comment {
-		return false, nil
-	}
-
-	if len(targetCfg.RootFS.DiffIDs) < 2 {
-		// There doesn't seem to be a base layer for this image
-		return false, nil
-	}
-
-	targetBaseImageID := targetCfg.RootFS.DiffIDs[len(targetCfg.RootFS.DiffIDs)-2]
-
-	currentBaseImageID, err := baseImage.TopLayer().DiffID()
+	err = remote.Write(ref, localImg, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
 	if err != nil {
-		return false, err
+		return fmt.Errorf("failed to push image: %w", err)
 	}
 
-	return targetBaseImageID == currentBaseImageID, nil
+	return nil
 }
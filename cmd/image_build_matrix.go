@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/rodaine/table"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/vbauerster/mpb/v8"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+// buildMatrixNameData is the data for the template of the image names in "image build-matrix"
+type buildMatrixNameData struct {
+	// Base is the base image as given on the command line
+	Base string
+}
+
+// buildMatrixResult is the outcome of a single build of "image build-matrix"
+type buildMatrixResult struct {
+	build    imageBuild
+	status   imageBuildStatus
+	duration time.Duration
+	err      error
+}
+
+// buildMatrixImageNames renders the name template for every base image. The names have to be unique.
+func buildMatrixImageNames(nameTemplate string, bases []string) ([]string, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+
+	names := make([]string, len(bases))
+	seen := map[string]string{}
+	for i, base := range bases {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, buildMatrixNameData{Base: base}); err != nil {
+			return nil, fmt.Errorf("failed to execute name template for base image %s: %w", base, err)
+		}
+
+		names[i] = buf.String()
+		if names[i] == "" {
+			return nil, fmt.Errorf("name template results in an empty name for base image %s", base)
+		}
+
+		if other, ok := seen[names[i]]; ok {
+			return nil, fmt.Errorf("base images %s and %s both result in the image name %s", other, base, names[i])
+		}
+		seen[names[i]] = base
+	}
+
+	return names, nil
+}
+
+func imageBuildMatrixCommand() *cobra.Command {
+	settings := newImageBuildSettings()
+
+	var bases []string
+	var nameTemplate string
+	var jobs int
+	var firstID uint
+	var logDir string
+
+	matrixCmd := &cobra.Command{
+		Use:   "build-matrix",
+		Short: "Build images from several base images",
+		Long: `Build one image for each of the given base images, using the same provisioning for all of them.
+The builds run in parallel. The name of each image is given by a template, which can refer to the base image
+as {{.Base}}. The provisioning logs of each build are written to a subdirectory of the log directory, and a summary
+of all builds is printed at the end.`,
+		Example: `virter image build-matrix -p provision.toml --base alma-8,alma-9,ubuntu-noble --name '{{.Base}}-drbd'`,
+		Args:    cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(bases) == 0 {
+				return fmt.Errorf("at least one base image is required")
+			}
+
+			if jobs < 1 {
+				return fmt.Errorf("--jobs must be at least 1")
+			}
+
+			return settings.parse()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx := cmd.Context()
+
+			names, err := buildMatrixImageNames(nameTemplate, bases)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			provisionConfig, err := virter.NewProvisionConfigFiles(settings.provFiles.Files, settings.provisionOption())
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			v, err := InitVirter()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			if logDir == "" {
+				logDir, err = os.MkdirTemp("", "virter-build-matrix-")
+				if err != nil {
+					log.Fatalf("Failed to create log directory: %v", err)
+				}
+			}
+
+			if firstID == 0 && viper.GetBool("libvirt.static_dhcp") {
+				log.Fatal("--id is required in static DHCP mode")
+			}
+
+			results := make([]buildMatrixResult, len(bases))
+			for i, base := range bases {
+				id := firstID + uint(i)
+				if firstID == 0 {
+					id, err = v.GetVMID(0, false)
+					if err != nil {
+						log.Fatalf("Failed to assign an ID for the build of %s: %v", names[i], err)
+					}
+				}
+
+				buildLogDir := filepath.Join(logDir, LocalImageName(names[i]))
+				if err := os.MkdirAll(buildLogDir, 0o755); err != nil {
+					log.Fatalf("Failed to create log directory: %v", err)
+				}
+
+				results[i].build = imageBuild{
+					baseImageName:   base,
+					newImageRef:     names[i],
+					vmID:            id,
+					provisionConfig: provisionConfig,
+					provisionOutput: provisionOutputFlags{
+						logDir:     buildLogDir,
+						reportPath: filepath.Join(buildLogDir, "report.json"),
+					},
+				}
+			}
+
+			p := mpb.NewWithContext(ctx, DefaultContainerOpt())
+
+			var g errgroup.Group
+			g.SetLimit(jobs)
+			for i := range results {
+				result := &results[i]
+				g.Go(func() error {
+					buildLog := log.WithFields(log.Fields{"image": result.build.newImageRef, "id": result.build.vmID})
+					buildLog.Info("Starting build")
+
+					start := time.Now()
+					result.status, result.err = settings.run(ctx, v, result.build, p)
+					result.duration = time.Since(start)
+
+					if result.err != nil {
+						buildLog.WithError(result.err).Error("Build failed")
+					} else {
+						buildLog.Infof("Build finished: %s", result.status)
+					}
+
+					// Failed builds are reported in the summary
+					return nil
+				})
+			}
+			_ = g.Wait()
+
+			p.Wait()
+
+			failed := 0
+			t := table.New("Base", "Image", "ID", "Result", "Duration")
+			for _, result := range results {
+				status := string(result.status)
+				if result.err != nil {
+					failed++
+					status = "failed"
+
+					var keptErr *virter.BuildVMKeptError
+					if errors.As(result.err, &keptErr) {
+						status = fmt.Sprintf("failed, VM %s kept", keptErr.VMName)
+					}
+				}
+
+				t.AddRow(result.build.baseImageName, LocalImageName(result.build.newImageRef), result.build.vmID, status, result.duration.Round(time.Second))
+			}
+			t.Print()
+
+			fmt.Printf("Logs written to %s\n", logDir)
+
+			if failed > 0 {
+				log.Fatalf("%d of %d builds failed", failed, len(results))
+			}
+		},
+		ValidArgsFunction: suggestNone,
+	}
+
+	settings.addFlags(matrixCmd)
+	matrixCmd.Flags().StringSliceVar(&bases, "base", nil, "Base images to build from. Can be given multiple times or as a comma separated list")
+	matrixCmd.Flags().StringVar(&nameTemplate, "name", "", "Template for the names of the new images, for example '{{.Base}}-provisioned'. With --push, this is the registry reference to push to")
+	matrixCmd.Flags().IntVarP(&jobs, "jobs", "j", 4, "Maximum number of images to build in parallel")
+	matrixCmd.Flags().UintVar(&firstID, "id", 0, "ID for the VM of the first build, the following builds use consecutive IDs. By default, free IDs are assigned")
+	matrixCmd.Flags().StringVar(&logDir, "log-dir", "", "Directory to write the logs and reports of the builds to, one subdirectory per image. Defaults to a new temporary directory")
+	_ = matrixCmd.MarkFlagRequired("name")
+
+	return matrixCmd
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/pkg/registry"
+)
+
+// registryImageDefaults converts the defaults of an image registry entry to the defaults recorded in the image.
+func registryImageDefaults(d registry.ImageDefaults) (virter.ImageDefaults, error) {
+	result := virter.ImageDefaults{
+		SSHUser:    d.SSHUser,
+		Firmware:   d.Firmware,
+		SecureBoot: d.SecureBoot,
+		DiskBus:    d.DiskBus,
+	}
+
+	if d.MinMemory != "" {
+		var minMemory Size
+		if err := minMemory.UnmarshalText([]byte(d.MinMemory)); err != nil {
+			return virter.ImageDefaults{}, fmt.Errorf("invalid min_memory: %w", err)
+		}
+		result.MinMemoryKiB = minMemory.KiB
+	}
+
+	if err := result.Check(); err != nil {
+		return virter.ImageDefaults{}, err
+	}
+
+	return result, nil
+}
+
+// imageDefaults returns the defaults recorded in the image.
+func imageDefaults(image *virter.LocalImage) (virter.ImageDefaults, error) {
+	d, err := image.Defaults()
+	if err != nil {
+		return virter.ImageDefaults{}, fmt.Errorf("failed to get defaults of image: %w", err)
+	}
+
+	if labels := d.Labels(); len(labels) > 0 {
+		fields := log.Fields{}
+		for k, v := range labels {
+			fields[k] = v
+		}
+		log.WithFields(fields).Info("Using defaults recorded in the image")
+	}
+
+	return d, nil
+}
+
+// applyImageDefaults changes the VM configuration according to the image defaults. Settings given explicitly by the
+// flags of the command are kept.
+func applyImageDefaults(flags *pflag.FlagSet, d virter.ImageDefaults, c *virter.VMConfig) {
+	if d.SSHUser != "" && !flags.Changed("user") {
+		c.SSHUserName = d.SSHUser
+	}
+
+	if d.MinMemoryKiB > c.MemoryKiB {
+		if flags.Changed("memory") {
+			log.WithFields(log.Fields{"vm": c.Name, "memory": fmt.Sprintf("%dKiB", c.MemoryKiB), "minimum": fmt.Sprintf("%dKiB", d.MinMemoryKiB)}).Warn("Memory is less than the image needs")
+		} else {
+			c.MemoryKiB = d.MinMemoryKiB
+		}
+	}
+
+	if d.SecureBoot && !flags.Changed("secure-boot") {
+		c.SecureBoot = true
+	}
+
+	if c.Firmware == "" {
+		c.Firmware = d.Firmware
+	}
+
+	if c.BootDiskBus == "" {
+		c.BootDiskBus = d.DiskBus
+	}
+}
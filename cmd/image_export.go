@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/vbauerster/mpb/v8"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/pkg/pullpolicy"
+)
+
+func imageExportCommand() *cobra.Command {
+	var ociPath string
+
+	exportCmd := &cobra.Command{
+		Use:   "export name [name...]",
+		Short: "Export images to an OCI image layout",
+		Long: `Export images, including their layers and configuration, to an OCI image layout. The layout is a
+directory, or a tar archive if the path ends with ".tar". Layers shared by several images are only stored once.
+
+Exporting to an existing layout adds the images to it, replacing images of the same name. Use "virter image import"
+to load the images from the layout, for example on a host without access to a registry.`,
+		Example: `virter image export --oci images.tar alma-9 alma-9-drbd`,
+		Args:    cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx := cmd.Context()
+
+			v, err := InitVirter()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			p := mpb.NewWithContext(ctx, DefaultContainerOpt())
+
+			images := make([]*virter.LocalImage, len(args))
+			for i, image := range args {
+				images[i], err = GetLocalImage(ctx, image, image, virter.CpuArchNative, v, pullpolicy.Never, DefaultProgressFormat(p))
+				if err != nil {
+					log.WithError(err).Fatalf("error searching image %s", image)
+				}
+			}
+
+			err = v.ImageExportOCI(ociPath, images)
+			p.Wait()
+			if err != nil {
+				log.WithError(err).Fatal("failed to export images")
+			}
+
+			for _, img := range images {
+				fmt.Printf("Exported %s\n", img.Name())
+			}
+		},
+		ValidArgsFunction: suggestImageNames,
+	}
+
+	exportCmd.Flags().StringVar(&ociPath, "oci", "", "Path of the OCI image layout to write to, a directory or a .tar file")
+	_ = exportCmd.MarkFlagRequired("oci")
+
+	return exportCmd
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/rodaine/table"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func imageHistoryCommand() *cobra.Command {
+	historyCmd := &cobra.Command{
+		Use:   "history name",
+		Short: "Show the history of an image",
+		Long: `Show the builds that created a local image, newest first. The comment of builds done by virter is the
+build ID or the build cache key.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := InitVirter()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			img := findLocalImage(v, args[0])
+
+			history, err := img.History()
+			if err != nil {
+				log.Fatalf("failed to get image history: %v", err)
+			}
+
+			now := time.Now()
+
+			t := table.New("Created", "Created By", "Comment")
+			for i := len(history) - 1; i >= 0; i-- {
+				entry := history[i]
+
+				created := "unknown"
+				if !entry.Created.IsZero() {
+					created = fmt.Sprintf("%s ago", units.HumanDuration(now.Sub(entry.Created.Time)))
+				}
+
+				t.AddRow(created, entry.CreatedBy, entry.Comment)
+			}
+			t.Print()
+		},
+		ValidArgsFunction: suggestImageNames,
+	}
+
+	return historyCmd
+}
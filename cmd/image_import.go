@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/vbauerster/mpb/v8"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func imageImportCommand() *cobra.Command {
+	var ociPath string
+
+	importCmd := &cobra.Command{
+		Use:   "import [name...]",
+		Short: "Import images from an OCI image layout",
+		Long: `Import images from an OCI image layout, as written by "virter image export". The layout is a directory,
+or a tar archive if the path ends with ".tar". If no names are given, all images in the layout are imported. Layers
+already present in local storage are not imported again.`,
+		Example: `virter image import --oci images.tar alma-9-drbd`,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx := cmd.Context()
+
+			v, err := InitVirter()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			names := make([]string, len(args))
+			for i, name := range args {
+				names[i] = LocalImageName(name)
+			}
+
+			p := mpb.NewWithContext(ctx, DefaultContainerOpt())
+
+			images, err := v.ImageImportOCI(ociPath, names, virter.WithProgress(DefaultProgressFormat(p)))
+			p.Wait()
+			for _, img := range images {
+				fmt.Printf("Imported %s\n", img.Name())
+			}
+
+			if err != nil {
+				log.WithError(err).Fatal("failed to import images")
+			}
+		},
+		ValidArgsFunction: suggestNone,
+	}
+
+	importCmd.Flags().StringVar(&ociPath, "oci", "", "Path of the OCI image layout to read from, a directory or a .tar file")
+	_ = importCmd.MarkFlagRequired("oci")
+
+	return importCmd
+}
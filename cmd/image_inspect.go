@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	regv1 "github.com/google/go-containerregistry/pkg/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+// imageInspectOutput is the information about an image printed by "image inspect"
+type imageInspectOutput struct {
+	Name string `json:"name"`
+	// ID is the digest of the image configuration, as for container images
+	ID      string     `json:"id"`
+	Created *time.Time `json:"created,omitempty"`
+	// BuildCacheKey is the key of the build that created the image, if it was built by virter
+	BuildCacheKey string                  `json:"build_cache_key,omitempty"`
+	Provenance    *virter.ImageProvenance `json:"provenance,omitempty"`
+	Layers        []imageInspectLayer     `json:"layers"`
+	History       []regv1.History         `json:"history"`
+	Config        *regv1.ConfigFile       `json:"config"`
+}
+
+// imageInspectLayer describes one layer of an image, oldest first
+type imageInspectLayer struct {
+	DiffID string `json:"diff_id"`
+	// Size is the space the layer takes up in the storage pool
+	Size uint64 `json:"size"`
+	// Capacity is the size of the disk as seen by a VM
+	Capacity uint64 `json:"capacity"`
+}
+
+// findLocalImage looks up an image in local storage, exiting if it does not exist.
+func findLocalImage(v *virter.Virter, image string) *virter.LocalImage {
+	img, err := v.FindImage(LocalImageName(image), v.ProvisionStoragePool())
+	if err != nil {
+		log.Fatalf("failed to find image: %v", err)
+	}
+
+	if img == nil {
+		log.Fatalf("image %s not present in local storage", image)
+	}
+
+	return img
+}
+
+func imageInspectCommand() *cobra.Command {
+	inspectCmd := &cobra.Command{
+		Use:   "inspect name",
+		Short: "Show details of an image",
+		Long: `Show details of a local image as JSON: its layers and their sizes, the history of builds that created it
+and, for images built by virter, the provenance of the build.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := InitVirter()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			img := findLocalImage(v, args[0])
+
+			cfg, err := img.ConfigFile()
+			if err != nil {
+				log.Fatalf("failed to get image configuration: %v", err)
+			}
+
+			id, err := img.ConfigName()
+			if err != nil {
+				log.Fatalf("failed to get image ID: %v", err)
+			}
+
+			volumeLayers, err := img.VolumeLayers()
+			if err != nil {
+				log.Fatalf("failed to get image layers: %v", err)
+			}
+
+			layers := make([]imageInspectLayer, len(volumeLayers))
+			for i, layer := range volumeLayers {
+				diffID, err := layer.DiffID()
+				if err != nil {
+					log.Fatalf("failed to get layer ID: %v", err)
+				}
+
+				capacity, allocation, err := layer.Sizes()
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				layers[i] = imageInspectLayer{
+					DiffID:   diffID.String(),
+					Size:     allocation,
+					Capacity: capacity,
+				}
+			}
+
+			output := imageInspectOutput{
+				Name:       img.Name(),
+				ID:         id.String(),
+				Provenance: virter.ImageProvenanceFromConfig(cfg),
+				Layers:     layers,
+				History:    cfg.History,
+				Config:     cfg,
+			}
+
+			if !cfg.Created.IsZero() {
+				output.Created = &cfg.Created.Time
+			}
+
+			if len(cfg.History) > 0 {
+				output.BuildCacheKey = cfg.History[len(cfg.History)-1].Comment
+			}
+
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(output); err != nil {
+				log.Fatal(fmt.Errorf("failed to print image configuration: %w", err))
+			}
+		},
+		ValidArgsFunction: suggestImageNames,
+	}
+
+	return inspectCmd
+}
@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"path"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -12,14 +16,71 @@ import (
 	"github.com/LINBIT/virter/internal/virter"
 )
 
+// downloadToTempFile downloads the given URL to a temporary file. The caller has to remove the file.
+func downloadToTempFile(ctx context.Context, url string, bar virter.ProgressOpt) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad http status: %v", response.Status)
+	}
+
+	f, err := os.CreateTemp("", "virter-download-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer f.Close()
+
+	b := bar.NewBar(path.Base(req.URL.Path), "download", response.ContentLength)
+	defer b.SetTotal(-1, true)
+
+	if _, err := io.Copy(f, b.ProxyReader(response.Body)); err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("failed to download %s: %w", url, err)
+	}
+
+	return f.Name(), nil
+}
+
 func imageLoadCommand() *cobra.Command {
+	var format virter.DiskFormat
+	var vagrantBox string
+	var ova string
+	var sshUser string
+
 	load := &cobra.Command{
 		Use:   "load name [file]",
 		Short: "Load an image",
-		Long: `Load an image from a standalone qcow2 image. If the second argument is omitted, the image will be 
-read from stdin`,
-		Args: cobra.RangeArgs(1, 2),
+		Long: `Load an image from a standalone disk image. If the second argument is omitted, the image will be
+read from stdin. The format of the disk image and its compression (gzip or zstd) are detected, unless the format is
+given. Disk images in formats other than qcow2 are converted by libvirt, VHDX images by qemu-img on this host.
+
+With --vagrant or --ova, the disk image is taken from a Vagrant box or an OVA appliance, which can be given as file or
+URL. The SSH user of a Vagrant box is recorded in the image, so that "vm run" uses it by default.`,
+		Example: `virter image load --vagrant https://example.com/boxes/alma-9-libvirt.box alma-9-vagrant`,
+		Args:    cobra.RangeArgs(1, 2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if vagrantBox != "" && ova != "" {
+				return fmt.Errorf("--vagrant and --ova cannot be used together")
+			}
+
+			if (vagrantBox != "" || ova != "") && len(args) > 1 {
+				return fmt.Errorf("no file argument allowed with --vagrant or --ova")
+			}
+
+			return nil
+		},
 		Run: func(cmd *cobra.Command, args []string) {
+			ctx := cmd.Context()
+
 			v, err := InitVirter()
 			if err != nil {
 				log.Fatal(err)
@@ -31,51 +92,25 @@ read from stdin`,
 				log.WithError(err).Fatal("error parsing destination image name")
 			}
 
-			importLayer, err := v.NewDynamicLayer("load-"+image, v.ProvisionStoragePool())
-			if err != nil {
-				log.WithError(err).Fatal("error creating import layer")
-			}
-
 			p := mpb.New(DefaultContainerOpt())
 
-			var in io.Reader
-			if len(args) == 1 {
-				log.Info("loading from stdin")
-				in = os.Stdin
-			} else {
-				f, err := os.Open(args[1])
+			if vagrantBox != "" || ova != "" {
+				err = loadAppliance(ctx, v, p, image, vagrantBox, ova, sshUser)
 				if err != nil {
-					log.WithError(err).Fatal("failed to open input file")
-				}
-				defer f.Close()
-
-				in = f
-
-				// If we can't stat() the file or size is zero, still allow this to continue, could be some special file.
-				stat, err := f.Stat()
-				if err == nil && stat.Size() > 0 {
-					bar := DefaultProgressFormat(p).NewBar(image, "load", stat.Size())
-					in = bar.ProxyReader(in)
+					log.Fatal(err)
 				}
+				return
 			}
 
-			err = importLayer.Upload(in)
-			if err != nil {
-				log.WithError(err).Fatal("error uploading data to layer")
+			inPath := ""
+			if len(args) > 1 {
+				inPath = args[1]
 			}
 
-			vl, err := importLayer.ToVolumeLayer(nil, virter.WithProgress(DefaultProgressFormat(p)))
+			err = loadDiskImage(v, p, image, inPath, format, sshUser)
 			if err != nil {
-				log.WithError(err).Fatal("error persisting imported layer")
-			}
-
-			_, err = v.MakeImage(image, vl)
-			if err != nil {
-				log.WithError(err).Fatal("error tagging volume layer for image")
+				log.Fatal(err)
 			}
-
-			p.Wait()
-			fmt.Printf("Loaded %s\n", image)
 		},
 		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 			if len(args) == 0 {
@@ -88,5 +123,79 @@ read from stdin`,
 		},
 	}
 
+	load.Flags().Var(&format, "format", fmt.Sprintf("Disk format of the input. Detected if not given. Valid values: [%s]", strings.Join(virter.DiskFormatNames(), ", ")))
+
+	load.Flags().StringVar(&vagrantBox, "vagrant", "", "Load the disk of the given Vagrant box file or URL. Boxes for the libvirt and virtualbox providers are supported")
+	load.Flags().StringVar(&ova, "ova", "", "Load the disk of the given OVA appliance file or URL")
+	load.Flags().StringVar(&sshUser, "ssh-user", "", "Record the user to log in as via SSH in the image. Overrides the user of a Vagrant box")
+
 	return load
 }
+
+// loadAppliance creates an image from the disk of the given Vagrant box or OVA appliance, which is downloaded first if
+// it is a URL.
+func loadAppliance(ctx context.Context, v *virter.Virter, p *mpb.Progress, image, vagrantBox, ova, sshUser string) error {
+	source := vagrantBox + ova
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		downloaded, err := downloadToTempFile(ctx, source, DefaultProgressFormat(p))
+		if err != nil {
+			return fmt.Errorf("failed to download appliance: %w", err)
+		}
+		defer os.Remove(downloaded)
+
+		source = downloaded
+	}
+
+	load := v.ImageLoadOVA
+	if vagrantBox != "" {
+		load = v.ImageLoadVagrant
+	}
+
+	_, err := load(image, source, sshUser, virter.WithProgress(DefaultProgressFormat(p)))
+	if err != nil {
+		return fmt.Errorf("error loading image: %w", err)
+	}
+
+	p.Wait()
+	fmt.Printf("Loaded %s\n", image)
+	return nil
+}
+
+// loadDiskImage creates an image from the disk image at inPath, or from stdin if inPath is empty.
+func loadDiskImage(v *virter.Virter, p *mpb.Progress, image, inPath string, format virter.DiskFormat, sshUser string) error {
+	var in io.Reader
+	if inPath == "" {
+		log.Info("loading from stdin")
+		in = os.Stdin
+	} else {
+		f, err := os.Open(inPath)
+		if err != nil {
+			return fmt.Errorf("failed to open input file: %w", err)
+		}
+		defer f.Close()
+
+		in = f
+
+		// If we can't stat() the file or size is zero, still allow this to continue, could be some special file.
+		stat, err := f.Stat()
+		if err == nil && stat.Size() > 0 {
+			bar := DefaultProgressFormat(p).NewBar(image, "load", stat.Size())
+			in = bar.ProxyReader(in)
+		}
+	}
+
+	img, err := v.ImageLoad(image, in, format, virter.WithProgress(DefaultProgressFormat(p)))
+	if err != nil {
+		return fmt.Errorf("error loading image: %w", err)
+	}
+
+	if sshUser != "" {
+		if err := v.SetImageLabels(img, map[string]string{virter.LabelSSHUser: sshUser}); err != nil {
+			return fmt.Errorf("error recording SSH user: %w", err)
+		}
+	}
+
+	p.Wait()
+	fmt.Printf("Loaded %s\n", image)
+	return nil
+}
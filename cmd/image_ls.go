@@ -11,6 +11,8 @@ import (
 	"github.com/rodaine/table"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
 )
 
 func parseLibvirtTimestamp(raw string) (time.Time, error) {
@@ -63,9 +65,17 @@ func imageLsCommand() *cobra.Command {
 					i++
 				}
 				sort.Strings(dists)
-				t := table.New("Name", "URL")
+				t := table.New("Name", "Architectures", "URL")
 				for _, name := range dists {
-					t.AddRow(name, entries[name].URL)
+					entry := entries[name]
+					arches := entry.Architectures()
+					if entry.URL != "" {
+						arches = append(arches, "any")
+					}
+
+					// Show the URL pulled by default
+					source, _ := entry.Source(string(virter.CpuArchNative))
+					t.AddRow(name, strings.Join(arches, ","), source.URL)
 				}
 				t.Print()
 			} else {
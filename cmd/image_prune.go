@@ -15,7 +15,7 @@ func imagePruneCommand() *cobra.Command {
 	pruneCmd := &cobra.Command{
 		Use:   "prune",
 		Short: "Prune unreferenced or unused image layers",
-		Long:  `Prune all image layers not referenced by tag images or VMs`,
+		Long:  `Prune all image layers not referenced by tag images or VMs, including the layers of build checkpoints`,
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			v, err := InitVirter()
@@ -52,6 +52,14 @@ func imagePruneCommand() *cobra.Command {
 				}
 			}
 
+			count, err := v.PruneCheckpoints()
+			if err != nil {
+				log.WithError(err).Fatal("failed to prune build checkpoints")
+			}
+			if count > 0 {
+				log.WithField("count", count).Info("pruned build checkpoints")
+			}
+
 			layers, err := v.LayerList()
 			if err != nil {
 				log.WithError(err).Fatal("failed to get layer list")
@@ -72,6 +80,13 @@ func imagePruneCommand() *cobra.Command {
 					log.WithFields(log.Fields{"layer": layer.Name(), "count": count}).Info("pruned unused layers")
 				}
 			}
+
+			count, err = v.PruneImageConfigs()
+			if err != nil {
+				log.WithError(err).Warn("could not prune image configurations")
+			} else if count > 0 {
+				log.WithField("count", count).Info("pruned unused image configurations")
+			}
 		},
 		ValidArgsFunction: suggestNone,
 	}
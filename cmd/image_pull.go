@@ -7,10 +7,13 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/vbauerster/mpb/v8"
 
+	"github.com/LINBIT/virter/internal/virter"
 	"github.com/LINBIT/virter/pkg/pullpolicy"
 )
 
 func imagePullCommand() *cobra.Command {
+	cpuArch := virter.CpuArchNative
+
 	pullCmd := &cobra.Command{
 		Use:   "pull name [tag|url]",
 		Short: "Pull an image",
@@ -18,7 +21,8 @@ func imagePullCommand() *cobra.Command {
 Container tag is explicitly given, the image will be fetched from there.
 Otherwise the URL for the specified name from the local image registry 
 will be used.`,
-		Args: cobra.RangeArgs(1, 2),
+		Example: `virter image pull --arch arm64 ubuntu-noble-arm64 ubuntu-noble`,
+		Args:    cobra.RangeArgs(1, 2),
 		Run: func(cmd *cobra.Command, args []string) {
 			dest := args[0]
 			source := args[0]
@@ -34,7 +38,7 @@ will be used.`,
 
 			p := mpb.New(DefaultContainerOpt())
 
-			image, err := GetLocalImage(cmd.Context(), dest, source, v, pullpolicy.Always, DefaultProgressFormat(p))
+			image, err := GetLocalImage(cmd.Context(), dest, source, cpuArch, v, pullpolicy.Always, DefaultProgressFormat(p))
 			if err != nil {
 				log.WithError(err).Fatal("failed to pull image")
 			}
@@ -53,5 +57,7 @@ will be used.`,
 		},
 	}
 
+	pullCmd.Flags().VarP(&cpuArch, "arch", "", "CPU architecture of the image to pull from the image registry")
+
 	return pullCmd
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/vbauerster/mpb/v8"
 
+	"github.com/LINBIT/virter/internal/virter"
 	"github.com/LINBIT/virter/pkg/pullpolicy"
 )
 
@@ -38,7 +39,7 @@ func imagePushCommand() *cobra.Command {
 
 			p := mpb.NewWithContext(ctx, DefaultContainerOpt())
 
-			img, err := GetLocalImage(ctx, source, source, v, pullpolicy.Never, DefaultProgressFormat(p))
+			img, err := GetLocalImage(ctx, source, source, virter.CpuArchNative, v, pullpolicy.Never, DefaultProgressFormat(p))
 			if err != nil {
 				log.WithError(err).Fatal("failed to get image")
 			}
@@ -1,114 +1,168 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/vbauerster/mpb/v8"
 	"golang.org/x/term"
 
+	"github.com/LINBIT/virter/internal/virter"
 	"github.com/LINBIT/virter/pkg/pullpolicy"
 )
 
 func imageSaveCommand() *cobra.Command {
+	format := virter.DiskFormatQCOW2
+	compression := virter.DiskCompressionNone
+
 	saveCmd := &cobra.Command{
 		Use:   "save name [file]",
 		Short: "Save an image",
-		Long: `Saves an image as a standalone qcow2 image. If the image uses multiple layers, all layers will be
-squashed into a single file.`,
-		Args: cobra.RangeArgs(1, 2),
+		Long: `Saves an image as a standalone disk image, by default in qcow2 format. If the image uses multiple layers,
+all layers will be squashed into a single file. Conversion to other formats is done by libvirt, except for VHDX and
+qcow2 with compressed clusters, which need qemu-img on this host. The file can be compressed with gzip or zstd,
+"image load" detects the compression. If the file is omitted, the image is written to stdout.`,
+		Example: `virter image save --format vmdk --compress zstd alma-9 alma-9.vmdk.zst`,
+		Args:    cobra.RangeArgs(1, 2),
 		Run: func(cmd *cobra.Command, args []string) {
-			ctx := cmd.Context()
-
 			v, err := InitVirter()
 			if err != nil {
 				log.Fatal(err)
 			}
 			defer v.ForceDisconnect()
 
-			image := args[0]
-			var out io.Writer
-			if len(args) == 1 {
-				out = os.Stdout
-				if term.IsTerminal(int(os.Stdout.Fd())) {
-					log.Fatal("refusing to write image to terminal, redirect or specify a filename")
-				}
-			} else {
-				f, err := os.Create(args[1])
-				if err != nil {
-					log.WithError(err).Fatal("failed to create output file")
-				}
-				defer func() {
-					_ = f.Close()
-					if ctx.Err() != nil {
-						_ = os.Remove(args[1])
-					}
-				}()
-
-				out = f
+			outPath := ""
+			if len(args) > 1 {
+				outPath = args[1]
 			}
 
-			p := mpb.NewWithContext(ctx, DefaultContainerOpt())
-
-			imgRef, err := GetLocalImage(ctx, image, image, v, pullpolicy.Never, DefaultProgressFormat(p))
+			err = saveImage(cmd.Context(), v, args[0], outPath, format, compression)
 			if err != nil {
-				log.WithError(err).Fatalf("error searching image %s", image)
+				log.Fatal(err)
 			}
-
-			if imgRef == nil {
-				log.Fatalf("could not find a local image %s", image)
+		},
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				// Only suggest first argument
+				return suggestImageNames(cmd, args, toComplete)
 			}
 
-			top := imgRef.TopLayer()
+			// Allow files here
+			return nil, cobra.ShellCompDirectiveDefault
+		},
+	}
 
-			squashed, err := top.Squashed()
-			if err != nil {
-				log.WithError(err).Fatal("could not squash image")
-			}
+	saveCmd.Flags().Var(&format, "format", fmt.Sprintf("Disk format to save the image in. Valid values: [%s]", strings.Join(virter.DiskFormatNames(), ", ")))
+	saveCmd.Flags().Var(&compression, "compress", fmt.Sprintf("Compression to apply to the saved file. %s compresses the clusters of a qcow2 image instead of the whole file. Valid values: [%s, %s, %s, %s]", virter.DiskCompressionQCOW2, virter.DiskCompressionNone, virter.DiskCompressionGzip, virter.DiskCompressionZstd, virter.DiskCompressionQCOW2))
 
-			defer func() {
-				err := squashed.Delete()
-				if err != nil {
-					log.WithError(err).Warn("failed to delete squashed volume")
-				}
-			}()
+	return saveCmd
+}
 
-			desc, err := squashed.Descriptor()
-			if err != nil {
-				log.WithError(err).Fatal("could not get description of squashed volume")
+// saveImage writes the image squashed into a single disk image to outPath, or to stdout if outPath is empty. The
+// output file is removed if saving fails.
+func saveImage(ctx context.Context, v *virter.Virter, image, outPath string, format virter.DiskFormat, compression virter.DiskCompression) (err error) {
+	var out io.Writer
+	if outPath == "" {
+		out = os.Stdout
+		if term.IsTerminal(int(os.Stdout.Fd())) {
+			return fmt.Errorf("refusing to write image to terminal, redirect or specify a filename")
+		}
+	} else {
+		f, err := os.Create(outPath)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer func() {
+			_ = f.Close()
+			if err != nil || ctx.Err() != nil {
+				_ = os.Remove(outPath)
 			}
+		}()
 
-			bar := DefaultProgressFormat(p).NewBar(imgRef.Name(), "save", int64(desc.Physical.Value))
+		out = f
+	}
 
-			reader, err := squashed.Uncompressed()
-			if err != nil {
-				log.WithError(err).Fatal("could not get reader from volume")
-			}
+	p := mpb.NewWithContext(ctx, DefaultContainerOpt())
 
-			reader = bar.ProxyReader(reader)
-			defer reader.Close()
+	imgRef, err := GetLocalImage(ctx, image, image, virter.CpuArchNative, v, pullpolicy.Never, DefaultProgressFormat(p))
+	if err != nil {
+		return fmt.Errorf("error searching image %s: %w", image, err)
+	}
 
-			_, err = io.Copy(out, reader)
-			if err != nil {
-				log.WithError(err).Fatal("failed to copy volume content to output")
-			}
+	if imgRef == nil {
+		return fmt.Errorf("could not find a local image %s", image)
+	}
 
-			p.Wait()
-			_, _ = fmt.Fprintf(os.Stderr, "Saved %s\n", imgRef.Name())
-		},
-		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
-			if len(args) == 0 {
-				// Only suggest first argument
-				return suggestImageNames(cmd, args, toComplete)
-			}
+	if compression == virter.DiskCompressionQCOW2 && format != virter.DiskFormatQCOW2 {
+		return fmt.Errorf("compression %s needs format %s", compression, virter.DiskFormatQCOW2)
+	}
 
-			// Allow files here
-			return nil, cobra.ShellCompDirectiveDefault
-		},
+	// Formats libvirt can not write are converted from qcow2 on this host
+	convertLocally := format.ConvertedLocally() || compression == virter.DiskCompressionQCOW2
+	squashFormat := format
+	if convertLocally {
+		squashFormat = virter.DiskFormatQCOW2
 	}
 
-	return saveCmd
+	top := imgRef.TopLayer()
+
+	squashed, err := top.SquashedAs(squashFormat)
+	if err != nil {
+		return fmt.Errorf("could not squash image: %w", err)
+	}
+
+	defer func() {
+		err := squashed.Delete()
+		if err != nil {
+			log.WithError(err).Warn("failed to delete squashed volume")
+		}
+	}()
+
+	desc, err := squashed.Descriptor()
+	if err != nil {
+		return fmt.Errorf("could not get description of squashed volume: %w", err)
+	}
+
+	bar := DefaultProgressFormat(p).NewBar(imgRef.Name(), "save", int64(desc.Physical.Value))
+
+	reader, err := squashed.Uncompressed()
+	if err != nil {
+		return fmt.Errorf("could not get reader from volume: %w", err)
+	}
+
+	reader = bar.ProxyReader(reader)
+	defer reader.Close()
+
+	if convertLocally {
+		converted, err := virter.ConvertDiskImage(reader, squashFormat, format, compression == virter.DiskCompressionQCOW2)
+		if err != nil {
+			return err
+		}
+		defer converted.Close()
+
+		reader = converted
+	}
+
+	compressed, err := virter.CompressingWriter(out, compression)
+	if err != nil {
+		return fmt.Errorf("failed to compress output: %w", err)
+	}
+
+	_, err = io.Copy(compressed, reader)
+	if err != nil {
+		return fmt.Errorf("failed to copy volume content to output: %w", err)
+	}
+
+	if err := compressed.Close(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	p.Wait()
+	_, _ = fmt.Fprintf(os.Stderr, "Saved %s\n", imgRef.Name())
+	return nil
 }
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func imageTagCommand() *cobra.Command {
+	tagCmd := &cobra.Command{
+		Use:   "tag source target",
+		Short: "Create another name for an image",
+		Long: `Create the image target, referring to the same layers as the image source. No data is copied, so this is
+instant. An existing image named target is replaced. Removing either of the images does not affect the other one.`,
+		Example: `virter image tag foo:candidate foo:stable`,
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := InitVirter()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			source := LocalImageName(args[0])
+			target := LocalImageName(args[1])
+
+			if _, err := v.ImageTag(source, target); err != nil {
+				log.Fatalf("failed to tag image: %v", err)
+			}
+
+			log.WithFields(log.Fields{"source": source, "target": target}).Info("tagged image")
+		},
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return suggestImageNames(cmd, args, toComplete)
+			}
+
+			return suggestNone(cmd, args, toComplete)
+		},
+	}
+
+	return tagCmd
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func provisionCommand() *cobra.Command {
+	provisionCmd := &cobra.Command{
+		Use:   "provision",
+		Short: "Provisioning file related subcommands",
+		Long:  `Provisioning file related subcommands.`,
+	}
+
+	provisionCmd.AddCommand(provisionValidateCommand())
+
+	return provisionCmd
+}
+
+// provisionOutputFlags holds the flags controlling the logs and reports written while provisioning
+type provisionOutputFlags struct {
+	logDir     string
+	reportPath string
+}
+
+func (f *provisionOutputFlags) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.logDir, "log-dir", "", "Directory to write one log file per VM and provisioning step to")
+	cmd.Flags().StringVar(&f.reportPath, "report", "", `File to write a report of all provisioning steps to. Written in JUnit format if the name ends in ".xml", in JSON format otherwise`)
+}
+
+// newReport returns a report to collect the provisioning results in, or nil if no report was requested.
+func (f *provisionOutputFlags) newReport() *virter.ProvisionReport {
+	if f.reportPath == "" {
+		return nil
+	}
+	return &virter.ProvisionReport{}
+}
+
+// writeReport writes the report if one was requested. Errors are only logged, so that they do not hide the
+// result of the provisioning itself.
+func (f *provisionOutputFlags) writeReport(report *virter.ProvisionReport) {
+	if report == nil {
+		return
+	}
+
+	if err := report.WriteFile(f.reportPath); err != nil {
+		log.Errorf("Failed to write provisioning report: %v", err)
+	}
+}
+
+// loadAndValidateProvisionConfig resolves the provisioning files and checks everything that can be checked without a VM.
+func loadAndValidateProvisionConfig(provFiles []string, provOpt virter.ProvisionOption) (virter.ProvisionConfig, error) {
+	pc, err := virter.NewProvisionConfigFiles(provFiles, provOpt)
+	if err != nil {
+		return pc, err
+	}
+
+	if err := pc.Validate(); err != nil {
+		return pc, err
+	}
+
+	return pc, nil
+}
+
+// printProvisionConfig writes the fully resolved provisioning steps in TOML format, with the values of secrets replaced.
+func printProvisionConfig(w io.Writer, pc virter.ProvisionConfig) error {
+	if err := pc.EncodeTOML(w); err != nil {
+		return fmt.Errorf("failed to print provisioning config: %w", err)
+	}
+	return nil
+}
+
+// checkContainerImages looks up the container images used by the provisioning in their registries. Images with the
+// pull policy Never are not looked up, as they have to exist locally.
+func checkContainerImages(ctx context.Context, pc virter.ProvisionConfig) error {
+	var result error
+	for _, image := range pc.RegistryContainerImages() {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid container image %q: %w", image, err))
+			continue
+		}
+
+		log.WithField("image", image).Debug("looking up container image")
+		_, err = remote.Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("container image %q not found: %w", image, err))
+		}
+	}
+
+	return result
+}
+
+// warnContainerImagesUnchecked tells the user that the container images were only checked syntactically.
+func warnContainerImagesUnchecked(pc virter.ProvisionConfig) {
+	if len(pc.RegistryContainerImages()) > 0 {
+		log.Warn("Container images were not looked up, use 'virter provision validate --check-images' to check that they exist")
+	}
+}
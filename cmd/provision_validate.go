@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/pkg/pullpolicy"
+)
+
+func provisionValidateCommand() *cobra.Command {
+	var provisionOverrides []string
+	var provisionFormat virter.ProvisionFormat
+	var containerPullPolicy pullpolicy.PullPolicy
+	var checkImages bool
+
+	validateCmd := &cobra.Command{
+		Use:   "validate [file...]",
+		Short: "Check provisioning files and print the resolved steps",
+		Long: `Check provisioning files without running them. The files and all their includes are
+loaded and the values from --set are applied. Templates, the file version, host paths and container
+image references are checked. If everything is valid, the fully resolved steps are printed.
+
+Container images are only checked to exist with --check-images, which looks them up in their registries.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 && len(provisionOverrides) == 0 {
+				return fmt.Errorf("requires at least one provisioning file or --set value")
+			}
+			for _, arg := range args {
+				if _, err := os.Stat(arg); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			provOpt := virter.ProvisionOption{
+				Overrides:          provisionOverrides,
+				DefaultPullPolicy:  getDefaultContainerPullPolicy(),
+				OverridePullPolicy: containerPullPolicy,
+				Format:             provisionFormat,
+			}
+
+			pc, err := loadAndValidateProvisionConfig(args, provOpt)
+			if err != nil {
+				log.Fatalf("Invalid provisioning configuration: %v", err)
+			}
+
+			if checkImages {
+				if err := checkContainerImages(cmd.Context(), pc); err != nil {
+					log.Fatalf("Invalid provisioning configuration: %v", err)
+				}
+			} else {
+				warnContainerImagesUnchecked(pc)
+			}
+
+			if err := printProvisionConfig(os.Stdout, pc); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	validateCmd.Flags().StringArrayVarP(&provisionOverrides, "set", "s", []string{}, "set/override provisioning steps")
+	validateCmd.Flags().VarP(&provisionFormat, "provision-format", "", fmt.Sprintf("Format of the provisioning files. Detected from the file extension if not given. Valid values: [%s, %s, %s]", virter.ProvisionFormatTOML, virter.ProvisionFormatYAML, virter.ProvisionFormatJSON))
+	validateCmd.Flags().BoolVar(&checkImages, "check-images", false, "Look up the container images in their registries. Images only available locally are reported as missing, unless their pull policy is Never")
+	validateCmd.Flags().VarP(&containerPullPolicy, "container-pull-policy", "", fmt.Sprintf("Whether or not to pull container images used during provisioning. Overrides the `pull` value of every provision step. Valid values: [%s, %s, %s]", pullpolicy.Always, pullpolicy.IfNotExist, pullpolicy.Never))
+
+	return validateCmd
+}
@@ -14,7 +14,10 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var upstreamRegistryURL = fmt.Sprintf("https://linbit.github.io/virter/v%d/images.toml", registry.CurrentRegistryFileVersion)
+// upstreamRegistryURL returns the URL of the shipped image registry in the given registry file version.
+func upstreamRegistryURL(version int) string {
+	return fmt.Sprintf("https://linbit.github.io/virter/v%d/images.toml", version)
+}
 
 const longRegistryCommandText = `Image registry related subcommands.
 To manipulate the registry config: '%s'`
@@ -27,6 +30,7 @@ func registryCommand() *cobra.Command {
 	}
 
 	registryCmd.AddCommand(registryUpdateCommand())
+	registryCmd.AddCommand(registryMigrateCommand())
 
 	return registryCmd
 }
@@ -55,11 +59,23 @@ func fetchShippedRegistry(path string) error {
 			dir, err)
 	}
 
-	log.Debugf("Fetching shipped registry from '%s'", upstreamRegistryURL)
+	// Older registry file versions are migrated when loading, so fall back to them until the current version is
+	// published.
+	var resp *http.Response
+	for version := registry.CurrentRegistryFileVersion; version >= 1; version-- {
+		url := upstreamRegistryURL(version)
+		log.Debugf("Fetching shipped registry from '%s'", url)
 
-	resp, err := http.Get(upstreamRegistryURL)
-	if err != nil {
-		return err
+		resp, err = http.Get(url)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusNotFound || version == 1 {
+			break
+		}
+
+		resp.Body.Close()
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/pkg/registry"
+)
+
+func registryMigrateCommand() *cobra.Command {
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate the user-defined image registry to the current file version",
+		Long: fmt.Sprintf(`Rewrite the user-defined image registry file '%s' in the current
+file version. The original file is kept next to it, with the old version
+as suffix. Files in older versions are also migrated when they are loaded,
+so this is only needed to use features of the current version.`, userRegistryFile()),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			path := userRegistryFile()
+			migrated, err := registry.MigrateFile(path)
+			if err != nil {
+				log.Fatalf("Failed to migrate registry: %v", err)
+			}
+
+			if !migrated {
+				log.Infof("Registry at '%s' already has version %d", path, registry.CurrentRegistryFileVersion)
+				return
+			}
+
+			log.Infof("Successfully migrated registry at '%s' to version %d", path, registry.CurrentRegistryFileVersion)
+		},
+	}
+
+	return migrateCmd
+}
@@ -60,6 +60,7 @@ and resetting, for a stable test environment.`,
 	rootCmd.AddCommand(vmCommand())
 	rootCmd.AddCommand(networkCommand())
 	rootCmd.AddCommand(registryCommand())
+	rootCmd.AddCommand(provisionCommand())
 	return rootCmd
 }
 
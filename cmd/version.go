@@ -6,21 +6,26 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// virterVersion returns the version of this virter binary, "DEV" for development builds
+func virterVersion() string {
+	if version == "" {
+		return "DEV"
+	}
+	return version
+}
+
 func versionCommand() *cobra.Command {
 	return &cobra.Command{
 		Use:   "version",
 		Short: "Print version information of virter",
 		Run: func(cmd *cobra.Command, args []string) {
-			if version == "" {
-				version = "DEV"
-			}
 			if builddate == "" {
 				builddate = "DEV"
 			}
 			if githash == "" {
 				githash = "DEV"
 			}
-			fmt.Printf("virter version %s\n", version)
+			fmt.Printf("virter version %s\n", virterVersion())
 			fmt.Printf("Built at %s\n", builddate)
 			fmt.Printf("Version control hash: %s\n", githash)
 
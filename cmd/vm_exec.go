@@ -4,9 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
-	"strings"
 
 	"golang.org/x/crypto/ssh"
 
@@ -22,27 +20,40 @@ import (
 )
 
 // logProvisioningErrorAndExit logs an error from a virter.VMExec* function and exits with the appropriate exit code.
-// If the error is from a failed SSH or container provisioning step, the exit code is the exit code
-// of the respective command.
-// Otherwise, the exit code is 1.
+// See provisioningExitCode for the exit code.
 func logProvisioningErrorAndExit(err error) {
 	log.Errorf("Failed to build image: %v", err)
+	os.Exit(provisioningExitCode(err))
+}
+
+// provisioningExitCode returns the exit code for an error from a virter.VMExec* function.
+// If the error is from a failed SSH, container or ansible provisioning step, the exit code is the exit code
+// of the respective command.
+// Otherwise, the exit code is 1.
+func provisioningExitCode(err error) int {
 	var sshErr *ssh.ExitError
 	if errors.As(err, &sshErr) {
-		os.Exit(sshErr.ExitStatus())
+		return sshErr.ExitStatus()
 	}
 	var containerErr *virter.ContainerExitError
 	if errors.As(err, &containerErr) {
-		os.Exit(containerErr.Status)
+		return containerErr.Status
+	}
+	var ansibleErr *virter.AnsibleExitError
+	if errors.As(err, &ansibleErr) {
+		return ansibleErr.Status
 	}
-	os.Exit(1)
+	return 1
 }
 
 func vmExecCommand() *cobra.Command {
-	var provFile FileVar
+	var provFiles FileListVar
 	var provisionOverrides []string
+	var provisionFormat virter.ProvisionFormat
 
 	var containerPullPolicy pullpolicy.PullPolicy
+	var dryRun bool
+	var output provisionOutputFlags
 
 	execCmd := &cobra.Command{
 		Use:   "exec vm_name [vm_name...]",
@@ -54,23 +65,40 @@ func vmExecCommand() *cobra.Command {
 				Overrides:          provisionOverrides,
 				DefaultPullPolicy:  getDefaultContainerPullPolicy(),
 				OverridePullPolicy: containerPullPolicy,
+				Format:             provisionFormat,
 			}
-			if err := execProvision(cmd.Context(), provFile.File, provOpt, args); err != nil {
+
+			if dryRun {
+				pc, err := loadAndValidateProvisionConfig(provFiles.Files, provOpt)
+				if err != nil {
+					log.Fatalf("Invalid provisioning configuration: %v", err)
+				}
+				warnContainerImagesUnchecked(pc)
+				if err := printProvisionConfig(os.Stdout, pc); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			if err := execProvision(cmd.Context(), provFiles.Files, provOpt, args, output); err != nil {
 				logProvisioningErrorAndExit(err)
 			}
 		},
 		ValidArgsFunction: suggestVmNames,
 	}
 
-	execCmd.Flags().VarP(&provFile, "provision", "p", "name of toml file containing provisioning steps")
+	execCmd.Flags().VarP(&provFiles, "provision", "p", "name of file containing provisioning steps. Can be specified multiple times, the files are concatenated in order")
+	execCmd.Flags().VarP(&provisionFormat, "provision-format", "", fmt.Sprintf("Format of the provisioning files. Detected from the file extension if not given. Valid values: [%s, %s, %s]", virter.ProvisionFormatTOML, virter.ProvisionFormatYAML, virter.ProvisionFormatJSON))
 	execCmd.Flags().StringArrayVarP(&provisionOverrides, "set", "s", []string{}, "set/override provisioning steps")
 	execCmd.Flags().VarP(&containerPullPolicy, "container-pull-policy", "", fmt.Sprintf("Whether or not to pull container images used during provisioning. Overrides the `pull` value of every provision step. Valid values: [%s, %s, %s]", pullpolicy.Always, pullpolicy.IfNotExist, pullpolicy.Never))
+	execCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only check the provisioning configuration and print the resolved steps, without connecting to libvirt or the VMs")
+	output.addFlags(execCmd)
 
 	return execCmd
 }
 
-func execProvision(ctx context.Context, provFileReader io.ReadCloser, provOpt virter.ProvisionOption, vmNames []string) error {
-	pc, err := virter.NewProvisionConfig(provFileReader, provOpt)
+func execProvision(ctx context.Context, provFiles []string, provOpt virter.ProvisionOption, vmNames []string, output provisionOutputFlags) error {
+	pc, err := virter.NewProvisionConfigFiles(provFiles, provOpt)
 	if err != nil {
 		return err
 	}
@@ -80,40 +108,27 @@ func execProvision(ctx context.Context, provFileReader io.ReadCloser, provOpt vi
 	}
 	defer v.ForceDisconnect()
 
-	for _, s := range pc.Steps {
-		if s.Container != nil {
-			if err := execContainer(ctx, v, s.Container, vmNames); err != nil {
-				return err
-			}
-		} else if s.Shell != nil {
-			if err := v.VMExecShell(ctx, vmNames, s.Shell); err != nil {
-				return err
-			}
-		} else if s.Rsync != nil {
-			copier := netcopy.NewRsyncNetworkCopier()
-			if err := v.VMExecRsync(ctx, copier, vmNames, s.Rsync); err != nil {
-				return err
-			}
-		}
+	tools := virter.ProvisionTools{
+		ShellClientBuilder: SSHClientBuilder{},
+		NetworkCopier:      netcopy.NewRsyncNetworkCopier(),
 	}
 
-	return nil
-}
-
-func execContainer(ctx context.Context, v *virter.Virter, s *virter.ProvisionContainerStep, vmNames []string) error {
-	containerProvider, err := containerapi.NewProvider(ctx, containerProvider())
-	if err != nil {
-		return err
+	if pc.NeedsContainers() {
+		containerProvider, err := containerapi.NewProvider(ctx, containerProvider())
+		if err != nil {
+			return err
+		}
+		defer containerProvider.Close()
+		tools.ContainerProvider = containerProvider
 	}
-	defer containerProvider.Close()
 
-	containerCfg := containerapi.NewContainerConfig(
-		"virter-"+strings.Join(vmNames, "-"),
-		s.Image,
-		s.Env,
-		containerapi.WithCommand(s.Command...),
-		containerapi.WithPullConfig(s.Pull.ForContainer()),
-	)
+	execConfig := virter.ProvisionExecConfig{
+		ReadyConfig: getReadyConfig(),
+		LogDir:      output.logDir,
+		Report:      output.newReport(),
+	}
 
-	return v.VMExecContainer(ctx, containerProvider, vmNames, containerCfg, s.Copy)
+	err = v.VMExecProvision(ctx, tools, vmNames, pc, execConfig)
+	output.writeReport(execConfig.Report)
+	return err
 }
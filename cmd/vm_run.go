@@ -91,8 +91,10 @@ func vmRunCommand() *cobra.Command {
 	var mountStrings []string
 	var mounts []virter.Mount
 
-	var provFile FileVar
+	var provFiles FileListVar
+	var provisionOutput provisionOutputFlags
 	var provisionOverrides []string
+	var provisionFormat virter.ProvisionFormat
 
 	var user string
 	var vncEnabled bool
@@ -152,20 +154,25 @@ func vmRunCommand() *cobra.Command {
 			extraAuthorizedKeys := extraAuthorizedKeys()
 
 			p := mpb.New(DefaultContainerOpt())
-			image, err := GetLocalImage(ctx, args[0], args[0], v, vmPullPolicy, DefaultProgressFormat(p))
+			image, err := GetLocalImage(ctx, args[0], args[0], cpuArch, v, vmPullPolicy, DefaultProgressFormat(p))
 			if err != nil {
 				log.Fatalf("Error while getting image: %v", err)
 			}
 
 			p.Wait()
 
+			defaults, err := imageDefaults(image)
+			if err != nil {
+				log.Fatal(err)
+			}
+
 			consoleDir, err = createConsoleDir(consoleDir)
 			if err != nil {
 				log.Fatalf("Error while creating console directory: %v", err)
 			}
 
 			// do we want to run provisioning steps?
-			provision := provFile.File != nil || len(provisionOverrides) > 0
+			provision := len(provFiles.Files) > 0 || len(provisionOverrides) > 0
 
 			// if we want to run some provisioning steps later,
 			// it doesn't make sense not to wait for SSH.
@@ -231,6 +238,7 @@ func vmRunCommand() *cobra.Command {
 						VNCIPv4BindAddress: vncIPv4BindAddress,
 						SSHUserName:        user,
 					}
+					applyImageDefaults(cmd.Flags(), defaults, &c)
 
 					err = v.VMRun(c)
 					if err != nil {
@@ -255,8 +263,9 @@ func vmRunCommand() *cobra.Command {
 					Overrides:          provisionOverrides,
 					DefaultPullPolicy:  getDefaultContainerPullPolicy(),
 					OverridePullPolicy: containerPullPolicy,
+					Format:             provisionFormat,
 				}
-				if err := execProvision(ctx, provFile.File, provOpt, vmNames); err != nil {
+				if err := execProvision(ctx, provFiles.Files, provOpt, vmNames, provisionOutput); err != nil {
 					log.Fatal(err)
 				}
 			}
@@ -300,12 +309,14 @@ func vmRunCommand() *cobra.Command {
 	runCmd.Flags().StringArrayVarP(&nicStrings, "nic", "i", []string{}, `Add a NIC to the VM. Format: "type=network,source=some-net-name". Type can also be "bridge", in which case the source is the bridge device name. Additional config options are "model" (default: virtio) and "mac" (default chosen by libvirt). Can be specified multiple times`)
 	runCmd.Flags().StringArrayVarP(&mountStrings, "mount", "v", []string{}, `Mount a host path in the VM, like a bind mount. Format: "host=/path/on/host,vm=/path/in/vm"`)
 
-	runCmd.Flags().VarP(&provFile, "provision", "p", "name of toml file containing provisioning steps")
+	runCmd.Flags().VarP(&provFiles, "provision", "p", "name of file containing provisioning steps. Can be specified multiple times, the files are concatenated in order")
+	runCmd.Flags().VarP(&provisionFormat, "provision-format", "", fmt.Sprintf("Format of the provisioning files. Detected from the file extension if not given. Valid values: [%s, %s, %s]", virter.ProvisionFormatTOML, virter.ProvisionFormatYAML, virter.ProvisionFormatJSON))
 	runCmd.Flags().StringArrayVarP(&provisionOverrides, "set", "s", []string{}, "set/override provisioning steps")
+	provisionOutput.addFlags(runCmd)
 
 	runCmd.Flags().VarP(&vmPullPolicy, "vm-pull-policy", "", fmt.Sprintf("Whether or not to pull the source image. Valid values: [%s, %s, %s]", pullpolicy.Always, pullpolicy.IfNotExist, pullpolicy.Never))
 	runCmd.Flags().VarP(&containerPullPolicy, "container-pull-policy", "", fmt.Sprintf("Whether or not to pull container images used during provisioning. Overrides the `pull` value of every provision step. Valid values: [%s, %s, %s]", pullpolicy.Always, pullpolicy.IfNotExist, pullpolicy.Never))
-	runCmd.Flags().StringVarP(&user, "user", "u", "root", "Remote user for ssh session")
+	runCmd.Flags().StringVarP(&user, "user", "u", "root", "Remote user for ssh session. Defaults to the user recorded in the image, if any")
 	runCmd.Flags().BoolVarP(&vncEnabled, "vnc", "", false, "whether to configure VNC (remote GUI access) for the VM (defaults to false)")
 	runCmd.Flags().IntVar(&vncPort, "vnc-port", 0, "VNC port. Defaults to 6000+id of this VM")
 	runCmd.Flags().StringVar(&vncIPv4BindAddress, "vnc-bind-ip", "127.0.0.1", "VNC IPv4 address to bind VNC listening socket to")
@@ -0,0 +1,230 @@
+package virter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/LINBIT/containerapi"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ansibleContainerDir is where the generated inventory and variables are mounted in the container
+	ansibleContainerDir = "/virter/ansible"
+	// ansibleContainerWorkspace is where the working directory is mounted in the container
+	ansibleContainerWorkspace = "/virter/workspace"
+	// ansibleInventoryGroup is the inventory group containing all target VMs
+	ansibleInventoryGroup = "virter"
+)
+
+// AnsibleExitError is returned when ansible-playbook exits with a non-zero exit code
+type AnsibleExitError struct {
+	Status int
+}
+
+func (e *AnsibleExitError) Error() string {
+	return fmt.Sprintf("ansible-playbook exited with status %d", e.Status)
+}
+
+// ansibleHost is a single host in the generated inventory
+type ansibleHost struct {
+	Name string
+	IP   string
+	User string
+}
+
+// writeAnsibleInventory writes an inventory in INI format, containing all hosts in a single group.
+func writeAnsibleInventory(w io.Writer, hosts []ansibleHost) error {
+	_, err := fmt.Fprintf(w, "[%s]\n", ansibleInventoryGroup)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hosts {
+		_, err := fmt.Fprintf(w, "%s ansible_host=%s ansible_user=%s\n", h.Name, h.IP, h.User)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ansiblePlaybookArgs returns the arguments for ansible-playbook. dir is the directory containing the generated
+// inventory and variables.
+func ansiblePlaybookArgs(dir, keyPath, knownHostsPath, playbook string, extraArgs []string) []string {
+	args := []string{
+		"--inventory", path.Join(dir, "inventory"),
+		"--private-key", keyPath,
+		"--ssh-common-args", fmt.Sprintf("-o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes", knownHostsPath),
+		"--extra-vars", "@" + path.Join(dir, "values.json"),
+	}
+	args = append(args, extraArgs...)
+	return append(args, playbook)
+}
+
+// writeAnsibleFiles writes the inventory and the variables for ansible-playbook to dir.
+func writeAnsibleFiles(dir string, hosts []ansibleHost, values map[string]string) error {
+	inventory, err := os.Create(filepath.Join(dir, "inventory"))
+	if err != nil {
+		return fmt.Errorf("failed to create inventory: %w", err)
+	}
+	defer inventory.Close()
+
+	err = writeAnsibleInventory(inventory, hosts)
+	if err != nil {
+		return fmt.Errorf("failed to write inventory: %w", err)
+	}
+
+	err = inventory.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close inventory: %w", err)
+	}
+
+	if values == nil {
+		values = map[string]string{}
+	}
+
+	valuesJSON, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to encode values: %w", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "values.json"), valuesJSON, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write values: %w", err)
+	}
+
+	return nil
+}
+
+// VMExecAnsible runs an Ansible playbook against some VMs. The values are passed to the playbook as extra vars.
+func (v *Virter) VMExecAnsible(ctx context.Context, containerProvider containerapi.ContainerProvider, vmNames []string, ansibleStep *ProvisionAnsibleStep, values map[string]string) error {
+	return v.vmExecAnsible(ctx, containerProvider, vmNames, ansibleStep, values, "virter-"+strings.Join(vmNames, "-"), nil)
+}
+
+// vmExecAnsible runs an Ansible playbook against some VMs, on the host or in a container if the step has an image.
+// If logFile is not nil, the output of ansible-playbook is also written to it.
+func (v *Virter) vmExecAnsible(ctx context.Context, containerProvider containerapi.ContainerProvider, vmNames []string, ansibleStep *ProvisionAnsibleStep, values map[string]string, containerName string, logFile io.Writer) error {
+	ips, err := v.getIPs(vmNames)
+	if err != nil {
+		return err
+	}
+
+	users := v.getSSHUserNames(vmNames)
+
+	hosts := make([]ansibleHost, len(vmNames))
+	for i := range vmNames {
+		hosts[i] = ansibleHost{Name: vmNames[i], IP: ips[i], User: users[i]}
+	}
+
+	dir, err := os.MkdirTemp("", "virter-ansible-*")
+	if err != nil {
+		return fmt.Errorf("failed to create directory for ansible files: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = writeAnsibleFiles(dir, hosts, values)
+	if err != nil {
+		return err
+	}
+
+	if ansibleStep.Image != "" {
+		return v.vmExecAnsibleContainer(ctx, containerProvider, vmNames, ansibleStep, dir, containerName, logFile)
+	}
+
+	knownHosts, err := v.getKnownHostsFor(vmNames...)
+	if err != nil {
+		return err
+	}
+
+	knownHostsFile, err := os.Create(filepath.Join(dir, "known_hosts"))
+	if err != nil {
+		return fmt.Errorf("failed to create known hosts file: %w", err)
+	}
+	defer knownHostsFile.Close()
+
+	err = knownHosts.AsKnownHostsFile(knownHostsFile)
+	if err != nil {
+		return fmt.Errorf("failed to write known hosts file: %w", err)
+	}
+
+	err = knownHostsFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close known hosts file: %w", err)
+	}
+
+	args := ansiblePlaybookArgs(dir, v.sshkeys.KeyPath(), knownHostsFile.Name(), ansibleStep.Playbook, ansibleStep.ExtraArgs)
+	return runAnsiblePlaybook(ctx, args, ansibleStep.Env, logFile)
+}
+
+// runAnsiblePlaybook runs ansible-playbook on the host.
+func runAnsiblePlaybook(ctx context.Context, args []string, env map[string]string, logFile io.Writer) error {
+	cmd := exec.CommandContext(ctx, "ansible-playbook", args...)
+	cmd.Env = append(os.Environ(), EnvmapToSlice(env)...)
+
+	log.Debugf("executing ansible-playbook %s", strings.Join(args, " "))
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stderr pipe: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start ansible-playbook: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go logLines(&wg, "Ansible", false, stdout, logFile)
+	go logLines(&wg, "Ansible", true, stderr, logFile)
+	wg.Wait()
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return &AnsibleExitError{Status: exitErr.ExitCode()}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run ansible-playbook: %w", err)
+	}
+
+	return nil
+}
+
+// vmExecAnsibleContainer runs ansible-playbook in a container. The container is set up like for container steps,
+// with the generated inventory and variables mounted in addition.
+func (v *Virter) vmExecAnsibleContainer(ctx context.Context, containerProvider containerapi.ContainerProvider, vmNames []string, ansibleStep *ProvisionAnsibleStep, dir, containerName string, logFile io.Writer) error {
+	if filepath.IsAbs(ansibleStep.Playbook) {
+		return fmt.Errorf("playbook %q must be relative to the working directory when running in a container", ansibleStep.Playbook)
+	}
+
+	playbook := path.Join(ansibleContainerWorkspace, filepath.ToSlash(ansibleStep.Playbook))
+	args := ansiblePlaybookArgs(ansibleContainerDir, "/root/.ssh/id_rsa", "/root/.ssh/known_hosts", playbook, ansibleStep.ExtraArgs)
+
+	containerCfg := containerapi.NewContainerConfig(
+		containerName,
+		ansibleStep.Image,
+		ansibleStep.Env,
+		containerapi.WithCommand(append([]string{"ansible-playbook"}, args...)...),
+		containerapi.WithPullConfig(ansibleStep.Pull.ForContainer()),
+	)
+	containerCfg.AddMount(containerapi.Mount{HostPath: dir, ContainerPath: ansibleContainerDir, ReadOnly: true})
+
+	return v.vmExecContainer(ctx, containerProvider, vmNames, containerCfg, nil, logFile)
+}
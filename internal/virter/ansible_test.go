@@ -0,0 +1,74 @@
+package virter
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteAnsibleInventory(t *testing.T) {
+	hosts := []ansibleHost{
+		{Name: "vm-0", IP: "192.168.122.2", User: "root"},
+		{Name: "vm-1", IP: "192.168.122.3", User: "cloud-user"},
+	}
+
+	var buf bytes.Buffer
+	err := writeAnsibleInventory(&buf, hosts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `[virter]
+vm-0 ansible_host=192.168.122.2 ansible_user=root
+vm-1 ansible_host=192.168.122.3 ansible_user=cloud-user
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected inventory:\n%s", buf.String())
+	}
+}
+
+func TestAnsiblePlaybookArgs(t *testing.T) {
+	args := ansiblePlaybookArgs("/virter/ansible", "/root/.ssh/id_rsa", "/root/.ssh/known_hosts", "site.yml", []string{"--tags", "setup"})
+
+	expected := []string{
+		"--inventory", "/virter/ansible/inventory",
+		"--private-key", "/root/.ssh/id_rsa",
+		"--ssh-common-args", "-o UserKnownHostsFile=/root/.ssh/known_hosts -o StrictHostKeyChecking=yes",
+		"--extra-vars", "@/virter/ansible/values.json",
+		"--tags", "setup",
+		"site.yml",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("unexpected arguments %q", args)
+	}
+}
+
+func TestWriteAnsibleFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	err := writeAnsibleFiles(dir, []ansibleHost{{Name: "vm-0", IP: "192.168.122.2", User: "root"}}, map[string]string{"Port": "6443"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "inventory")); err != nil {
+		t.Errorf("expected inventory: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "values.json"))
+	if err != nil {
+		t.Fatalf("failed to read values: %v", err)
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(content, &values); err != nil {
+		t.Fatalf("invalid values file: %v", err)
+	}
+
+	if values["Port"] != "6443" {
+		t.Errorf("unexpected values %v", values)
+	}
+}
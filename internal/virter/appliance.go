@@ -0,0 +1,329 @@
+package virter
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// vagrantDefaultSSHUser is the user Vagrant logs in as, unless the Vagrantfile of the box says otherwise
+const vagrantDefaultSSHUser = "vagrant"
+
+// applianceMetadataMaxSize limits the size of metadata files read from appliance archives
+const applianceMetadataMaxSize = 1 << 20
+
+var vagrantfileSSHUserRegex = regexp.MustCompile(`config\.ssh\.username\s*=\s*["']([^"']+)["']`)
+
+// applianceArchive is a tar archive containing a disk image together with metadata describing it, such as a Vagrant
+// box or an OVA appliance. The archive may be compressed.
+type applianceArchive string
+
+func applianceMemberName(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "./"))
+}
+
+// readMetadata reads the members of the archive for which match returns true. The names of all members are returned
+// as well.
+func (a applianceArchive) readMetadata(match func(name string) bool) (map[string][]byte, []string, error) {
+	f, err := os.Open(string(a))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	in, _, err := decompressingReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer in.Close()
+
+	files := map[string][]byte{}
+	var names []string
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, names, nil
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read archive '%s': %w", a, err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := applianceMemberName(hdr.Name)
+		names = append(names, name)
+		if !match(name) {
+			continue
+		}
+
+		content, err := io.ReadAll(io.LimitReader(tr, applianceMetadataMaxSize))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read '%s' from archive '%s': %w", name, a, err)
+		}
+		files[name] = content
+	}
+}
+
+// open returns a reader for the member of the archive with the given name, together with its size.
+func (a applianceArchive) open(member string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(string(a))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	in, _, err := decompressingReader(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			in.Close()
+			f.Close()
+
+			if err == io.EOF {
+				return nil, 0, fmt.Errorf("'%s' not found in archive '%s'", member, a)
+			}
+
+			return nil, 0, fmt.Errorf("failed to read archive '%s': %w", a, err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg && applianceMemberName(hdr.Name) == member {
+			return &applianceMemberReader{Reader: tr, closers: []io.Closer{in, f}}, hdr.Size, nil
+		}
+	}
+}
+
+type applianceMemberReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *applianceMemberReader) Close() error {
+	var result error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// applianceDisk is the disk image in an appliance archive, together with the metadata to record in the image.
+type applianceDisk struct {
+	member  string
+	format  DiskFormat
+	sshUser string
+}
+
+// applianceDiskFormat returns the disk format given in the metadata of an appliance. Unknown formats are left for
+// detection.
+func applianceDiskFormat(s string) DiskFormat {
+	var format DiskFormat
+	if err := format.Set(s); err != nil {
+		return ""
+	}
+
+	return format
+}
+
+// vagrantBoxMetadata is the content of metadata.json in a Vagrant box
+type vagrantBoxMetadata struct {
+	Provider string `json:"provider"`
+	Format   string `json:"format"`
+	Disks    []struct {
+		Path   string `json:"path"`
+		Format string `json:"format"`
+	} `json:"disks"`
+}
+
+// vagrantBoxDisk finds the disk image in a Vagrant box. Boxes for the libvirt and virtualbox providers are supported.
+func vagrantBoxDisk(box applianceArchive) (*applianceDisk, error) {
+	files, names, err := box.readMetadata(func(name string) bool {
+		return name == "metadata.json" || name == "Vagrantfile" || strings.HasSuffix(name, ".ovf")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rawMetadata, ok := files["metadata.json"]
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not a Vagrant box: metadata.json is missing", box)
+	}
+
+	var metadata vagrantBoxMetadata
+	if err := json.Unmarshal(rawMetadata, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata.json of Vagrant box: %w", err)
+	}
+
+	var disk *applianceDisk
+	switch metadata.Provider {
+	case "libvirt":
+		disk = &applianceDisk{member: "box.img", format: applianceDiskFormat(metadata.Format)}
+		if len(metadata.Disks) > 0 {
+			if len(metadata.Disks) > 1 {
+				log.Warnf("Vagrant box has %d disks, only loading the first one", len(metadata.Disks))
+			}
+
+			disk.member = applianceMemberName(metadata.Disks[0].Path)
+			if metadata.Disks[0].Format != "" {
+				disk.format = applianceDiskFormat(metadata.Disks[0].Format)
+			}
+		}
+	case "virtualbox":
+		disk, err = ovfDisk(files, names)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Vagrant provider '%s', only libvirt and virtualbox boxes can be loaded", metadata.Provider)
+	}
+
+	disk.sshUser = vagrantDefaultSSHUser
+	if match := vagrantfileSSHUserRegex.FindSubmatch(files["Vagrantfile"]); match != nil {
+		disk.sshUser = string(match[1])
+	}
+
+	return disk, nil
+}
+
+// ovfEnvelope is the part of an OVF descriptor needed to find the disk images
+type ovfEnvelope struct {
+	Files []struct {
+		ID   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"References>File"`
+	Disks []struct {
+		FileRef string `xml:"fileRef,attr"`
+		Format  string `xml:"format,attr"`
+	} `xml:"DiskSection>Disk"`
+}
+
+// ovfDisk finds the first disk image referenced by the OVF descriptor among the given files.
+func ovfDisk(files map[string][]byte, names []string) (*applianceDisk, error) {
+	var descriptor []byte
+	for _, name := range names {
+		if strings.HasSuffix(name, ".ovf") {
+			descriptor = files[name]
+			break
+		}
+	}
+
+	if descriptor == nil {
+		return nil, fmt.Errorf("no OVF descriptor found")
+	}
+
+	var envelope ovfEnvelope
+	if err := xml.Unmarshal(descriptor, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to parse OVF descriptor: %w", err)
+	}
+
+	if len(envelope.Disks) == 0 {
+		return nil, fmt.Errorf("OVF descriptor does not contain any disks")
+	}
+
+	if len(envelope.Disks) > 1 {
+		log.Warnf("OVF descriptor has %d disks, only loading the first one", len(envelope.Disks))
+	}
+
+	disk := envelope.Disks[0]
+	for _, file := range envelope.Files {
+		if file.ID != disk.FileRef {
+			continue
+		}
+
+		result := &applianceDisk{member: applianceMemberName(file.Href)}
+		// The format is given as URL of the specification, for example
+		// http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized
+		if strings.Contains(strings.ToLower(disk.Format), "vmdk") {
+			result.format = DiskFormatVMDK
+		}
+
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("OVF descriptor references unknown file '%s'", disk.FileRef)
+}
+
+// ovaDisk finds the disk image in an OVA appliance.
+func ovaDisk(ova applianceArchive) (*applianceDisk, error) {
+	files, names, err := ova.readMetadata(func(name string) bool {
+		return strings.HasSuffix(name, ".ovf")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ovfDisk(files, names)
+}
+
+// ImageLoadVagrant creates an image from the Vagrant box at path. Boxes for the libvirt and virtualbox providers are
+// supported. The SSH user of the box is recorded in the image, unless sshUser overrides it.
+func (v *Virter) ImageLoadVagrant(image, path, sshUser string, opts ...LayerOperationOption) (*LocalImage, error) {
+	disk, err := vagrantBoxDisk(applianceArchive(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return v.imageLoadAppliance(image, applianceArchive(path), disk, sshUser, opts...)
+}
+
+// ImageLoadOVA creates an image from the OVA appliance at path. OVA appliances do not specify an SSH user, if sshUser
+// is given, it is recorded in the image.
+func (v *Virter) ImageLoadOVA(image, path, sshUser string, opts ...LayerOperationOption) (*LocalImage, error) {
+	disk, err := ovaDisk(applianceArchive(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return v.imageLoadAppliance(image, applianceArchive(path), disk, sshUser, opts...)
+}
+
+func (v *Virter) imageLoadAppliance(image string, archive applianceArchive, disk *applianceDisk, sshUser string, opts ...LayerOperationOption) (*LocalImage, error) {
+	reader, size, err := archive.open(disk.member)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	log.WithFields(log.Fields{"image": image, "disk": disk.member}).Debug("loading disk from appliance")
+
+	var in io.Reader = reader
+	o := makeLayerOperationOpts(opts...)
+	if o.Progress != nil {
+		bar := o.Progress.NewBar(image, "load", size)
+		in = bar.ProxyReader(reader)
+	}
+
+	img, err := v.ImageLoad(image, in, disk.format, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if sshUser == "" {
+		sshUser = disk.sshUser
+	}
+
+	if sshUser != "" {
+		if err := v.SetImageLabels(img, map[string]string{LabelSSHUser: sshUser}); err != nil {
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
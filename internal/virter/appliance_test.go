@@ -0,0 +1,156 @@
+package virter
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeApplianceArchive(t *testing.T, members [][2]string) applianceArchive {
+	path := filepath.Join(t.TempDir(), "appliance")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create archive: %v", err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, member := range members {
+		hdr := &tar.Header{Name: member[0], Mode: 0o644, Size: int64(len(member[1])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write archive: %v", err)
+		}
+
+		if _, err := tw.Write([]byte(member[1])); err != nil {
+			t.Fatalf("failed to write archive: %v", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+
+	if err := gz.Close(); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+
+	return applianceArchive(path)
+}
+
+const testOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1">
+  <References>
+    <File ovf:id="file1" ovf:href="appliance-disk1.vmdk"/>
+  </References>
+  <DiskSection>
+    <Disk ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+  </DiskSection>
+</Envelope>
+`
+
+func TestApplianceDisk(t *testing.T) {
+	tests := []struct {
+		description string
+		members     [][2]string
+		ova         bool
+		expected    applianceDisk
+		expectErr   bool
+	}{
+		{
+			description: "vagrant-libvirt",
+			members: [][2]string{
+				{"./box.img", "disk"},
+				{"./metadata.json", `{"provider": "libvirt", "format": "qcow2", "virtual_size": 10}`},
+				{"./Vagrantfile", "Vagrant.configure(\"2\") do |config|\n  config.ssh.username = \"ubuntu\"\nend\n"},
+			},
+			expected: applianceDisk{member: "box.img", format: DiskFormatQCOW2, sshUser: "ubuntu"},
+		},
+		{
+			description: "vagrant-libvirt-disks",
+			members: [][2]string{
+				{"metadata.json", `{"provider": "libvirt", "format": "qcow2", "disks": [{"path": "box_1.img", "format": "raw"}]}`},
+				{"box_1.img", "disk"},
+			},
+			expected: applianceDisk{member: "box_1.img", format: DiskFormatRaw, sshUser: "vagrant"},
+		},
+		{
+			description: "vagrant-virtualbox",
+			members: [][2]string{
+				{"metadata.json", `{"provider": "virtualbox"}`},
+				{"box.ovf", testOVF},
+				{"appliance-disk1.vmdk", "disk"},
+			},
+			expected: applianceDisk{member: "appliance-disk1.vmdk", format: DiskFormatVMDK, sshUser: "vagrant"},
+		},
+		{
+			description: "vagrant-unsupported-provider",
+			members:     [][2]string{{"metadata.json", `{"provider": "hyperv"}`}},
+			expectErr:   true,
+		},
+		{
+			description: "vagrant-no-metadata",
+			members:     [][2]string{{"box.img", "disk"}},
+			expectErr:   true,
+		},
+		{
+			description: "ova",
+			members:     [][2]string{{"appliance.ovf", testOVF}, {"appliance-disk1.vmdk", "disk"}},
+			ova:         true,
+			expected:    applianceDisk{member: "appliance-disk1.vmdk", format: DiskFormatVMDK},
+		},
+		{
+			description: "ova-no-descriptor",
+			members:     [][2]string{{"appliance-disk1.vmdk", "disk"}},
+			ova:         true,
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			archive := writeApplianceArchive(t, test.members)
+
+			var disk *applianceDisk
+			var err error
+			if test.ova {
+				disk, err = ovaDisk(archive)
+			} else {
+				disk, err = vagrantBoxDisk(archive)
+			}
+
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got %+v", disk)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if *disk != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, *disk)
+			}
+
+			reader, size, err := archive.open(disk.member)
+			if err != nil {
+				t.Fatalf("failed to open disk: %v", err)
+			}
+			defer reader.Close()
+
+			content, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("failed to read disk: %v", err)
+			}
+
+			if string(content) != "disk" || size != 4 {
+				t.Errorf("unexpected disk content %q with size %d", content, size)
+			}
+		})
+	}
+}
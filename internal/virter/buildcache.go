@@ -0,0 +1,311 @@
+package virter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildCacheKeyVersion is part of every build cache key. It has to be changed whenever the derivation of the key
+// changes, so that images built with an older derivation are not mistaken as up-to-date.
+const buildCacheKeyVersion = "virter build cache v1"
+
+// BuildCacheKey derives the key that identifies the result of an image build from its inputs:
+//
+//   - the layers of the base image,
+//   - the fully rendered provisioning configuration, with the values of secrets left out,
+//   - the contents of the files copied by rsync steps,
+//   - the contents of the working directory for container steps, or of the inputs they list, and
+//   - the contents of the directories containing ansible playbooks.
+//
+// Files and directories below excludes are not taken into account. This is meant for paths virter writes to while
+// building, such as log directories. Outputs of provisioning steps, like the destinations of container copies, are
+// excluded automatically.
+func BuildCacheKey(baseImage *LocalImage, pc ProvisionConfig, excludes ...string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	// Resolved paths are hashed relative to the working directory, so it has to be resolved as well
+	if resolved, err := filepath.EvalSymlinks(wd); err == nil {
+		wd = resolved
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", buildCacheKeyVersion)
+
+	layers, err := baseImage.VolumeLayers()
+	if err != nil {
+		return "", fmt.Errorf("failed to get layers of base image: %w", err)
+	}
+
+	for _, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return "", fmt.Errorf("failed to get layer id of base image: %w", err)
+		}
+		fmt.Fprintf(h, "layer %s\n", diffID)
+	}
+
+	config, err := renderedProvisionConfigForCache(pc)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "config %d\n", len(config))
+	h.Write(config)
+
+	inputs, hashWorkDir, err := buildCacheInputs(pc, wd)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := &buildCacheHasher{
+		h:        h,
+		workDir:  wd,
+		excludes: resolveBuildCacheExcludes(append(buildCacheOutputs(pc), excludes...)),
+	}
+
+	if hashWorkDir {
+		inputs = []string{wd}
+	}
+
+	for _, input := range inputs {
+		if err := hasher.add(input); err != nil {
+			return "", err
+		}
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// renderedProvisionConfigForCache encodes the provisioning configuration with all secret values replaced. Secrets
+// must not be derivable from the cache key, which ends up in the image history.
+func renderedProvisionConfigForCache(pc ProvisionConfig) ([]byte, error) {
+	encoded, err := json.Marshal(pc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode provisioning configuration: %w", err)
+	}
+
+	redactor, err := pc.secretRedactor(func(value string) (string, error) {
+		escaped, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return strings.Trim(string(escaped), `"`), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(redactor.redact(string(encoded))), nil
+}
+
+// SHA256 returns the hash of the fully rendered provisioning configuration, including included files, script files
+// and overrides. The values of secrets are left out, like for BuildCacheKey.
+func (p *ProvisionConfig) SHA256() (string, error) {
+	config, err := renderedProvisionConfigForCache(*p)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// buildCacheInputs returns the host paths that provisioning reads from. If the paths can not be determined because
+// they depend on runtime data, the whole working directory is reported via hashWorkDir.
+//
+// Containers have the whole working directory mounted, so it is hashed for every container step, unless the step
+// lists its inputs explicitly. Ansible steps depend on the directory of the playbook.
+func buildCacheInputs(pc ProvisionConfig, wd string) (inputs []string, hashWorkDir bool, err error) {
+	for _, s := range pc.Steps {
+		switch {
+		case s.Container != nil:
+			if len(s.Container.CacheInputs) == 0 {
+				return nil, true, nil
+			}
+
+			for _, m := range s.Container.Mounts {
+				if m.ReadOnly {
+					inputs = append(inputs, m.Source)
+				}
+			}
+
+			inputs = append(inputs, s.Container.CacheInputs...)
+		case s.Ansible != nil:
+			playbook := s.Ansible.Playbook
+			if !filepath.IsAbs(playbook) {
+				playbook = filepath.Join(wd, playbook)
+			}
+			inputs = append(inputs, filepath.Dir(playbook))
+		case s.Rsync != nil && !s.Rsync.fromVM():
+			if templateUsesRuntimeData(s.Rsync.Source) {
+				// The files are only known once the step runs
+				return nil, true, nil
+			}
+
+			files, err := resolveRsyncSource(s.Rsync.Source, wd)
+			if err != nil {
+				return nil, false, err
+			}
+			inputs = append(inputs, files...)
+		}
+	}
+
+	return inputs, false, nil
+}
+
+// buildCacheOutputs returns the host paths that provisioning steps write to.
+func buildCacheOutputs(pc ProvisionConfig) []string {
+	var outputs []string
+	for _, s := range pc.Steps {
+		if s.Container != nil {
+			for _, c := range s.Container.copySteps() {
+				outputs = append(outputs, c.Dest)
+			}
+
+			for _, m := range s.Container.Mounts {
+				if !m.ReadOnly {
+					outputs = append(outputs, m.Source)
+				}
+			}
+		}
+
+		if s.Rsync != nil && s.Rsync.fromVM() {
+			outputs = append(outputs, s.Rsync.Dest)
+		}
+	}
+
+	return outputs
+}
+
+// buildCacheHasher adds the contents of files and directories to a hash
+type buildCacheHasher struct {
+	h       hash.Hash
+	workDir string
+	// excludes are absolute paths with symlinks resolved, see resolveBuildCacheExcludes
+	excludes []string
+}
+
+// resolveBuildCacheExcludes makes the excludes absolute and resolves symlinks, so that they can be compared to the
+// walked paths directly.
+func resolveBuildCacheExcludes(excludes []string) []string {
+	var resolved []string
+	for _, exclude := range excludes {
+		if exclude == "" {
+			continue
+		}
+
+		absExclude, err := filepath.Abs(exclude)
+		if err != nil {
+			continue
+		}
+
+		if r, err := filepath.EvalSymlinks(absExclude); err == nil {
+			absExclude = r
+		}
+
+		resolved = append(resolved, absExclude)
+	}
+
+	return resolved
+}
+
+func (b *buildCacheHasher) excluded(path string) bool {
+	for _, exclude := range b.excludes {
+		if path == exclude || strings.HasPrefix(path, exclude+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// add hashes the file or directory at path. Entries are identified by their path relative to the working directory,
+// so that moving the working directory does not change the key.
+func (b *buildCacheHasher) add(path string) error {
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to determine absolute path of %q: %w", path, err)
+	}
+
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+
+	if _, err := os.Lstat(root); errors.Is(err, fs.ErrNotExist) {
+		// Paths referenced by containers may not exist yet, which is a state of its own
+		rel, err := filepath.Rel(b.workDir, root)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(b.h, "missing %q\n", rel)
+		return nil
+	}
+
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read %q for the build cache key: %w", p, err)
+		}
+
+		if p != root && (d.Name() == ".git" || b.excluded(p)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.workDir, p)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return fmt.Errorf("failed to read link %q: %w", p, err)
+			}
+			fmt.Fprintf(b.h, "link %q %q\n", rel, target)
+		case d.IsDir():
+			fmt.Fprintf(b.h, "dir %q %o\n", rel, info.Mode().Perm())
+		case d.Type().IsRegular():
+			sum, err := fileSHA256(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(b.h, "file %q %o %s\n", rel, info.Mode().Perm(), sum)
+		}
+
+		return nil
+	})
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %q: %w", path, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,185 @@
+package virter_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func buildCacheKey(t *testing.T, img *virter.LocalImage, config string) string {
+	pc, err := virter.NewProvisionConfig(io.NopCloser(strings.NewReader(config)), virter.ProvisionOption{})
+	assert.NoError(t, err)
+
+	key, err := virter.BuildCacheKey(img, pc)
+	assert.NoError(t, err)
+	return key
+}
+
+func TestBuildCacheKey(t *testing.T) {
+	l, layer := prepareVolumeLayer(t)
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+
+	img, err := v.MakeImage("image1", layer)
+	assert.NoError(t, err)
+
+	t.Chdir(t.TempDir())
+	assert.NoError(t, os.MkdirAll("files", 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join("files", "a"), []byte("a"), 0o644))
+	assert.NoError(t, os.WriteFile("unrelated", []byte("unrelated"), 0o644))
+
+	shellConfig := `version = 1
+[[steps]]
+[steps.shell]
+script = "echo hello"
+`
+	rsyncConfig := `version = 1
+[[steps]]
+[steps.rsync]
+source = "files"
+dest = "/tmp"
+`
+	containerConfig := `version = 1
+[[steps]]
+[steps.container]
+image = "alpine"
+command = ["make"]
+[steps.container.copy]
+source = "/out"
+dest = "out"
+`
+	containerInputsConfig := `version = 1
+[[steps]]
+[steps.container]
+image = "alpine"
+command = ["sh", "/virter/workspace/files/a"]
+cache_inputs = ["files"]
+[[steps.container.mounts]]
+source = "data"
+target = "/data"
+read_only = true
+`
+	ansibleConfig := `version = 1
+[[steps]]
+[steps.ansible]
+playbook = "ansible/site.yml"
+`
+
+	shellKey := buildCacheKey(t, img, shellConfig)
+	assert.True(t, strings.HasPrefix(shellKey, "sha256:"))
+	assert.Equal(t, shellKey, buildCacheKey(t, img, shellConfig))
+	assert.NotEqual(t, shellKey, buildCacheKey(t, img, strings.Replace(shellConfig, "hello", "world", 1)))
+
+	// rsync steps only depend on the copied files
+	rsyncKey := buildCacheKey(t, img, rsyncConfig)
+	assert.NoError(t, os.WriteFile("unrelated", []byte("changed"), 0o644))
+	assert.Equal(t, rsyncKey, buildCacheKey(t, img, rsyncConfig))
+	assert.NoError(t, os.WriteFile(filepath.Join("files", "a"), []byte("changed"), 0o644))
+	assert.NotEqual(t, rsyncKey, buildCacheKey(t, img, rsyncConfig))
+
+	// container steps depend on the whole working directory, but not their outputs or excluded paths
+	containerKey := buildCacheKey(t, img, containerConfig)
+	assert.NoError(t, os.MkdirAll("out", 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join("out", "result"), []byte("result"), 0o644))
+	assert.Equal(t, containerKey, buildCacheKey(t, img, containerConfig))
+	assert.NoError(t, os.WriteFile("unrelated", []byte("changed for container"), 0o644))
+	assert.NotEqual(t, containerKey, buildCacheKey(t, img, containerConfig))
+	containerKey = buildCacheKey(t, img, containerConfig)
+	pc, err := virter.NewProvisionConfig(io.NopCloser(strings.NewReader(containerConfig)), virter.ProvisionOption{})
+	assert.NoError(t, err)
+	excludedKey, err := virter.BuildCacheKey(img, pc, "logs")
+	assert.NoError(t, err)
+	assert.Equal(t, containerKey, excludedKey)
+	assert.NoError(t, os.MkdirAll("logs", 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join("logs", "build.log"), []byte("log"), 0o644))
+	excludedKey, err = virter.BuildCacheKey(img, pc, "logs")
+	assert.NoError(t, err)
+	assert.Equal(t, containerKey, excludedKey)
+
+	// container steps that list their inputs only depend on those and their read-only mounts
+	containerKey = buildCacheKey(t, img, containerInputsConfig)
+	assert.NoError(t, os.WriteFile("unrelated", []byte("changed again"), 0o644))
+	assert.Equal(t, containerKey, buildCacheKey(t, img, containerInputsConfig))
+	assert.NoError(t, os.WriteFile(filepath.Join("files", "a"), []byte("changed again"), 0o644))
+	assert.NotEqual(t, containerKey, buildCacheKey(t, img, containerInputsConfig))
+	containerKey = buildCacheKey(t, img, containerInputsConfig)
+	assert.NoError(t, os.MkdirAll("data", 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join("data", "input"), []byte("input"), 0o644))
+	assert.NotEqual(t, containerKey, buildCacheKey(t, img, containerInputsConfig))
+
+	// ansible steps depend on the directory of the playbook
+	assert.NoError(t, os.MkdirAll(filepath.Join("ansible", "roles"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join("ansible", "site.yml"), []byte("- hosts: all"), 0o644))
+	ansibleKey := buildCacheKey(t, img, ansibleConfig)
+	assert.NoError(t, os.WriteFile("unrelated", []byte("changed for ansible"), 0o644))
+	assert.Equal(t, ansibleKey, buildCacheKey(t, img, ansibleConfig))
+	assert.NoError(t, os.WriteFile(filepath.Join("ansible", "roles", "main.yml"), []byte("role"), 0o644))
+	assert.NotEqual(t, ansibleKey, buildCacheKey(t, img, ansibleConfig))
+}
+
+func TestBuildCacheKeySecrets(t *testing.T) {
+	l, layer := prepareVolumeLayer(t)
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+
+	img, err := v.MakeImage("image1", layer)
+	assert.NoError(t, err)
+
+	config := `version = 1
+
+[secrets]
+token = { env = "VIRTER_BUILD_CACHE_TEST_TOKEN" }
+
+[[steps]]
+[steps.shell]
+script = "login {{ .Secrets.token }}"
+`
+
+	t.Setenv("VIRTER_BUILD_CACHE_TEST_TOKEN", "first-cache-test-token")
+	first := buildCacheKey(t, img, config)
+
+	t.Setenv("VIRTER_BUILD_CACHE_TEST_TOKEN", "second-cache-test-token")
+	second := buildCacheKey(t, img, config)
+
+	assert.Equal(t, first, second)
+}
+
+func TestProvisionConfigSHA256(t *testing.T) {
+	config := `version = 1
+
+[values]
+Package = "vim"
+
+[secrets]
+token = { env = "VIRTER_PROVISION_SHA256_TEST_TOKEN" }
+
+[[steps]]
+[steps.container]
+image = "alpine"
+command = ["install", "{{ .Package }}"]
+env = { TOKEN = "{{ .Secrets.token }}" }
+`
+
+	provisionSHA256 := func(overrides ...string) string {
+		pc, err := virter.NewProvisionConfig(io.NopCloser(strings.NewReader(config)), virter.ProvisionOption{Overrides: overrides})
+		assert.NoError(t, err)
+
+		sum, err := pc.SHA256()
+		assert.NoError(t, err)
+		return sum
+	}
+
+	t.Setenv("VIRTER_PROVISION_SHA256_TEST_TOKEN", "first-sha256-test-token")
+	first := provisionSHA256()
+	assert.Len(t, first, 64)
+
+	// Overrides change the rendered configuration, secrets do not
+	assert.NotEqual(t, first, provisionSHA256("values.Package=emacs"))
+
+	t.Setenv("VIRTER_PROVISION_SHA256_TEST_TOKEN", "second-sha256-test-token")
+	assert.Equal(t, first, provisionSHA256())
+}
@@ -0,0 +1,150 @@
+package virter
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CheckpointVolumePrefix is the prefix for the volumes referencing the layers committed after provisioning steps of
+// an image build. They work like tag volumes, but are named after the key of the checkpoint.
+const CheckpointVolumePrefix = "virter:checkpoint:"
+
+// imageBuildCheckpoint is a point in an image build after which a layer is committed
+type imageBuildCheckpoint struct {
+	// after is the index of the step after which the checkpoint is taken
+	after int
+	// key identifies the base image and all steps up to the checkpoint, see BuildCacheKey
+	key string
+}
+
+func checkpointVolumeName(key string) string {
+	return CheckpointVolumePrefix + strings.TrimPrefix(key, "sha256:")
+}
+
+// checkpointSteps returns the indices of the steps after which a checkpoint is taken: the steps with checkpoint set,
+// or all steps if all is true. There is never a checkpoint after the last step, as the image itself is committed
+// there.
+//
+// Captured output is not kept in checkpoints. With all, there are no checkpoints after the first step capturing
+// output. Otherwise, a step with checkpoint set after such a step is an error.
+func (p *ProvisionConfig) checkpointSteps(all bool) ([]int, error) {
+	var result []int
+	for i := 0; i < len(p.Steps)-1; i++ {
+		s := p.Steps[i]
+		if s.Shell != nil && s.Shell.Capture != "" {
+			for j := i; j < len(p.Steps); j++ {
+				if p.Steps[j].Checkpoint && !all {
+					return nil, fmt.Errorf("step %d: checkpoints are not possible after a step that captures output", j)
+				}
+			}
+			break
+		}
+
+		if s.Checkpoint || all {
+			result = append(result, i)
+		}
+	}
+
+	return result, nil
+}
+
+// imageBuildCheckpoints determines the checkpoints of an image build and their keys.
+func imageBuildCheckpoints(baseImage *LocalImage, buildConfig ImageBuildConfig) ([]imageBuildCheckpoint, error) {
+	steps, err := buildConfig.ProvisionConfig.checkpointSteps(buildConfig.CheckpointAllSteps)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoints := make([]imageBuildCheckpoint, 0, len(steps))
+	for _, i := range steps {
+		pc := buildConfig.ProvisionConfig
+		pc.Steps = pc.Steps[:i+1]
+
+		key, err := BuildCacheKey(baseImage, pc, buildConfig.CacheExcludes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute key for checkpoint after step %d: %w", i, err)
+		}
+
+		checkpoints = append(checkpoints, imageBuildCheckpoint{after: i, key: key})
+	}
+
+	return checkpoints, nil
+}
+
+// findCheckpoint returns the image of the checkpoint with the given key. Returns (nil, nil) if there is no such
+// checkpoint.
+func (v *Virter) findCheckpoint(key string) (*LocalImage, error) {
+	raw, err := v.FindRawLayer(checkpointVolumeName(key), v.provisionStoragePool)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw == nil {
+		return nil, nil
+	}
+
+	top, err := raw.Dependency()
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalImage{
+		tagLayer: raw,
+		topLayer: top,
+	}, nil
+}
+
+// makeCheckpoint creates a checkpoint with the given key, pointing to the given layer. An existing checkpoint of the
+// same key is replaced, the layers it pointed to are left for "image prune".
+func (v *Virter) makeCheckpoint(key string, topLayer *VolumeLayer) (*LocalImage, error) {
+	existing, err := v.FindRawLayer(checkpointVolumeName(key), v.provisionStoragePool)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := existing.Delete(); err != nil {
+		return nil, err
+	}
+
+	raw, err := v.emptyVolume(checkpointVolumeName(key), v.provisionStoragePool, WithBackingLayer(topLayer))
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalImage{
+		tagLayer: &RawLayer{
+			conn:   v.libvirt,
+			volume: raw,
+			pool:   v.provisionStoragePool,
+		},
+		topLayer: topLayer,
+	}, nil
+}
+
+// PruneCheckpoints deletes the checkpoints of all image builds. The layers they referenced can be pruned afterwards.
+// Returns the number of deleted checkpoints.
+func (v *Virter) PruneCheckpoints() (int, error) {
+	vols, _, err := v.libvirt.StoragePoolListAllVolumes(v.provisionStoragePool, -1, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list all volumes: %w", err)
+	}
+
+	count := 0
+	for _, vol := range vols {
+		if !strings.HasPrefix(vol.Name, CheckpointVolumePrefix) {
+			continue
+		}
+
+		checkpoint := &RawLayer{conn: v.libvirt, pool: v.provisionStoragePool, volume: vol}
+		if err := checkpoint.Delete(); err != nil {
+			return count, err
+		}
+
+		log.WithField("volume", vol.Name).Debug("deleted checkpoint")
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,68 @@
+package virter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckpointSteps(t *testing.T) {
+	shell := &ProvisionShellStep{Script: "true"}
+	capture := &ProvisionShellStep{Script: "echo hello", Capture: "greeting"}
+
+	tests := []struct {
+		description string
+		steps       []ProvisionStep
+		all         bool
+		expected    []int
+		expectErr   bool
+	}{
+		{
+			description: "none",
+			steps:       []ProvisionStep{{Shell: shell}, {Shell: shell}},
+		},
+		{
+			description: "marked",
+			steps:       []ProvisionStep{{Shell: shell}, {Shell: shell, Checkpoint: true}, {Shell: shell}},
+			expected:    []int{1},
+		},
+		{
+			description: "not-after-last",
+			steps:       []ProvisionStep{{Shell: shell, Checkpoint: true}, {Shell: shell, Checkpoint: true}},
+			expected:    []int{0},
+		},
+		{
+			description: "all",
+			steps:       []ProvisionStep{{Shell: shell}, {Shell: shell}, {Shell: shell}},
+			all:         true,
+			expected:    []int{0, 1},
+		},
+		{
+			description: "all-stops-at-capture",
+			steps:       []ProvisionStep{{Shell: shell}, {Shell: capture}, {Shell: shell}, {Shell: shell}},
+			all:         true,
+			expected:    []int{0},
+		},
+		{
+			description: "marked-after-capture",
+			steps:       []ProvisionStep{{Shell: capture}, {Shell: shell, Checkpoint: true}, {Shell: shell}},
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		pc := ProvisionConfig{Steps: tc.steps}
+		actual, err := pc.checkpointSteps(tc.all)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("expected error for test %s", tc.description)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for test %s: %v", tc.description, err)
+		} else if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("unexpected checkpoints for test %s: %v", tc.description, actual)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package virter
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned when imported data does not match the expected checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ExpectedChecksum is the checksum imported data must match, see WithExpectedChecksum.
+type ExpectedChecksum struct {
+	// Algorithm is either "sha256" or "sha512"
+	Algorithm string
+	Hex       string
+}
+
+func (c *ExpectedChecksum) newHash() (hash.Hash, error) {
+	switch strings.ToLower(c.Algorithm) {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm '%s'", c.Algorithm)
+	}
+}
+
+func (c *ExpectedChecksum) verify(h hash.Hash) error {
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, c.Hex) {
+		return fmt.Errorf("%w: expected %s:%s, got %s:%s", ErrChecksumMismatch, c.Algorithm, c.Hex, c.Algorithm, actual)
+	}
+
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 
 	"github.com/LINBIT/containerapi"
 
+	"github.com/hashicorp/go-multierror"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -33,7 +34,7 @@ func (e *ContainerExitError) Error() string {
 	return fmt.Sprintf("container exited with status %d", e.Status)
 }
 
-func containerRun(ctx context.Context, containerProvider containerapi.ContainerProvider, containerCfg *containerapi.ContainerConfig, vmNames []string, vmSSHUserNames []string, vmIPs []string, keyStore sshkeys.KeyStore, knownHosts sshkeys.KnownHosts, copyStep *ProvisionContainerCopyStep) error {
+func containerRun(ctx context.Context, containerProvider containerapi.ContainerProvider, containerCfg *containerapi.ContainerConfig, vmNames []string, vmSSHUserNames []string, vmIPs []string, keyStore sshkeys.KeyStore, knownHosts sshkeys.KnownHosts, copySteps []ProvisionContainerCopyStep, logFile io.Writer) error {
 	// This is roughly equivalent to
 	// docker run --rm --network=host -e TARGETS=$vmIPs -e SSH_PRIVATE_KEY="$sshPrivateKey" $dockerImageName
 
@@ -127,32 +128,37 @@ func containerRun(ctx context.Context, containerProvider containerapi.ContainerP
 		return fmt.Errorf("could not start container: %w", err)
 	}
 
-	err = streamLogs(ctx, containerProvider, containerID)
+	err = streamLogs(ctx, containerProvider, containerID, logFile)
 	if err != nil {
 		return err
 	}
 
-	waitErr := containerWait(statusCh, errCh)
+	waitErr := containerWait(ctx, statusCh, errCh)
 
 	// Copy out files from container even if the wait ended in an error.
 	// The files may still be important. For instance, when the wait timed
 	// out or the container terminated with a non-zero exit code. This
 	// generally indicates a failure of the process running in the
 	// container. In these cases, the container itself is still valid.
-	if copyStep != nil {
+	// All copies are attempted, so that one missing file does not prevent collecting the others.
+	var copyErr error
+	for i := range copySteps {
 		// Use a fresh Context here because ctx may have been canceled
 		copyCtx, copyCancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer copyCancel()
-		err = containerCopy(copyCtx, containerProvider, containerID, copyStep, wd)
+		err = containerCopy(copyCtx, containerProvider, containerID, &copySteps[i], wd)
+		copyCancel()
 		if err != nil {
-			return err
+			copyErr = multierror.Append(copyErr, err)
 		}
 	}
+	if copyErr != nil {
+		return copyErr
+	}
 
 	return waitErr
 }
 
-func streamLogs(ctx context.Context, containerProvider containerapi.ContainerProvider, id string) error {
+func streamLogs(ctx context.Context, containerProvider containerapi.ContainerProvider, id string, logFile io.Writer) error {
 	stdout, stderr, err := containerProvider.Logs(ctx, id)
 	if err != nil {
 		return fmt.Errorf("could not get container logs: %w", err)
@@ -161,13 +167,23 @@ func streamLogs(ctx context.Context, containerProvider containerapi.ContainerPro
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	go logLines(&wg, "Container", false, stdout)
-	go logLines(&wg, "Container", true, stderr)
+	go logLines(&wg, "Container", false, stdout, logFile)
+	go logLines(&wg, "Container", true, stderr, logFile)
 
 	wg.Wait()
 	return nil
 }
 
+// writeLogFileLine writes a message from either stdout or stderr to a log file
+func writeLogFileLine(logFile io.Writer, message string, stderr bool) {
+	prefix := "out"
+	if stderr {
+		prefix = "err"
+	}
+
+	_, _ = fmt.Fprintf(logFile, "%s: %s\n", prefix, message)
+}
+
 // logStdoutStderr logs a message from a VM which came from either stdout or stderr
 func logStdoutStderr(vmName, message string, stderr bool) {
 	var prefix string
@@ -187,12 +203,16 @@ func logStdoutStderr(vmName, message string, stderr bool) {
 	log.Printf("%s %s: %s", vmName, prefix, message)
 }
 
-func logLines(wg *sync.WaitGroup, vm string, stderr bool, r io.Reader) {
+// logLines logs every line read from r. If logFile is not nil, the lines are also written to it.
+func logLines(wg *sync.WaitGroup, vm string, stderr bool, r io.Reader, logFile io.Writer) {
 	defer wg.Done()
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		message := strings.TrimRight(scanner.Text(), " \t\r\n")
 		logStdoutStderr(vm, message, stderr)
+		if logFile != nil {
+			writeLogFileLine(logFile, message, stderr)
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		log.Printf("%s: Error reading: %v", vm, err)
@@ -201,8 +221,10 @@ func logLines(wg *sync.WaitGroup, vm string, stderr bool, r io.Reader) {
 
 // containerWait waits for a container to exit.
 // If the container exits with a non-zero exit code, a ContainerExitError is returned.
-func containerWait(statusCh <-chan int64, errCh <-chan error) error {
+func containerWait(ctx context.Context, statusCh <-chan int64, errCh <-chan error) error {
 	select {
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for container: %w", ctx.Err())
 	case err := <-errCh:
 		return fmt.Errorf("error waiting for container: %w", err)
 	case status := <-statusCh:
@@ -239,3 +261,36 @@ func containerCopy(ctx context.Context, provider containerapi.ContainerProvider,
 	fdPath := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
 	return provider.CopyFrom(ctx, containerID, step.Source, fdPath)
 }
+
+// prepareContainerMount creates the host directory of a container mount if necessary and checks that it is within
+// the working directory. The resolved path is returned, so that a symlink cannot be swapped in later.
+func prepareContainerMount(source string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to find current working directory: %w", err)
+	}
+
+	if err := checkPathInWorkDir(source, wd); err != nil {
+		return "", fmt.Errorf("container mount source not allowed: %w", err)
+	}
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		return "", fmt.Errorf("failed to create container mount source: %w", err)
+	}
+
+	realPath, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve container mount source %q: %w", source, err)
+	}
+
+	realPath, err = filepath.Abs(realPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine absolute path of %q: %w", realPath, err)
+	}
+
+	if err := checkPathInWorkDir(realPath, wd); err != nil {
+		return "", fmt.Errorf("container mount source not allowed: %w", err)
+	}
+
+	return realPath, nil
+}
@@ -17,6 +17,8 @@ type MockContainerProvider struct {
 	startCalled  bool
 	logsCalled   bool
 	waitCalled   bool
+	copied       []string
+	exitStatus   int64
 }
 
 const mockContainerId = "some-container-id"
@@ -38,7 +40,7 @@ func (c *MockContainerProvider) Stop(ctx context.Context, containerID string, ti
 func (c *MockContainerProvider) Wait(ctx context.Context, containerID string) (<-chan int64, <-chan error) {
 	c.waitCalled = true
 	statusChan := make(chan int64, 1)
-	statusChan <- 0
+	statusChan <- c.exitStatus
 	errChan := make(chan error)
 	return statusChan, errChan
 }
@@ -54,6 +56,7 @@ func (c *MockContainerProvider) Remove(ctx context.Context, containerID string)
 }
 
 func (c *MockContainerProvider) CopyFrom(ctx context.Context, containerId string, source string, dest string) error {
+	c.copied = append(c.copied, source)
 	return nil
 }
 
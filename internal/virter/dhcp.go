@@ -352,7 +352,8 @@ func (v *Virter) findIPs(network libvirt.Network, mac string) ([]string, error)
 
 // GetVMID returns wantedID if it is not 0 and free.
 // If wantedID is 0 GetVMID searches for an unused ID and returns the first it can find.
-// For searching it uses the set libvirt network and already reserved DHCP entries.
+// For searching it uses the set libvirt network and already reserved DHCP entries. IDs found by searching are not
+// returned again by this Virter, so that concurrent callers get different IDs before their VMs are created.
 func (v *Virter) GetVMID(wantedID uint, expectDHCPEntry bool) (uint, error) {
 	if expectDHCPEntry {
 		if wantedID == 0 {
@@ -387,15 +388,28 @@ func (v *Virter) GetVMID(wantedID uint, expectDHCPEntry bool) (uint, error) {
 		start = wantedID
 	}
 
+	v.vmIDLock.Lock()
+	defer v.vmIDLock.Unlock()
+
 	// we start from top of avialable host id's and check if they are already used and find one
 	for i := end; i >= start; i-- {
-		mac := QemuMAC(wantedID)
+		if wantedID == 0 && v.handedOutVMIDs[i] {
+			continue
+		}
+
+		mac := QemuMAC(i)
 		ips, err := v.findIPs(v.provisionNetwork, mac)
 		if err != nil {
 			return 0, err
 		}
 
 		if len(ips) == 0 {
+			if wantedID == 0 {
+				if v.handedOutVMIDs == nil {
+					v.handedOutVMIDs = map[uint]bool{}
+				}
+				v.handedOutVMIDs[i] = true
+			}
 			return i, nil
 		}
 	}
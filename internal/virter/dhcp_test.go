@@ -0,0 +1,34 @@
+package virter_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func TestVirter_GetVMID(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+
+	// The highest ID of the /24 network is taken by a DHCP entry
+	fakeNetworkAddHost(l.networks[networkName], virter.QemuMAC(254), "192.168.122.254")
+
+	first, err := v.GetVMID(0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(253), first)
+
+	// IDs are not handed out twice, even before a VM uses them
+	second, err := v.GetVMID(0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(252), second)
+
+	// Explicitly requested IDs are only checked against the DHCP entries
+	wanted, err := v.GetVMID(first, false)
+	assert.NoError(t, err)
+	assert.Equal(t, first, wanted)
+
+	_, err = v.GetVMID(254, false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,316 @@
+package virter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// DiskFormat is the format of a disk image file, as written by "image save" and read by "image load".
+//
+// Conversions between formats are done by libvirt when cloning volumes, so no conversion tools are needed on the
+// host running virter. Only formats libvirt can not convert, see ConvertedLocally, need qemu-img on the host.
+type DiskFormat string
+
+const (
+	DiskFormatQCOW2 DiskFormat = "qcow2"
+	DiskFormatRaw   DiskFormat = "raw"
+	DiskFormatVMDK  DiskFormat = "vmdk"
+	DiskFormatVHD   DiskFormat = "vhd"
+	DiskFormatVHDX  DiskFormat = "vhdx"
+	DiskFormatVDI   DiskFormat = "vdi"
+)
+
+var diskFormats = []DiskFormat{DiskFormatQCOW2, DiskFormatRaw, DiskFormatVMDK, DiskFormatVHD, DiskFormatVHDX, DiskFormatVDI}
+
+// DiskFormatNames returns the names of all known disk formats.
+func DiskFormatNames() []string {
+	names := make([]string, len(diskFormats))
+	for i := range diskFormats {
+		names[i] = string(diskFormats[i])
+	}
+
+	return names
+}
+
+func (f *DiskFormat) String() string {
+	return string(*f)
+}
+
+func (f *DiskFormat) Set(s string) error {
+	for _, known := range diskFormats {
+		if DiskFormat(strings.ToLower(s)) == known {
+			*f = known
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown disk format. [%s]", strings.Join(DiskFormatNames(), ", "))
+}
+
+func (f *DiskFormat) Type() string {
+	return "diskFormat"
+}
+
+// libvirtType returns the name libvirt uses for the format of a storage volume. qemu-img uses the same names.
+func (f DiskFormat) libvirtType() string {
+	if f == DiskFormatVHD {
+		return "vpc"
+	}
+
+	return string(f)
+}
+
+// ConvertedLocally reports whether libvirt can not convert from and to the format, so that it has to be converted
+// with ConvertDiskImage instead.
+func (f DiskFormat) ConvertedLocally() bool {
+	return f == DiskFormatVHDX
+}
+
+// diskFormatHeaderSize is the number of bytes needed to detect the format of a disk image
+const diskFormatHeaderSize = 512
+
+// DetectDiskFormat detects the format of a disk image from its first bytes. Data without a known signature is
+// assumed to be a raw disk image.
+func DetectDiskFormat(header []byte) (DiskFormat, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte("QFI\xfb")):
+		return DiskFormatQCOW2, nil
+	case bytes.HasPrefix(header, []byte("KDMV")):
+		return DiskFormatVMDK, nil
+	case bytes.HasPrefix(header, []byte("# Disk DescriptorFile")):
+		return "", fmt.Errorf("VMDK descriptor files are not supported, use a single file (monolithicSparse) VMDK")
+	case bytes.HasPrefix(header, []byte("conectix")):
+		return DiskFormatVHD, nil
+	case len(header) >= 0x44 && bytes.Equal(header[0x40:0x44], []byte{0x7f, 0x10, 0xda, 0xbe}):
+		return DiskFormatVDI, nil
+	case bytes.HasPrefix(header, []byte("vhdxfile")):
+		return DiskFormatVHDX, nil
+	default:
+		return DiskFormatRaw, nil
+	}
+}
+
+// DiskCompression is the compression applied to a disk image file, independent of its format.
+type DiskCompression string
+
+const (
+	DiskCompressionNone DiskCompression = "none"
+	DiskCompressionGzip DiskCompression = "gzip"
+	DiskCompressionZstd DiskCompression = "zstd"
+	// DiskCompressionQCOW2 compresses the clusters of a qcow2 image instead of the whole file, so that it can be used
+	// without decompressing it first. It is applied by ConvertDiskImage, CompressingWriter leaves the data as it is.
+	DiskCompressionQCOW2 DiskCompression = "qcow2"
+)
+
+func (c *DiskCompression) String() string {
+	return string(*c)
+}
+
+func (c *DiskCompression) Set(s string) error {
+	switch DiskCompression(strings.ToLower(s)) {
+	case DiskCompressionNone, DiskCompressionGzip, DiskCompressionZstd, DiskCompressionQCOW2:
+		*c = DiskCompression(strings.ToLower(s))
+		return nil
+	default:
+		return fmt.Errorf("unknown compression. [%s, %s, %s, %s]", DiskCompressionNone, DiskCompressionGzip, DiskCompressionZstd, DiskCompressionQCOW2)
+	}
+}
+
+func (c *DiskCompression) Type() string {
+	return "compression"
+}
+
+// CompressingWriter returns a writer that compresses the data written to it with the given compression and writes the
+// result to w. The returned writer must be closed to flush all data, this does not close w.
+func CompressingWriter(w io.Writer, c DiskCompression) (io.WriteCloser, error) {
+	switch c {
+	case "", DiskCompressionNone, DiskCompressionQCOW2:
+		return nopWriteCloser{w}, nil
+	case DiskCompressionGzip:
+		return gzip.NewWriter(w), nil
+	case DiskCompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", c)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// ConvertDiskImage converts the disk image read from r from one format to another with qemu-img on the host running
+// virter. This is needed for formats libvirt can not convert and to compress the clusters of a qcow2 image. The
+// returned reader has to be closed to remove the temporary files.
+func ConvertDiskImage(r io.Reader, from, to DiskFormat, compress bool) (io.ReadCloser, error) {
+	dir, err := os.MkdirTemp("", "virter-convert-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+
+	converted, err := convertDiskImageIn(dir, r, from, to, compress)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &tempFileReader{File: converted, dir: dir}, nil
+}
+
+func convertDiskImageIn(dir string, r io.Reader, from, to DiskFormat, compress bool) (*os.File, error) {
+	src := filepath.Join(dir, "src."+string(from))
+	dst := filepath.Join(dir, "dst."+string(to))
+
+	f, err := os.Create(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write disk image to temporary file: %w", err)
+	}
+
+	args := []string{"convert", "-f", from.libvirtType(), "-O", to.libvirtType()}
+	if compress {
+		args = append(args, "-c")
+	}
+	args = append(args, src, dst)
+
+	log.WithField("args", args).Debug("converting disk image with qemu-img")
+	out, err := exec.Command("qemu-img", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s disk image to %s with qemu-img: %w: %s", from, to, err, strings.TrimSpace(string(out)))
+	}
+
+	// The source is not needed anymore, so free the space early
+	_ = os.Remove(src)
+
+	return os.Open(dst)
+}
+
+// tempFileReader reads a file in a temporary directory, which is removed on Close.
+type tempFileReader struct {
+	*os.File
+	dir string
+}
+
+func (t *tempFileReader) Close() error {
+	err := t.File.Close()
+	if rmErr := os.RemoveAll(t.dir); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// decompressingReader detects whether the data in r is compressed and returns a reader for the uncompressed data.
+func decompressingReader(r io.Reader) (io.ReadCloser, DiskCompression, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("failed to read disk image: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decompress disk image: %w", err)
+		}
+		return gz, DiskCompressionGzip, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decompress disk image: %w", err)
+		}
+		return zr.IOReadCloser(), DiskCompressionZstd, nil
+	default:
+		return io.NopCloser(buffered), DiskCompressionNone, nil
+	}
+}
+
+// ImageLoad creates an image from a disk image file. Compressed files are decompressed. If format is empty, the
+// format of the disk image is detected. Disk images not in qcow2 format are converted by libvirt, or by qemu-img if
+// libvirt can not convert them.
+func (v *Virter) ImageLoad(image string, reader io.Reader, format DiskFormat, opts ...LayerOperationOption) (*LocalImage, error) {
+	in, compression, err := decompressingReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	buffered := bufio.NewReaderSize(in, diskFormatHeaderSize)
+	if format == "" {
+		header, err := buffered.Peek(diskFormatHeaderSize)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read disk image: %w", err)
+		}
+
+		format, err = DetectDiskFormat(header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.WithFields(log.Fields{"image": image, "format": format, "compression": compression}).Debug("loading disk image")
+
+	var content io.Reader = buffered
+	if format.ConvertedLocally() {
+		converted, err := ConvertDiskImage(buffered, format, DiskFormatQCOW2, false)
+		if err != nil {
+			return nil, err
+		}
+		defer converted.Close()
+
+		content = converted
+		format = DiskFormatQCOW2
+	}
+
+	upload, err := v.NewDynamicLayer("load-"+image, v.provisionStoragePool, WithFormat(format.libvirtType()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating import layer: %w", err)
+	}
+
+	if err := upload.Upload(content); err != nil {
+		if rmErr := upload.Delete(); rmErr != nil {
+			log.WithError(rmErr).Warnf("could not remove import layer after failed upload")
+		}
+		return nil, err
+	}
+
+	layer := upload
+	if format != DiskFormatQCOW2 {
+		converted, err := upload.convertedAs(DynamicLayerName("load-converted-"+image), DiskFormatQCOW2)
+		if rmErr := upload.Delete(); rmErr != nil {
+			log.WithError(rmErr).Warnf("could not remove import layer after conversion")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %s disk image to qcow2: %w", format, err)
+		}
+
+		layer = converted
+	}
+
+	vl, err := layer.ToVolumeLayer(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error persisting imported layer: %w", err)
+	}
+
+	return v.MakeImage(image, vl)
+}
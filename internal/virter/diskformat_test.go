@@ -0,0 +1,171 @@
+package virter
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectDiskFormat(t *testing.T) {
+	vdi := make([]byte, diskFormatHeaderSize)
+	copy(vdi, "<<< Oracle VM VirtualBox Disk Image >>>\n")
+	copy(vdi[0x40:], []byte{0x7f, 0x10, 0xda, 0xbe})
+
+	tests := []struct {
+		description string
+		header      []byte
+		expected    DiskFormat
+		expectErr   bool
+	}{
+		{description: "qcow2", header: []byte("QFI\xfb\x00\x00\x00\x03"), expected: DiskFormatQCOW2},
+		{description: "vmdk", header: []byte("KDMV\x01\x00\x00\x00"), expected: DiskFormatVMDK},
+		{description: "vmdk-descriptor", header: []byte("# Disk DescriptorFile\nversion=1\n"), expectErr: true},
+		{description: "vhd", header: []byte("conectix\x00\x00\x00\x02"), expected: DiskFormatVHD},
+		{description: "vdi", header: vdi, expected: DiskFormatVDI},
+		{description: "vhdx", header: []byte("vhdxfile\x00\x00"), expected: DiskFormatVHDX},
+		{description: "raw", header: make([]byte, diskFormatHeaderSize), expected: DiskFormatRaw},
+		{description: "empty", header: nil, expected: DiskFormatRaw},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			actual, err := DetectDiskFormat(test.header)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got format %s", actual)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if actual != test.expected {
+				t.Errorf("expected format %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDiskCompression(t *testing.T) {
+	content := bytes.Repeat([]byte("QFI\xfb some disk content"), 1000)
+
+	for _, compression := range []DiskCompression{DiskCompressionNone, DiskCompressionGzip, DiskCompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := CompressingWriter(&buf, compression)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := w.Write(content); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err := w.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			r, detected, err := decompressingReader(&buf)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer r.Close()
+
+			if detected != compression {
+				t.Errorf("expected compression %s, got %s", compression, detected)
+			}
+
+			actual, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(content, actual) {
+				t.Errorf("content changed by compression")
+			}
+		})
+	}
+}
+
+// fakeQemuImg puts a qemu-img into PATH that records its arguments and writes the source prefixed with "converted:" to
+// the destination. It returns the file the arguments are recorded in.
+func fakeQemuImg(t *testing.T) string {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo "$@" > "$(dirname "$0")/args"
+eval src=\${$(($# - 1))}
+eval dst=\${$#}
+{ printf 'converted:'; cat "$src"; } > "$dst"
+`
+	if err := os.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0o755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return filepath.Join(dir, "args")
+}
+
+func TestConvertDiskImage(t *testing.T) {
+	argsFile := fakeQemuImg(t)
+
+	tests := []struct {
+		description string
+		from        DiskFormat
+		to          DiskFormat
+		compress    bool
+		expected    string
+	}{
+		{description: "vhdx", from: DiskFormatQCOW2, to: DiskFormatVHDX, expected: "convert -f qcow2 -O vhdx"},
+		{description: "vhd", from: DiskFormatVHDX, to: DiskFormatVHD, expected: "convert -f vhdx -O vpc"},
+		{description: "compressed-qcow2", from: DiskFormatQCOW2, to: DiskFormatQCOW2, compress: true, expected: "convert -f qcow2 -O qcow2 -c"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r, err := ConvertDiskImage(strings.NewReader("disk"), test.from, test.to, test.compress)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			content, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(content) != "converted:disk" {
+				t.Errorf("unexpected converted content %q", content)
+			}
+
+			dir := filepath.Dir(r.(*tempFileReader).Name())
+			if err := r.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Errorf("temporary directory %s was not removed", dir)
+			}
+
+			args, err := os.ReadFile(argsFile)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !strings.HasPrefix(string(args), test.expected+" ") {
+				t.Errorf("expected qemu-img %s, got %s", test.expected, args)
+			}
+		})
+	}
+}
+
+func TestConvertDiskImageFailure(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	if _, err := ConvertDiskImage(strings.NewReader("disk"), DiskFormatQCOW2, DiskFormatVHDX, false); err == nil {
+		t.Errorf("expected error without qemu-img")
+	}
+}
@@ -10,10 +10,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/LINBIT/containerapi"
 	"github.com/digitalocean/go-libvirt"
@@ -46,6 +48,7 @@ type LocalImage struct {
 	topLayer *VolumeLayer
 	lock     sync.Mutex
 	layers   []regv1.Layer
+	config   *regv1.ConfigFile
 	opts     []LayerOperationOption
 }
 
@@ -88,6 +91,25 @@ func (l *LocalImage) Layers() ([]regv1.Layer, error) {
 	}
 }
 
+// VolumeLayers returns the ordered list of volume layers that make up this image, oldest first.
+//
+// Unlike Layers, this does not prepare the layers for pushing, so it is cheap.
+func (l *LocalImage) VolumeLayers() ([]*VolumeLayer, error) {
+	var layers []*VolumeLayer
+	for cur := l.topLayer; cur != nil; {
+		layers = append([]*VolumeLayer{cur}, layers...)
+
+		dep, err := cur.Dependency()
+		if err != nil {
+			return nil, err
+		}
+
+		cur = dep
+	}
+
+	return layers, nil
+}
+
 // MediaType of this image's manifest.
 func (l *LocalImage) MediaType() (types.MediaType, error) {
 	return types.DockerManifestSchema2, nil
@@ -103,12 +125,37 @@ func (l *LocalImage) ConfigName() (regv1.Hash, error) {
 	return partial.ConfigName(l)
 }
 
+// LayersDigest returns a digest over the uncompressed ids of all layers of the image. Unlike ConfigName, it does not
+// change when only the stored configuration, such as labels or history, changes.
+func (l *LocalImage) LayersDigest() (regv1.Hash, error) {
+	layers, err := l.VolumeLayers()
+	if err != nil {
+		return regv1.Hash{}, err
+	}
+
+	h := sha256.New()
+	for _, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return regv1.Hash{}, err
+		}
+		fmt.Fprintf(h, "%s\n", diffID)
+	}
+
+	return regv1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
 // ConfigFile returns this image's config file.
 //
-// For containers this specifies metadata like which command to run and permissions. For us this simply carries
-// the list layers by their uncompressed id.
+// For containers this specifies metadata like which command to run and permissions. For us this carries the list
+// layers by their uncompressed id, together with the stored configuration of the image, such as its history.
 func (l *LocalImage) ConfigFile() (*regv1.ConfigFile, error) {
-	layers, err := l.Layers()
+	layers, err := l.VolumeLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := l.storedConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -122,12 +169,13 @@ func (l *LocalImage) ConfigFile() (*regv1.ConfigFile, error) {
 		ids[i] = digest
 	}
 
-	return &regv1.ConfigFile{
-		RootFS: regv1.RootFS{
-			Type:    RootFSType,
-			DiffIDs: ids,
-		},
-	}, nil
+	cfg := stored.DeepCopy()
+	cfg.RootFS = regv1.RootFS{
+		Type:    RootFSType,
+		DiffIDs: ids,
+	}
+
+	return cfg, nil
 }
 
 // RawConfigFile returns the serialized bytes of ConfigFile().
@@ -284,7 +332,8 @@ func (v *Virter) FindImage(image string, pool libvirt.StoragePool, opts ...Layer
 
 // MakeImage creates a new LocalImage of the given name, pointing to the given VolumeLayer.
 //
-// If an image of the given name already exists it will be deleted first.
+// If an image of the given name already exists with a different top layer, it will be deleted first, together with its
+// stored configuration.
 func (v *Virter) MakeImage(image string, topLayer *VolumeLayer, opts ...LayerOperationOption) (*LocalImage, error) {
 	rawName := TagVolumePrefix + image
 	existing, err := v.FindRawLayer(rawName, v.provisionStoragePool)
@@ -322,12 +371,17 @@ func (v *Virter) MakeImage(image string, topLayer *VolumeLayer, opts ...LayerOpe
 		log.WithField("image", image).Info("replaced image tag")
 	}
 
+	if err := v.removeImageConfig(image); err != nil {
+		return nil, err
+	}
+
 	raw, err := v.emptyVolume(rawName, v.provisionStoragePool, WithBackingLayer(topLayer))
 	if err != nil {
 		return nil, err
 	}
 
 	tagLayer := &RawLayer{
+		conn:   v.libvirt,
 		volume: raw,
 		pool:   v.provisionStoragePool,
 	}
@@ -339,6 +393,56 @@ func (v *Virter) MakeImage(image string, topLayer *VolumeLayer, opts ...LayerOpe
 	}, nil
 }
 
+// ImageTag creates the image target, pointing to the same layers as the image source. Only a new tag volume is
+// created, the layers are shared. The stored configuration of the source image is copied.
+//
+// If the target image already exists, it is replaced. Returns an error if the source image does not exist.
+func (v *Virter) ImageTag(source, target string) (*LocalImage, error) {
+	sourceImage, err := v.FindImage(source, v.provisionStoragePool)
+	if err != nil {
+		return nil, err
+	}
+
+	if sourceImage == nil {
+		return nil, fmt.Errorf("image '%s' not present in local storage", source)
+	}
+
+	if source == target {
+		return sourceImage, nil
+	}
+
+	targetImage, err := v.MakeImage(target, sourceImage.topLayer)
+	if err != nil {
+		return nil, err
+	}
+
+	configLayer, err := sourceImage.tagLayer.sibling(ConfigVolumePrefix + source)
+	if err != nil {
+		return nil, err
+	}
+
+	if configLayer == nil {
+		// MakeImage keeps the configuration if the target already pointed to the same layer
+		if err := v.removeImageConfig(target); err != nil {
+			return nil, err
+		}
+
+		return targetImage, nil
+	}
+
+	cfg, err := sourceImage.storedConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := v.SetImageConfig(target, cfg); err != nil {
+		return nil, err
+	}
+
+	targetImage.config = cfg
+	return targetImage, nil
+}
+
 // ImageImport imports the given registry image into the specified local storage pool
 func (v *Virter) ImageImport(name string, pool libvirt.StoragePool, image regv1.Image, opts ...LayerOperationOption) (*LocalImage, error) {
 	o := makeLayerOperationOpts(opts...)
@@ -438,7 +542,27 @@ func (v *Virter) ImageImport(name string, pool libvirt.StoragePool, image regv1.
 		return nil, fmt.Errorf("tried importing an empty image")
 	}
 
-	return v.MakeImage(name, topLayer)
+	localImage, err := v.MakeImage(name, topLayer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the configuration, so that the history survives pushing and pulling
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image configuration: %w", err)
+	}
+
+	if cfg != nil {
+		if err := v.SetImageConfig(name, cfg); err != nil {
+			return nil, err
+		}
+
+		localImage.config = cfg.DeepCopy()
+		localImage.config.RootFS = regv1.RootFS{}
+	}
+
+	return localImage, nil
 }
 
 // ImageImportFromReader imports a new image into the specified local storage pool from a basic reader.
@@ -446,7 +570,20 @@ func (v *Virter) ImageImportFromReader(image string, reader io.ReadCloser, pool
 	defer reader.Close()
 
 	diffId := sha256.New()
-	teeReader := io.TeeReader(reader, diffId)
+	hashes := []io.Writer{diffId}
+
+	o := makeLayerOperationOpts(opts...)
+	var checksum hash.Hash
+	if o.Checksum != nil {
+		var err error
+		checksum, err = o.Checksum.newHash()
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, checksum)
+	}
+
+	teeReader := io.TeeReader(reader, io.MultiWriter(hashes...))
 
 	dynLayer, err := v.NewDynamicLayer(image, pool)
 	if err != nil {
@@ -462,6 +599,15 @@ func (v *Virter) ImageImportFromReader(image string, reader io.ReadCloser, pool
 		return nil, err
 	}
 
+	if checksum != nil {
+		if err := o.Checksum.verify(checksum); err != nil {
+			if rmErr := dynLayer.Delete(); rmErr != nil {
+				err = fmt.Errorf("could not remove image: %v, after verification failed: %w", rmErr, err)
+			}
+			return nil, err
+		}
+	}
+
 	hash := regv1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(diffId.Sum(nil))}
 	layer, err := dynLayer.ToVolumeLayer(&hash, opts...)
 	if err != nil {
@@ -491,6 +637,10 @@ func (v *Virter) ImageRm(name string, pool libvirt.StoragePool) error {
 	}
 
 	if count > 0 {
+		if err := v.removeImageConfig(name); err != nil {
+			return err
+		}
+
 		log.WithField("image", name).Info("deleted image")
 	}
 	return nil
@@ -541,60 +691,159 @@ type ImageBuildTools struct {
 type ImageBuildConfig struct {
 	ContainerName   string
 	ProvisionConfig ProvisionConfig
+	// ProvisionLogDir is the directory to write the provisioning logs to. If empty, no log files are written.
+	ProvisionLogDir string
+	// ProvisionReport collects the results of the provisioning steps. May be nil.
+	ProvisionReport *ProvisionReport
 	CommitConfig    CommitConfig
+	// KeepOnFailure leaves the VM running if provisioning or committing fails, instead of deleting it
+	KeepOnFailure bool
+	// CacheKey identifies the inputs of the build. It is recorded in the history of the new image.
+	CacheKey string
+	// CheckpointAllSteps commits a checkpoint after every provisioning step, instead of only after the steps with
+	// checkpoint set.
+	CheckpointAllSteps bool
+	// IgnoreCheckpoints runs all steps, even if checkpoints of an earlier build exist. New checkpoints are still
+	// committed.
+	IgnoreCheckpoints bool
+	// CacheExcludes are paths that are not taken into account for the keys of checkpoints, see BuildCacheKey
+	CacheExcludes []string
+	// Provenance is recorded in the configuration of the new image. The base digest and build time are filled in
+	// by ImageBuild.
+	Provenance ImageProvenance
 }
 
-func (v *Virter) imageBuildProvisionCommit(ctx context.Context, tools ImageBuildTools, vmConfig VMConfig, readyConfig VmReadyConfig, buildConfig ImageBuildConfig, opts ...LayerOperationOption) error {
-	vmNames := []string{vmConfig.Name}
-	var err error
+// BuildVMKeptError is returned by ImageBuild if the build failed and the VM was kept because of KeepOnFailure.
+type BuildVMKeptError struct {
+	VMName string
+	Err    error
+}
 
-	err = v.WaitVmReady(ctx, tools.ShellClientBuilder, vmConfig.Name, readyConfig)
-	if err != nil {
-		return err
+func (e *BuildVMKeptError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BuildVMKeptError) Unwrap() error {
+	return e.Err
+}
+
+// imageBuildProvisionCommit runs the provisioning steps from firstStep on in the VM and commits the image. At every
+// checkpoint the VM is committed to a checkpoint layer and started again from it.
+func (v *Virter) imageBuildProvisionCommit(ctx context.Context, tools ImageBuildTools, vmConfig VMConfig, readyConfig VmReadyConfig, buildConfig ImageBuildConfig, checkpoints []imageBuildCheckpoint, firstStep int, opts ...LayerOperationOption) error {
+	provisionTools := ProvisionTools{
+		ShellClientBuilder: tools.ShellClientBuilder,
+		ContainerProvider:  tools.ContainerProvider,
+		NetworkCopier:      netcopy.NewRsyncNetworkCopier(),
 	}
 
-	for _, s := range buildConfig.ProvisionConfig.Steps {
-		if s.Container != nil {
-			containerCfg := containerapi.NewContainerConfig(
-				buildConfig.ContainerName,
-				s.Container.Image,
-				s.Container.Env,
-				containerapi.WithCommand(s.Container.Command...),
-				containerapi.WithPullConfig(s.Container.Pull.ForContainer()),
-			)
-			err = v.VMExecContainer(ctx, tools.ContainerProvider, vmNames, containerCfg, nil)
-		} else if s.Shell != nil {
-			err = v.VMExecShell(ctx, vmNames, s.Shell)
-		} else if s.Rsync != nil {
-			copier := netcopy.NewRsyncNetworkCopier()
-			err = v.VMExecRsync(ctx, copier, vmNames, s.Rsync)
+	steps := buildConfig.ProvisionConfig.Steps
+	for {
+		err := v.WaitVmReady(ctx, tools.ShellClientBuilder, vmConfig.Name, readyConfig)
+		if err != nil {
+			return err
+		}
+
+		var checkpoint *imageBuildCheckpoint
+		lastStep := len(steps) - 1
+		for i := range checkpoints {
+			if checkpoints[i].after >= firstStep {
+				checkpoint = &checkpoints[i]
+				lastStep = checkpoint.after
+				break
+			}
 		}
 
+		pc := buildConfig.ProvisionConfig
+		pc.Steps = steps[firstStep : lastStep+1]
+
+		execConfig := ProvisionExecConfig{
+			ContainerName: buildConfig.ContainerName,
+			ReadyConfig:   readyConfig,
+			LogDir:        buildConfig.ProvisionLogDir,
+			Report:        buildConfig.ProvisionReport,
+			StepOffset:    firstStep,
+		}
+
+		err = v.VMExecProvision(ctx, provisionTools, []string{vmConfig.Name}, pc, execConfig)
 		if err != nil {
 			return err
 		}
-	}
 
-	err = v.VMCommit(ctx, tools.AfterNotifier, vmConfig.Name, buildConfig.CommitConfig, vmConfig.StaticDHCP, opts...)
-	if err != nil {
-		return err
+		if checkpoint == nil {
+			break
+		}
+
+		checkpointCommit := CommitConfig{
+			Shutdown:        true,
+			ShutdownTimeout: buildConfig.CommitConfig.ShutdownTimeout,
+		}
+
+		layer, err := v.vmCommitLayer(ctx, tools.AfterNotifier, vmConfig.Name, checkpointCommit, vmConfig.StaticDHCP, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to commit checkpoint after step %d: %w", checkpoint.after, err)
+		}
+
+		vmConfig.Image, err = v.makeCheckpoint(checkpoint.key, layer)
+		if err != nil {
+			return fmt.Errorf("failed to commit checkpoint after step %d: %w", checkpoint.after, err)
+		}
+
+		log.Infof("Committed checkpoint after step %d", checkpoint.after)
+
+		err = v.VMRun(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		firstStep = checkpoint.after + 1
 	}
 
-	return nil
+	return v.VMCommit(ctx, tools.AfterNotifier, vmConfig.Name, buildConfig.CommitConfig, vmConfig.StaticDHCP, opts...)
 }
 
 // ImageBuild builds an image by running a VM and provisioning it.
+//
+// If checkpoints of an earlier build with the same base image and steps exist, the build resumes from the latest one,
+// unless IgnoreCheckpoints is set.
 func (v *Virter) ImageBuild(ctx context.Context, tools ImageBuildTools, vmConfig VMConfig, readyConfig VmReadyConfig, buildConfig ImageBuildConfig, opts ...LayerOperationOption) error {
+	baseImage := vmConfig.Image
+
+	checkpoints, err := imageBuildCheckpoints(baseImage, buildConfig)
+	if err != nil {
+		return err
+	}
+
+	firstStep := 0
+	if !buildConfig.IgnoreCheckpoints {
+		for i := len(checkpoints) - 1; i >= 0; i-- {
+			checkpointImage, err := v.findCheckpoint(checkpoints[i].key)
+			if err != nil {
+				return err
+			}
+
+			if checkpointImage != nil {
+				log.Infof("Resuming build from checkpoint after step %d", checkpoints[i].after)
+				vmConfig.Image = checkpointImage
+				firstStep = checkpoints[i].after + 1
+				break
+			}
+		}
+	}
+
 	// VMRun is responsible to call CheckVMConfig here!
 	// TODO(): currently we can not know why VM run failed, so we don't clean up in this stage,
 	//         it could have been an existing VM, we don't want to delete it.
-	err := v.VMRun(vmConfig)
+	err = v.VMRun(vmConfig)
 	if err != nil {
 		return err
 	}
 
 	// from here on it is safe to rm the VM if something fails
-	err = v.imageBuildProvisionCommit(ctx, tools, vmConfig, readyConfig, buildConfig, opts...)
+	err = v.imageBuildProvisionCommit(ctx, tools, vmConfig, readyConfig, buildConfig, checkpoints, firstStep, opts...)
+	if err != nil && buildConfig.KeepOnFailure {
+		log.Warnf("could not build image, keeping VM %s", vmConfig.Name)
+		return &BuildVMKeptError{VMName: vmConfig.Name, Err: err}
+	}
 	if err != nil {
 		log.Warn("could not build image, deleting VM")
 		if rmErr := v.VMRm(vmConfig.Name, !vmConfig.StaticDHCP, true); rmErr != nil {
@@ -603,5 +852,90 @@ func (v *Virter) ImageBuild(ctx context.Context, tools ImageBuildTools, vmConfig
 		return err
 	}
 
+	// The VM is gone once it is committed, so there is nothing to keep or delete if recording fails
+	err = v.recordImageBuild(baseImage, buildConfig)
+	if err != nil {
+		return fmt.Errorf("failed to record build of image: %w", err)
+	}
+
 	return nil
 }
+
+// ImageBuildUpToDate checks whether target was built from baseImage by a build with the given cache key, i.e.
+// whether building again would produce the same image.
+//
+// The base image is identified by the digest of its layers recorded in the provenance of target, so relabeling the
+// base image does not make target out of date. Images built before the provenance was recorded have no checkpoint
+// layers, so their base layer is the one right below the top layer.
+func ImageBuildUpToDate(baseImage *LocalImage, target regv1.Image, cacheKey string) (bool, error) {
+	targetCfg, err := target.ConfigFile()
+	if err != nil {
+		return false, err
+	}
+
+	if len(targetCfg.History) == 0 {
+		// No history information, image wasn't provision with (new) virter
+		return false, nil
+	}
+
+	lastHistoryEntry := targetCfg.History[len(targetCfg.History)-1]
+	if cacheKey != lastHistoryEntry.Comment {
+		return false, nil
+	}
+
+	if baseDigest := targetCfg.Config.Labels[LabelBaseDigest]; baseDigest != "" {
+		currentBaseDigest, err := baseImage.LayersDigest()
+		if err != nil {
+			return false, err
+		}
+
+		return baseDigest == currentBaseDigest.String(), nil
+	}
+
+	if len(targetCfg.RootFS.DiffIDs) < 2 {
+		// There doesn't seem to be a base layer for this image
+		return false, nil
+	}
+
+	targetBaseImageID := targetCfg.RootFS.DiffIDs[len(targetCfg.RootFS.DiffIDs)-2]
+
+	currentBaseImageID, err := baseImage.TopLayer().DiffID()
+	if err != nil {
+		return false, err
+	}
+
+	return targetBaseImageID == currentBaseImageID, nil
+}
+
+// recordImageBuild stores the configuration of a newly built image: the history of the base image, followed by an
+// entry for the build itself, and the provenance of the build.
+func (v *Virter) recordImageBuild(baseImage *LocalImage, buildConfig ImageBuildConfig) error {
+	provenance := buildConfig.Provenance
+	cfg := &regv1.ConfigFile{}
+	if baseImage != nil {
+		baseCfg, err := baseImage.storedConfig()
+		if err != nil {
+			return err
+		}
+		cfg = baseCfg.DeepCopy()
+
+		baseDigest, err := baseImage.LayersDigest()
+		if err != nil {
+			return fmt.Errorf("failed to determine digest of base image layers: %w", err)
+		}
+		provenance.BaseDigest = baseDigest.String()
+	}
+
+	now := time.Now().UTC()
+	provenance.BuildTime = now.Format(time.RFC3339)
+	provenance.apply(cfg)
+
+	cfg.Created = regv1.Time{Time: now}
+	cfg.History = append(cfg.History, regv1.History{
+		Created:   regv1.Time{Time: now},
+		CreatedBy: "virter image build",
+		Comment:   buildConfig.CacheKey,
+	})
+
+	return v.SetImageConfig(buildConfig.CommitConfig.ImageName, cfg)
+}
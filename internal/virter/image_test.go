@@ -1,21 +1,29 @@
 package virter_test
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"errors"
 	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"testing/iotest"
+	"time"
 
 	regv1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/fake"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 
 	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/internal/virter/mocks"
 )
 
 func TestLocalImage_Layers(t *testing.T) {
@@ -112,6 +120,19 @@ func TestVirter_ImageImportFromReader(t *testing.T) {
 	assert.Nil(t, failed)
 	// 4 volumes: 2 * (existing content + tag volume), no new volume from failed import
 	assert.Len(t, l.pools[poolName].vols, 4)
+
+	mismatch := virter.ExpectedChecksum{Algorithm: "sha256", Hex: strings.Repeat("0", 64)}
+	failed, err = v.ImageImportFromReader("image3", io.NopCloser(strings.NewReader(ExampleLayerContent)), pool, virter.WithExpectedChecksum(mismatch))
+	assert.ErrorIs(t, err, virter.ErrChecksumMismatch)
+	assert.Nil(t, failed)
+	// 4 volumes: 2 * (existing content + tag volume), no new volume from unverified import
+	assert.Len(t, l.pools[poolName].vols, 4)
+
+	sum := sha512.Sum512([]byte(ExampleLayerContent))
+	match := virter.ExpectedChecksum{Algorithm: "sha512", Hex: hex.EncodeToString(sum[:])}
+	img3, err := v.ImageImportFromReader("image3", io.NopCloser(strings.NewReader(ExampleLayerContent)), pool, virter.WithExpectedChecksum(match))
+	assert.NoError(t, err)
+	assert.Equal(t, img3.TopLayer(), layer)
 }
 
 func TestVirter_ImageList(t *testing.T) {
@@ -235,3 +256,362 @@ func TestVirter_Image(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, ExampleLayerContent, string(layerContent))
 }
+
+func TestBuildVMKeptError(t *testing.T) {
+	err := error(&virter.BuildVMKeptError{VMName: "build-vm", Err: &virter.ContainerExitError{Status: 3}})
+
+	assert.Equal(t, "container exited with status 3", err.Error())
+
+	var containerErr *virter.ContainerExitError
+	assert.True(t, errors.As(err, &containerErr))
+	assert.Equal(t, 3, containerErr.Status)
+}
+
+func TestVirter_ImageBuildKeepOnFailure(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		l := newFakeLibvirtConnection()
+		l.addFakeImage(poolName, imageName)
+
+		v := virter.New(l, poolName, networkName, newMockKeystore())
+		pool, err := l.StoragePoolLookupByName(poolName)
+		assert.NoError(t, err)
+
+		img, err := v.FindImage(imageName, pool)
+		assert.NoError(t, err)
+
+		shell := new(mocks.MockShellClient)
+		shell.On("DialContext", mock.Anything).Return(nil)
+		shell.On("Close").Return(nil)
+		shell.On("ExecScript", mock.Anything).Return(nil)
+
+		container := mockContainerProvider()
+		container.exitStatus = 3
+
+		tools := virter.ImageBuildTools{
+			ShellClientBuilder: MockShellClientBuilder{shell},
+			ContainerProvider:  container,
+		}
+
+		vmConfig := virter.VMConfig{
+			Image:     img,
+			Name:      vmName,
+			ID:        vmID,
+			VCPUs:     1,
+			MemoryKiB: 1024,
+		}
+
+		buildConfig := virter.ImageBuildConfig{
+			ContainerName: "test",
+			ProvisionConfig: virter.ProvisionConfig{
+				Steps: []virter.ProvisionStep{{Container: &virter.ProvisionContainerStep{Image: containerImageName}}},
+			},
+			KeepOnFailure: keep,
+		}
+
+		err = v.ImageBuild(context.Background(), tools, vmConfig, virter.VmReadyConfig{Retries: 1, CheckTimeout: time.Second}, buildConfig)
+
+		var containerErr *virter.ContainerExitError
+		assert.True(t, errors.As(err, &containerErr))
+
+		var keptErr *virter.BuildVMKeptError
+		if keep {
+			assert.True(t, errors.As(err, &keptErr))
+			assert.Equal(t, vmName, keptErr.VMName)
+			assert.Contains(t, l.domains, vmName)
+			assert.Contains(t, l.pools[poolName].vols, virter.DynamicLayerName(vmName))
+			assert.Contains(t, l.pools[poolName].vols, virter.DynamicLayerName(vmName+"-cidata"))
+		} else {
+			assert.False(t, errors.As(err, &keptErr))
+			assert.NotContains(t, l.domains, vmName)
+			assert.NotContains(t, l.pools[poolName].vols, virter.DynamicLayerName(vmName))
+			assert.NotContains(t, l.pools[poolName].vols, virter.DynamicLayerName(vmName+"-cidata"))
+		}
+	}
+}
+
+func TestImageBuildUpToDate(t *testing.T) {
+	l, layer := prepareVolumeLayer(t)
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+
+	base, err := v.MakeImage("base", layer)
+	assert.NoError(t, err)
+
+	baseDigest, err := base.LayersDigest()
+	assert.NoError(t, err)
+
+	baseLayerID, err := base.TopLayer().DiffID()
+	assert.NoError(t, err)
+
+	checkpointLayerID := regv1.Hash{Algorithm: "sha256", Hex: strings.Repeat("1", 64)}
+	finalLayerID := regv1.Hash{Algorithm: "sha256", Hex: strings.Repeat("2", 64)}
+	otherID := regv1.Hash{Algorithm: "sha256", Hex: strings.Repeat("3", 64)}
+
+	testcases := []struct {
+		name       string
+		diffIDs    []regv1.Hash
+		baseDigest string
+		key        string
+		expected   bool
+	}{
+		{
+			name:       "with checkpoint",
+			diffIDs:    []regv1.Hash{baseLayerID, checkpointLayerID, finalLayerID},
+			baseDigest: baseDigest.String(),
+			key:        "sha256:1234",
+			expected:   true,
+		},
+		{
+			name:       "with checkpoint, other key",
+			diffIDs:    []regv1.Hash{baseLayerID, checkpointLayerID, finalLayerID},
+			baseDigest: baseDigest.String(),
+			key:        "sha256:5678",
+		},
+		{
+			name:       "other base image",
+			diffIDs:    []regv1.Hash{baseLayerID, finalLayerID},
+			baseDigest: otherID.String(),
+			key:        "sha256:1234",
+		},
+		{
+			name:     "without provenance",
+			diffIDs:  []regv1.Hash{baseLayerID, finalLayerID},
+			key:      "sha256:1234",
+			expected: true,
+		},
+		{
+			name:    "without provenance, other base image",
+			diffIDs: []regv1.Hash{otherID, finalLayerID},
+			key:     "sha256:1234",
+		},
+	}
+
+	for _, tcase := range testcases {
+		t.Run(tcase.name, func(t *testing.T) {
+			cfg := &regv1.ConfigFile{
+				History: []regv1.History{{CreatedBy: "virter image build", Comment: "sha256:1234"}},
+				RootFS:  regv1.RootFS{Type: "layers", DiffIDs: tcase.diffIDs},
+			}
+			if tcase.baseDigest != "" {
+				cfg.Config.Labels = map[string]string{virter.LabelBaseDigest: tcase.baseDigest}
+			}
+
+			target := &fake.FakeImage{
+				ConfigFileStub: func() (*regv1.ConfigFile, error) {
+					return cfg, nil
+				},
+			}
+
+			actual, err := virter.ImageBuildUpToDate(base, target, tcase.key)
+			assert.NoError(t, err)
+			assert.Equal(t, tcase.expected, actual)
+		})
+	}
+
+	// Relabeling the base image changes its ID, but not the image built from it
+	baseID, err := base.ConfigName()
+	assert.NoError(t, err)
+	assert.NoError(t, v.SetImageLabels(base, map[string]string{"com.example.relabeled": "true"}))
+	pool, err := l.StoragePoolLookupByName(poolName)
+	assert.NoError(t, err)
+	base, err = v.FindImage("base", pool)
+	assert.NoError(t, err)
+	relabeledID, err := base.ConfigName()
+	assert.NoError(t, err)
+	assert.NotEqual(t, baseID, relabeledID)
+
+	target := &fake.FakeImage{
+		ConfigFileStub: func() (*regv1.ConfigFile, error) {
+			return &regv1.ConfigFile{
+				Config:  regv1.Config{Labels: map[string]string{virter.LabelBaseDigest: baseDigest.String()}},
+				History: []regv1.History{{CreatedBy: "virter image build", Comment: "sha256:1234"}},
+				RootFS:  regv1.RootFS{Type: "layers", DiffIDs: []regv1.Hash{baseLayerID, finalLayerID}},
+			}, nil
+		},
+	}
+	upToDate, err := virter.ImageBuildUpToDate(base, target, "sha256:1234")
+	assert.NoError(t, err)
+	assert.True(t, upToDate)
+}
+
+func TestVirter_SetImageConfig(t *testing.T) {
+	l, layer := prepareVolumeLayer(t)
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+	pool, err := l.StoragePoolLookupByName(poolName)
+	assert.NoError(t, err)
+
+	_, err = v.MakeImage("image1", layer)
+	assert.NoError(t, err)
+
+	history := []regv1.History{{CreatedBy: "virter image build", Comment: "sha256:1234"}}
+	err = v.SetImageConfig("image1", &regv1.ConfigFile{History: history})
+	assert.NoError(t, err)
+
+	img, err := v.FindImage("image1", pool)
+	assert.NoError(t, err)
+
+	cfg, err := img.ConfigFile()
+	assert.NoError(t, err)
+	assert.Equal(t, history, cfg.History)
+	assert.Len(t, cfg.RootFS.DiffIDs, 1)
+
+	// Tagging the same layer again keeps the configuration
+	img, err = v.MakeImage("image1", layer)
+	assert.NoError(t, err)
+
+	cfg, err = img.ConfigFile()
+	assert.NoError(t, err)
+	assert.Equal(t, history, cfg.History)
+
+	// Removing the image removes the configuration, configurations without image are pruned
+	err = v.ImageRm("image1", pool)
+	assert.NoError(t, err)
+
+	err = v.SetImageConfig("image2", &regv1.ConfigFile{History: history})
+	assert.NoError(t, err)
+
+	count, err := v.PruneImageConfigs()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestVirter_ImageTag(t *testing.T) {
+	l, layer := prepareVolumeLayer(t)
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+	pool, err := l.StoragePoolLookupByName(poolName)
+	assert.NoError(t, err)
+
+	_, err = v.ImageTag("image1", "image2")
+	assert.Error(t, err)
+
+	_, err = v.MakeImage("image1", layer)
+	assert.NoError(t, err)
+
+	history := []regv1.History{{CreatedBy: "virter image build", Comment: "sha256:1234"}}
+	err = v.SetImageConfig("image1", &regv1.ConfigFile{History: history})
+	assert.NoError(t, err)
+
+	img, err := v.ImageTag("image1", "image2")
+	assert.NoError(t, err)
+	assert.Equal(t, layer.Name(), img.TopLayer().Name())
+
+	// layer + 2 * (tag volume + config volume)
+	assert.Len(t, l.pools[poolName].vols, 5)
+
+	history2, err := img.History()
+	assert.NoError(t, err)
+	assert.Equal(t, history, history2)
+
+	// Removing one tag keeps the other one
+	err = v.ImageRm("image1", pool)
+	assert.NoError(t, err)
+
+	img, err = v.FindImage("image2", pool)
+	assert.NoError(t, err)
+	assert.NotNil(t, img)
+
+	history2, err = img.History()
+	assert.NoError(t, err)
+	assert.Equal(t, history, history2)
+
+	err = v.ImageRm("image2", pool)
+	assert.NoError(t, err)
+	assert.Empty(t, l.pools[poolName].vols)
+}
+
+func TestVirter_ImageLoad(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+
+	var compressed bytes.Buffer
+	w, err := virter.CompressingWriter(&compressed, virter.DiskCompressionZstd)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(ExampleLayerContent))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	// Raw input is converted to qcow2
+	img, err := v.ImageLoad("image1", &compressed, "")
+	assert.NoError(t, err)
+	assert.Equal(t, virter.LayerVolumePrefix+ExampleLayerDigest, img.TopLayer().Name())
+
+	// layer + tag volume
+	assert.Len(t, l.pools[poolName].vols, 2)
+	assert.Equal(t, "qcow2", l.pools[poolName].vols[img.TopLayer().Name()].description.Target.Format.Type)
+
+	qcow2Content := "QFI\xfb" + ExampleLayerContent
+	img, err = v.ImageLoad("image2", strings.NewReader(qcow2Content), "")
+	assert.NoError(t, err)
+	assert.Equal(t, qcow2Content, string(l.pools[poolName].vols[img.TopLayer().Name()].content))
+
+	// VHDX input is converted to qcow2 with qemu-img
+	bin := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(bin, "qemu-img"), []byte("#!/bin/sh\neval dst=\\${$#}\nprintf 'QFI\\373converted' > \"$dst\"\n"), 0o755))
+	t.Setenv("PATH", bin)
+	img, err = v.ImageLoad("image3", strings.NewReader("vhdxfile"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "QFI\xfbconverted", string(l.pools[poolName].vols[img.TopLayer().Name()].content))
+
+	t.Setenv("PATH", t.TempDir())
+	_, err = v.ImageLoad("image4", strings.NewReader("vhdxfile"), "")
+	assert.Error(t, err)
+}
+
+func TestVirter_SetImageLabels(t *testing.T) {
+	l, layer := prepareVolumeLayer(t)
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+	pool, err := l.StoragePoolLookupByName(poolName)
+	assert.NoError(t, err)
+
+	img, err := v.MakeImage("image1", layer)
+	assert.NoError(t, err)
+
+	user, err := img.SSHUser()
+	assert.NoError(t, err)
+	assert.Empty(t, user)
+
+	err = v.SetImageLabels(img, map[string]string{virter.LabelSSHUser: "vagrant"})
+	assert.NoError(t, err)
+
+	img, err = v.FindImage("image1", pool)
+	assert.NoError(t, err)
+
+	user, err = img.SSHUser()
+	assert.NoError(t, err)
+	assert.Equal(t, "vagrant", user)
+}
+
+func TestVirter_ImageDefaults(t *testing.T) {
+	l, layer := prepareVolumeLayer(t)
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+	pool, err := l.StoragePoolLookupByName(poolName)
+	assert.NoError(t, err)
+
+	img, err := v.MakeImage("image1", layer)
+	assert.NoError(t, err)
+
+	defaults, err := img.Defaults()
+	assert.NoError(t, err)
+	assert.Equal(t, virter.ImageDefaults{}, defaults)
+	assert.Empty(t, defaults.Labels())
+
+	expected := virter.ImageDefaults{
+		SSHUser:      "ubuntu",
+		MinMemoryKiB: 2 * 1024 * 1024,
+		Firmware:     virter.FirmwareEFI,
+		SecureBoot:   true,
+		DiskBus:      "scsi",
+	}
+	err = v.SetImageLabels(img, expected.Labels())
+	assert.NoError(t, err)
+
+	img, err = v.FindImage("image1", pool)
+	assert.NoError(t, err)
+
+	defaults, err = img.Defaults()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, defaults)
+
+	user, err := img.SSHUser()
+	assert.NoError(t, err)
+	assert.Equal(t, "ubuntu", user)
+}
@@ -0,0 +1,194 @@
+package virter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	regv1 "github.com/google/go-containerregistry/pkg/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigVolumePrefix is the prefix for the volumes storing the configuration of local images.
+//
+// libvirt storage volumes cannot carry any metadata, so the image configuration (history and the like) is stored as
+// JSON in a small raw volume next to the tag volume of the image.
+const ConfigVolumePrefix = "virter:config:"
+
+// LabelSSHUser is the label in the image configuration naming the user to log in as via SSH, if it is not root.
+const LabelSSHUser = "com.linbit.virter.ssh.user"
+
+// storedConfig returns the configuration stored for the image. Images without a stored configuration, for example
+// images created by older versions of virter, have an empty configuration.
+//
+// The RootFS of the returned configuration is always empty, as it is derived from the layers of the image.
+func (l *LocalImage) storedConfig() (*regv1.ConfigFile, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.config != nil {
+		return l.config, nil
+	}
+
+	cfg := &regv1.ConfigFile{}
+	configLayer, err := l.tagLayer.sibling(ConfigVolumePrefix + l.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if configLayer != nil {
+		reader, err := configLayer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		// The volume may be larger than the content, the padding after the JSON document is ignored
+		if err := json.NewDecoder(reader).Decode(cfg); err != nil {
+			return nil, fmt.Errorf("failed to decode configuration of image '%s': %w", l.Name(), err)
+		}
+		_, _ = io.Copy(io.Discard, reader)
+	}
+
+	cfg.RootFS = regv1.RootFS{}
+	l.config = cfg
+	return cfg, nil
+}
+
+// History returns the history entries of the image, oldest first.
+func (l *LocalImage) History() ([]regv1.History, error) {
+	cfg, err := l.storedConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.History, nil
+}
+
+// SSHUser returns the user to log in as via SSH recorded in the image, or an empty string if there is none.
+func (l *LocalImage) SSHUser() (string, error) {
+	cfg, err := l.storedConfig()
+	if err != nil {
+		return "", err
+	}
+
+	return cfg.Config.Labels[LabelSSHUser], nil
+}
+
+// SetImageLabels adds labels to the stored configuration of an image, replacing labels of the same name.
+func (v *Virter) SetImageLabels(img *LocalImage, labels map[string]string) error {
+	stored, err := img.storedConfig()
+	if err != nil {
+		return err
+	}
+
+	cfg := stored.DeepCopy()
+	if cfg.Config.Labels == nil {
+		cfg.Config.Labels = map[string]string{}
+	}
+
+	for key, value := range labels {
+		cfg.Config.Labels[key] = value
+	}
+
+	if err := v.SetImageConfig(img.Name(), cfg); err != nil {
+		return err
+	}
+
+	img.lock.Lock()
+	img.config = cfg
+	img.lock.Unlock()
+
+	return nil
+}
+
+// sibling looks up another volume in the same pool. Returns (nil, nil) if the volume does not exist.
+func (rl *RawLayer) sibling(name string) (*RawLayer, error) {
+	vol, err := rl.conn.StorageVolLookupByName(rl.pool, name)
+	if err != nil {
+		if hasErrorCode(err, libvirt.ErrNoStorageVol) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("could not lookup storage volume '%s': %w", name, err)
+	}
+
+	return &RawLayer{conn: rl.conn, pool: rl.pool, volume: vol}, nil
+}
+
+// SetImageConfig stores the configuration of a local image, replacing any configuration stored before.
+//
+// The RootFS of the configuration is not stored, as it is always derived from the layers of the image.
+func (v *Virter) SetImageConfig(image string, cfg *regv1.ConfigFile) error {
+	stored := cfg.DeepCopy()
+	stored.RootFS = regv1.RootFS{}
+
+	encoded, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration of image '%s': %w", image, err)
+	}
+
+	if err := v.removeImageConfig(image); err != nil {
+		return err
+	}
+
+	sizeKiB := (uint64(len(encoded)) + 1023) / 1024
+	vol, err := v.emptyVolume(ConfigVolumePrefix+image, v.provisionStoragePool, WithFormat("raw"), WithCapacity(sizeKiB))
+	if err != nil {
+		return err
+	}
+
+	configLayer := &RawLayer{conn: v.libvirt, pool: v.provisionStoragePool, volume: vol}
+	if err := configLayer.Upload(bytes.NewReader(encoded)); err != nil {
+		_ = configLayer.Delete()
+		return fmt.Errorf("failed to store configuration of image '%s': %w", image, err)
+	}
+
+	return nil
+}
+
+// removeImageConfig deletes the stored configuration of an image, if there is any.
+func (v *Virter) removeImageConfig(image string) error {
+	existing, err := v.FindRawLayer(ConfigVolumePrefix+image, v.provisionStoragePool)
+	if err != nil {
+		return err
+	}
+
+	return existing.Delete()
+}
+
+// PruneImageConfigs deletes stored image configurations whose image no longer exists.
+// Returns the number of deleted configurations.
+func (v *Virter) PruneImageConfigs() (int, error) {
+	vols, _, err := v.libvirt.StoragePoolListAllVolumes(v.provisionStoragePool, -1, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list all volumes: %w", err)
+	}
+
+	tags := map[string]bool{}
+	for _, vol := range vols {
+		if strings.HasPrefix(vol.Name, TagVolumePrefix) {
+			tags[strings.TrimPrefix(vol.Name, TagVolumePrefix)] = true
+		}
+	}
+
+	count := 0
+	for _, vol := range vols {
+		if !strings.HasPrefix(vol.Name, ConfigVolumePrefix) || tags[strings.TrimPrefix(vol.Name, ConfigVolumePrefix)] {
+			continue
+		}
+
+		configLayer := &RawLayer{conn: v.libvirt, pool: v.provisionStoragePool, volume: vol}
+		if err := configLayer.Delete(); err != nil {
+			return count, err
+		}
+
+		log.WithField("volume", vol.Name).Debug("deleted image configuration")
+		count++
+	}
+
+	return count, nil
+}
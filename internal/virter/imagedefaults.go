@@ -0,0 +1,104 @@
+package virter
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Labels in the image configuration recording settings the image needs, see ImageDefaults.
+const (
+	LabelMinMemory  = "com.linbit.virter.memory.min"
+	LabelFirmware   = "com.linbit.virter.firmware"
+	LabelSecureBoot = "com.linbit.virter.secure_boot"
+	LabelDiskBus    = "com.linbit.virter.disk.bus"
+)
+
+// Firmware types for VMs
+const (
+	FirmwareBIOS = "bios"
+	FirmwareEFI  = "efi"
+)
+
+// ImageDefaults are settings an image needs to work properly, for example because it only boots with UEFI. They are
+// recorded as labels in the image configuration, so that they are applied whenever a VM is started from the image.
+type ImageDefaults struct {
+	SSHUser      string
+	MinMemoryKiB uint64
+	Firmware     string
+	SecureBoot   bool
+	DiskBus      string
+}
+
+// Labels returns the labels recording the defaults. Unset defaults have no label.
+func (d ImageDefaults) Labels() map[string]string {
+	labels := map[string]string{}
+	if d.SSHUser != "" {
+		labels[LabelSSHUser] = d.SSHUser
+	}
+
+	if d.MinMemoryKiB != 0 {
+		labels[LabelMinMemory] = strconv.FormatUint(d.MinMemoryKiB, 10)
+	}
+
+	if d.Firmware != "" {
+		labels[LabelFirmware] = d.Firmware
+	}
+
+	if d.SecureBoot {
+		labels[LabelSecureBoot] = "true"
+	}
+
+	if d.DiskBus != "" {
+		labels[LabelDiskBus] = d.DiskBus
+	}
+
+	return labels
+}
+
+// Check returns an error if the defaults contain values virter does not support.
+func (d ImageDefaults) Check() error {
+	switch d.Firmware {
+	case "", FirmwareBIOS, FirmwareEFI:
+	default:
+		return fmt.Errorf("unknown firmware '%s', expected %s or %s", d.Firmware, FirmwareBIOS, FirmwareEFI)
+	}
+
+	if d.DiskBus != "" {
+		if _, ok := busToDevPrefix[d.DiskBus]; !ok {
+			return fmt.Errorf("unknown disk bus '%s'", d.DiskBus)
+		}
+	}
+
+	return nil
+}
+
+// Defaults returns the defaults recorded in the image.
+func (l *LocalImage) Defaults() (ImageDefaults, error) {
+	cfg, err := l.storedConfig()
+	if err != nil {
+		return ImageDefaults{}, err
+	}
+
+	labels := cfg.Config.Labels
+	d := ImageDefaults{
+		SSHUser:  labels[LabelSSHUser],
+		Firmware: labels[LabelFirmware],
+		DiskBus:  labels[LabelDiskBus],
+	}
+
+	if s := labels[LabelMinMemory]; s != "" {
+		d.MinMemoryKiB, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return ImageDefaults{}, fmt.Errorf("invalid label %s in image '%s': %w", LabelMinMemory, l.Name(), err)
+		}
+	}
+
+	if s := labels[LabelSecureBoot]; s != "" {
+		d.SecureBoot, err = strconv.ParseBool(s)
+		if err != nil {
+			return ImageDefaults{}, fmt.Errorf("invalid label %s in image '%s': %w", LabelSecureBoot, l.Name(), err)
+		}
+	}
+
+	return d, nil
+}
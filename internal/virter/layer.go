@@ -65,6 +65,7 @@ type ProgressOpt interface {
 
 type layerOperatorOpts struct {
 	Progress ProgressOpt
+	Checksum *ExpectedChecksum
 }
 type LayerOperationOption = func(o *layerOperatorOpts)
 
@@ -74,6 +75,13 @@ func WithProgress(p ProgressOpt) LayerOperationOption {
 	}
 }
 
+// WithExpectedChecksum makes imports from a reader fail if the data read does not match the checksum.
+func WithExpectedChecksum(c ExpectedChecksum) LayerOperationOption {
+	return func(o *layerOperatorOpts) {
+		o.Checksum = &c
+	}
+}
+
 func makeLayerOperationOpts(opts ...LayerOperationOption) *layerOperatorOpts {
 	o := &layerOperatorOpts{}
 	for _, f := range opts {
@@ -166,7 +174,7 @@ func WithCapacity(minCapKib uint64) NewLayerOption {
 
 // WithFormat sets the format used by the storage volume.
 //
-// Supported values are "qcow2" and "raw".
+// Virter creates "qcow2" and "raw" volumes, other formats are only used for converting disk images, see DiskFormat.
 func WithFormat(fmt string) NewLayerOption {
 	return func(volume *lx.StorageVolume) error {
 		volume.Target.Format = &lx.StorageVolumeTargetFormat{Type: fmt}
@@ -580,6 +588,16 @@ func (rl *RawLayer) Descriptor() (lx.StorageVolume, error) {
 	return result, nil
 }
 
+// Sizes returns the capacity of the storage volume and the space allocated for it on the host, both in bytes.
+func (rl *RawLayer) Sizes() (capacity, allocation uint64, err error) {
+	_, capacity, allocation, err = rl.conn.StorageVolGetInfo(rl.volume)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get volume info for '%s': %w", rl.volume.Name, err)
+	}
+
+	return capacity, allocation, nil
+}
+
 // ToVolumeLayer converts this layer into a VolumeLayer.
 //
 // Since VolumeLayer are immutable, this is a no-op.
@@ -731,31 +749,44 @@ func (vl *VolumeLayer) asBackingStore() *lx.StorageVolumeBackingStore {
 //
 // All backing layers are squashed into a single layer, the returned layer will not depend on any other layers.
 func (vl *VolumeLayer) Squashed() (*RawLayer, error) {
-	original, err := vl.Descriptor()
+	return vl.SquashedAs(DiskFormatQCOW2)
+}
+
+// SquashedAs creates a squashed copy of this layer in the given disk format.
+//
+// All backing layers are squashed into a single layer, the returned layer will not depend on any other layers.
+func (vl *VolumeLayer) SquashedAs(format DiskFormat) (*RawLayer, error) {
+	return vl.convertedAs(DynamicLayerName("squash-from-"+vl.volume.Name), format)
+}
+
+// convertedAs creates a copy of this layer with the given name in the given disk format. Any backing layers are merged
+// into the copy. The conversion is done by libvirt, so no conversion tools are needed on this host.
+func (rl *RawLayer) convertedAs(name string, format DiskFormat) (*RawLayer, error) {
+	original, err := rl.Descriptor()
 	if err != nil {
 		return nil, err
 	}
 
 	newDesc := lx.StorageVolume{
-		Name:     DynamicLayerName("squash-from-" + original.Name),
+		Name:     name,
 		Capacity: original.Capacity,
-		Target:   &lx.StorageVolumeTarget{Format: &lx.StorageVolumeTargetFormat{Type: "qcow2"}},
+		Target:   &lx.StorageVolumeTarget{Format: &lx.StorageVolumeTargetFormat{Type: format.libvirtType()}},
 	}
 
 	encoded, err := newDesc.Marshal()
 	if err != nil {
-		return nil, fmt.Errorf("could not encode squashed storage volume: %w", err)
+		return nil, fmt.Errorf("could not encode converted storage volume: %w", err)
 	}
 
-	copyVol, err := vl.conn.StorageVolCreateXMLFrom(vl.pool, encoded, vl.volume, 0)
+	copyVol, err := rl.conn.StorageVolCreateXMLFrom(rl.pool, encoded, rl.volume, 0)
 	if err != nil {
 		return nil, fmt.Errorf("could not clone volume: %w", err)
 	}
 
 	return &RawLayer{
 		volume: copyVol,
-		pool:   vl.pool,
-		conn:   vl.conn,
+		pool:   rl.pool,
+		conn:   rl.conn,
 	}, nil
 }
 
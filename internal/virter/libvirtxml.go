@@ -96,8 +96,13 @@ func vmDisksToLibvirtDisks(vmDisks []VMDisk, diskCache string) ([]lx.DomainDisk,
 }
 
 func (v *Virter) vmXML(vm VMConfig, mac string, meta *VMMeta) (string, error) {
+	bootDiskBus := vm.BootDiskBus
+	if bootDiskBus == "" {
+		bootDiskBus = "virtio"
+	}
+
 	vmDisks := []VMDisk{
-		{device: VMDiskDeviceDisk, poolName: v.provisionStoragePool.Name, volumeName: DynamicLayerName(vm.Name), bus: "virtio", format: "qcow2"},
+		{device: VMDiskDeviceDisk, poolName: v.provisionStoragePool.Name, volumeName: DynamicLayerName(vm.Name), bus: bootDiskBus, format: "qcow2"},
 		{device: VMDiskDeviceCDROM, poolName: v.provisionStoragePool.Name, volumeName: DynamicLayerName(ciDataVolumeName(vm.Name)), bus: "scsi", format: "raw"},
 	}
 	for _, d := range vm.Disks {
@@ -241,6 +246,10 @@ func (v *Virter) vmXML(vm VMConfig, mac string, meta *VMMeta) (string, error) {
 		return "", err
 	}
 
+	if vm.Firmware == FirmwareEFI {
+		domain.OS.Firmware = "efi"
+	}
+
 	if vm.SecureBoot {
 		if domain.OS.Loader == nil {
 			domain.OS.Loader = &lx.DomainLoader{}
@@ -0,0 +1,284 @@
+package virter
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	log "github.com/sirupsen/logrus"
+)
+
+// ociRefNameAnnotation is the annotation naming an image in the index of an OCI image layout.
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// isOCITar returns true if the OCI image layout at path is stored as tar archive instead of a directory.
+func isOCITar(path string) bool {
+	return strings.HasSuffix(path, ".tar")
+}
+
+// ImageExportOCI writes images to the OCI image layout at path. If path ends with ".tar", the layout is stored as a
+// tar archive, otherwise as a directory.
+//
+// An existing layout is extended: the images are added to its index under their name, replacing images of the same
+// name. Layers shared by several images are only stored once.
+func (v *Virter) ImageExportOCI(path string, images []*LocalImage) error {
+	dir := path
+	if isOCITar(path) {
+		tmp, err := os.MkdirTemp("", "virter-oci-")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		defer os.RemoveAll(tmp)
+
+		err = extractOCITar(path, tmp)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		dir = tmp
+	}
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to open OCI layout '%s': %w", path, err)
+		}
+
+		p, err = layout.Write(dir, empty.Index)
+		if err != nil {
+			return fmt.Errorf("failed to create OCI layout '%s': %w", path, err)
+		}
+	}
+
+	for _, img := range images {
+		annotations := map[string]string{ociRefNameAnnotation: img.Name()}
+		err := p.ReplaceImage(img, match.Name(img.Name()), layout.WithAnnotations(annotations))
+		if err != nil {
+			return fmt.Errorf("failed to write image '%s' to OCI layout: %w", img.Name(), err)
+		}
+
+		log.WithField("image", img.Name()).Debug("exported image")
+	}
+
+	// Blobs of replaced images may not be referenced anymore
+	unused, err := p.GarbageCollect()
+	if err != nil {
+		return fmt.Errorf("failed to find unused blobs in OCI layout: %w", err)
+	}
+
+	for _, h := range unused {
+		if err := p.RemoveBlob(h); err != nil {
+			return fmt.Errorf("failed to remove unused blob from OCI layout: %w", err)
+		}
+	}
+
+	if isOCITar(path) {
+		return writeOCITar(dir, path)
+	}
+
+	return nil
+}
+
+// ImageImportOCI imports images from the OCI image layout at path, as written by ImageExportOCI.
+//
+// If names is empty, all images in the layout are imported. Otherwise, only the images with the given names are
+// imported. Returns the imported images.
+func (v *Virter) ImageImportOCI(path string, names []string, opts ...LayerOperationOption) ([]*LocalImage, error) {
+	dir := path
+	if isOCITar(path) {
+		tmp, err := os.MkdirTemp("", "virter-oci-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		defer os.RemoveAll(tmp)
+
+		if err := extractOCITar(path, tmp); err != nil {
+			return nil, err
+		}
+
+		dir = tmp
+	}
+
+	index, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OCI layout '%s': %w", path, err)
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index of OCI layout '%s': %w", path, err)
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var result []*LocalImage
+	for _, desc := range manifest.Manifests {
+		name := desc.Annotations[ociRefNameAnnotation]
+		if len(wanted) > 0 && !wanted[name] {
+			continue
+		}
+
+		if name == "" || !desc.MediaType.IsImage() {
+			log.WithField("digest", desc.Digest).Warn("skipping unnamed entry of OCI layout")
+			continue
+		}
+
+		img, err := index.Image(desc.Digest)
+		if err != nil {
+			return result, fmt.Errorf("failed to read image '%s' from OCI layout: %w", name, err)
+		}
+
+		localImg, err := v.ImageImport(name, v.provisionStoragePool, img, opts...)
+		if err != nil {
+			return result, fmt.Errorf("failed to import image '%s': %w", name, err)
+		}
+
+		delete(wanted, name)
+		result = append(result, localImg)
+	}
+
+	if len(wanted) > 0 {
+		missing := make([]string, 0, len(wanted))
+		for name := range wanted {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+
+		return result, fmt.Errorf("images not found in OCI layout '%s': %s", path, strings.Join(missing, ", "))
+	}
+
+	return result, nil
+}
+
+// writeOCITar stores the layout in dir as tar archive at path. The archive is replaced atomically, so that a failed
+// export does not destroy an existing archive.
+func writeOCITar(dir, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".virter-oci-*.tar")
+	if err != nil {
+		return fmt.Errorf("failed to create OCI archive: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write OCI archive: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write OCI archive: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write OCI archive: %w", err)
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// extractOCITar extracts the layout stored as tar archive at path into dir.
+func extractOCITar(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open OCI archive: %w", err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read OCI archive '%s': %w", path, err)
+		}
+
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("invalid path '%s' in OCI archive '%s'", hdr.Name, path)
+		}
+
+		target := filepath.Join(dir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := extractOCITarFile(tr, target); err != nil {
+				return fmt.Errorf("failed to extract '%s' from OCI archive: %w", hdr.Name, err)
+			}
+		default:
+			log.WithField("path", hdr.Name).Debug("skipping special file in OCI archive")
+		}
+	}
+}
+
+func extractOCITarFile(r io.Reader, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,74 @@
+package virter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	regv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func TestVirter_ImageExportOCI(t *testing.T) {
+	l, layer := prepareVolumeLayer(t)
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+
+	img1, err := v.MakeImage("image1", layer)
+	assert.NoError(t, err)
+
+	history := []regv1.History{{CreatedBy: "virter image build", Comment: "sha256:1234"}}
+	err = v.SetImageConfig("image1", &regv1.ConfigFile{History: history})
+	assert.NoError(t, err)
+
+	img2, err := v.ImageTag("image1", "image2")
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	err = v.ImageExportOCI(dir, []*virter.LocalImage{img1, img2})
+	assert.NoError(t, err)
+
+	// Both images share layer, config and manifest
+	blobs, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	assert.NoError(t, err)
+	assert.Len(t, blobs, 3)
+
+	archive := filepath.Join(t.TempDir(), "images.tar")
+	err = v.ImageExportOCI(archive, []*virter.LocalImage{img1})
+	assert.NoError(t, err)
+
+	// Exporting to an existing archive adds to it
+	err = v.ImageExportOCI(archive, []*virter.LocalImage{img2})
+	assert.NoError(t, err)
+
+	for _, path := range []string{dir, archive} {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			target := newFakeLibvirtConnection()
+			targetVirter := virter.New(target, poolName, networkName, newMockKeystore())
+			pool, err := target.StoragePoolLookupByName(poolName)
+			assert.NoError(t, err)
+
+			_, err = targetVirter.ImageImportOCI(path, []string{"image3"})
+			assert.Error(t, err)
+
+			imported, err := targetVirter.ImageImportOCI(path, nil)
+			assert.NoError(t, err)
+			assert.Len(t, imported, 2)
+
+			for _, name := range []string{"image1", "image2"} {
+				img, err := targetVirter.FindImage(name, pool)
+				assert.NoError(t, err)
+				if !assert.NotNil(t, img) {
+					continue
+				}
+
+				assert.Equal(t, layer.Name(), img.TopLayer().Name())
+
+				importedHistory, err := img.History()
+				assert.NoError(t, err)
+				assert.Equal(t, history, importedHistory)
+			}
+		})
+	}
+}
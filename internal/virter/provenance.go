@@ -0,0 +1,84 @@
+package virter
+
+import (
+	regv1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Labels in the image configuration recording how an image was built.
+const (
+	LabelBaseRef         = "com.linbit.virter.base.ref"
+	LabelBaseDigest      = "com.linbit.virter.base.digest"
+	LabelProvisionSHA256 = "com.linbit.virter.provision.sha256"
+	LabelVirterVersion   = "com.linbit.virter.version"
+	LabelBuildHost       = "com.linbit.virter.build.host"
+	LabelBuildTime       = "com.linbit.virter.build.time"
+)
+
+// ImageProvenance describes where an image built by virter came from. It is stored as labels in the image
+// configuration, so it is kept when the image is pushed and pulled again.
+type ImageProvenance struct {
+	// BaseRef is the base image as given for the build
+	BaseRef string `json:"base_ref,omitempty"`
+	// BaseDigest is the digest of the layers of the base image, see LocalImage.LayersDigest
+	BaseDigest string `json:"base_digest,omitempty"`
+	// ProvisionSHA256 is the hash of the rendered provisioning configuration, see ProvisionConfig.SHA256
+	ProvisionSHA256 string `json:"provision_sha256,omitempty"`
+	// VirterVersion is the version of virter that built the image
+	VirterVersion string `json:"virter_version,omitempty"`
+	// BuildHost is the host name of the machine that built the image
+	BuildHost string `json:"build_host,omitempty"`
+	// BuildTime is the time the build finished, in RFC 3339 format
+	BuildTime string `json:"build_time,omitempty"`
+}
+
+func (p *ImageProvenance) labels() map[string]string {
+	return map[string]string{
+		LabelBaseRef:         p.BaseRef,
+		LabelBaseDigest:      p.BaseDigest,
+		LabelProvisionSHA256: p.ProvisionSHA256,
+		LabelVirterVersion:   p.VirterVersion,
+		LabelBuildHost:       p.BuildHost,
+		LabelBuildTime:       p.BuildTime,
+	}
+}
+
+// apply stores the provenance in the labels of cfg, replacing the provenance of the base image. Empty fields are
+// left out.
+func (p *ImageProvenance) apply(cfg *regv1.ConfigFile) {
+	for key, value := range p.labels() {
+		delete(cfg.Config.Labels, key)
+
+		if value == "" {
+			continue
+		}
+
+		if cfg.Config.Labels == nil {
+			cfg.Config.Labels = map[string]string{}
+		}
+		cfg.Config.Labels[key] = value
+	}
+}
+
+// ImageProvenanceFromConfig reads the provenance from the labels of an image configuration. Returns nil if the image
+// was not built by virter.
+func ImageProvenanceFromConfig(cfg *regv1.ConfigFile) *ImageProvenance {
+	if cfg == nil {
+		return nil
+	}
+
+	labels := cfg.Config.Labels
+	p := &ImageProvenance{
+		BaseRef:         labels[LabelBaseRef],
+		BaseDigest:      labels[LabelBaseDigest],
+		ProvisionSHA256: labels[LabelProvisionSHA256],
+		VirterVersion:   labels[LabelVirterVersion],
+		BuildHost:       labels[LabelBuildHost],
+		BuildTime:       labels[LabelBuildTime],
+	}
+
+	if *p == (ImageProvenance{}) {
+		return nil
+	}
+
+	return p
+}
@@ -0,0 +1,56 @@
+package virter
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	regv1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestImageProvenance(t *testing.T) {
+	base := &ImageProvenance{
+		BaseRef:         "alma-9",
+		BaseDigest:      "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		ProvisionSHA256: "2222222222222222222222222222222222222222222222222222222222222222",
+		VirterVersion:   "v0.1.0",
+		BuildHost:       "builder-1",
+		BuildTime:       "2026-01-02T03:04:05Z",
+	}
+
+	cfg := &regv1.ConfigFile{}
+	cfg.Config.Labels = map[string]string{"other": "label"}
+	base.apply(cfg)
+
+	// The provenance of a build replaces the one of its base image, empty fields are not inherited
+	derived := &ImageProvenance{
+		BaseRef:       "alma-9-drbd",
+		VirterVersion: "v0.2.0",
+		BuildTime:     "2026-02-03T04:05:06Z",
+	}
+	derived.apply(cfg)
+
+	// The labels have to survive encoding, as done when storing or pushing the configuration
+	encoded, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+
+	decoded := &regv1.ConfigFile{}
+	if err := json.Unmarshal(encoded, decoded); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+
+	actual := ImageProvenanceFromConfig(decoded)
+	if !reflect.DeepEqual(actual, derived) {
+		t.Errorf("expected provenance %+v, got %+v", derived, actual)
+	}
+
+	if decoded.Config.Labels["other"] != "label" {
+		t.Errorf("expected other labels to be kept, got %v", decoded.Config.Labels)
+	}
+
+	if p := ImageProvenanceFromConfig(&regv1.ConfigFile{}); p != nil {
+		t.Errorf("expected no provenance for image without labels, got %+v", p)
+	}
+}
@@ -2,19 +2,36 @@ package virter
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"text/template"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template/parse"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/hashicorp/go-multierror"
 	"github.com/helm/helm/pkg/strvals"
 	"github.com/mitchellh/mapstructure"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 
+	"github.com/LINBIT/virter/pkg/netcopy"
 	"github.com/LINBIT/virter/pkg/pullpolicy"
 )
 
 const CurrentProvisionFileVersion = 1
 
+// DefaultRebootTimeout is the time a VM may take to come back after a reboot step if no timeout was given
+const DefaultRebootTimeout = 5 * time.Minute
+
 // ProvisionContainerStep is a single provisioning step executed in a container
 type ProvisionContainerStep struct {
 	Image   string                      `toml:"image"`
@@ -22,6 +39,17 @@ type ProvisionContainerStep struct {
 	Env     map[string]string           `toml:"env"`
 	Command []string                    `toml:"command"`
 	Copy    *ProvisionContainerCopyStep `toml:"copy"`
+	// Copies lists further files or directories to copy out of the container after it exits
+	Copies []ProvisionContainerCopyStep `toml:"copies,omitempty"`
+	// Mounts lists additional host directories that are bind mounted into the container
+	Mounts []ProvisionContainerMount `toml:"mounts,omitempty"`
+	// User runs the command as this user instead of the user configured in the image
+	User string `toml:"user,omitempty"`
+	// Workdir is the absolute path in the container the command runs in
+	Workdir string `toml:"workdir,omitempty"`
+	// CacheInputs lists the files and directories in the working directory the container reads. If set, only these
+	// and the read-only mounts are part of the build cache key, instead of the whole working directory.
+	CacheInputs []string `toml:"cache_inputs,omitempty"`
 }
 
 type ProvisionContainerCopyStep struct {
@@ -29,16 +57,88 @@ type ProvisionContainerCopyStep struct {
 	Dest   string `toml:"dest"`
 }
 
+// ProvisionContainerMount is a host directory that is bind mounted into the container of a provisioning step
+type ProvisionContainerMount struct {
+	// Source is the host directory, it has to be within the working directory. It is created if it does not exist.
+	Source string `toml:"source"`
+	// Target is the absolute path in the container
+	Target   string `toml:"target"`
+	ReadOnly bool   `toml:"read_only,omitempty"`
+}
+
+// copySteps returns all files to copy out of the container: Copy first, followed by Copies.
+func (s *ProvisionContainerStep) copySteps() []ProvisionContainerCopyStep {
+	var steps []ProvisionContainerCopyStep
+	if s.Copy != nil {
+		steps = append(steps, *s.Copy)
+	}
+	return append(steps, s.Copies...)
+}
+
 // ProvisionShellStep is a single provisioniong step executed in a shell (via ssh)
 type ProvisionShellStep struct {
-	Script string            `toml:"script"`
-	Env    map[string]string `toml:"env"`
+	Script string `toml:"script"`
+	// ScriptFile is read to get the script instead of giving it inline. Relative paths are relative to the provisioning file.
+	ScriptFile string `toml:"script_file,omitempty"`
+	// Verbatim runs the script as it is, instead of executing it as a template
+	Verbatim bool              `toml:"verbatim,omitempty"`
+	Env      map[string]string `toml:"env"`
+	// User runs the script as this user, using sudo or doas
+	User string `toml:"user,omitempty"`
+	// Workdir is the directory on the VM the script runs in
+	Workdir string `toml:"workdir,omitempty"`
+	// Interpreter is the command that gets the script on its standard input, e.g. "python3"
+	Interpreter string `toml:"interpreter,omitempty"`
+	// Capture is the name under which the standard output of the script is available to later steps
+	Capture string `toml:"capture,omitempty"`
 }
 
+// Directions of rsync steps
+const (
+	ProvisionRsyncToVM   = "to_vm"
+	ProvisionRsyncFromVM = "from_vm"
+)
+
 // ProvisionRsyncStep is used to copy files to the target via the rsync utility
 type ProvisionRsyncStep struct {
 	Source string `toml:"source"`
 	Dest   string `toml:"dest"`
+	// Exclude lists patterns of files that are not copied
+	Exclude []string `toml:"exclude,omitempty"`
+	// Delete removes files from the destination that do not exist in the source
+	Delete bool `toml:"delete,omitempty"`
+	// Direction is either "to_vm" (the default) or "from_vm". When copying from the VMs, the files of each VM are
+	// put in a subdirectory of Dest named after the VM.
+	Direction string `toml:"direction,omitempty"`
+}
+
+// fromVM checks if the step copies files from the VMs to the host.
+func (s *ProvisionRsyncStep) fromVM() bool {
+	return s.Direction == ProvisionRsyncFromVM
+}
+
+// copyOptions returns the options for the NetworkCopier.
+func (s *ProvisionRsyncStep) copyOptions() netcopy.CopyOptions {
+	return netcopy.CopyOptions{
+		Exclude: s.Exclude,
+		Delete:  s.Delete,
+	}
+}
+
+// ProvisionRebootStep reboots the target and waits for it to become ready again
+type ProvisionRebootStep struct {
+	Timeout time.Duration `toml:"timeout"`
+}
+
+// ProvisionAnsibleStep runs an Ansible playbook against the target VMs, on the host or in a container
+type ProvisionAnsibleStep struct {
+	// Playbook is the path of the playbook, relative to the working directory
+	Playbook string `toml:"playbook"`
+	// Image is the container image to run ansible-playbook in. If empty, ansible-playbook is run on the host.
+	Image     string                `toml:"image,omitempty"`
+	Pull      pullpolicy.PullPolicy `toml:"pull,omitempty"`
+	Env       map[string]string     `toml:"env,omitempty"`
+	ExtraArgs []string              `toml:"extra_args,omitempty"`
 }
 
 // ProvisionStep is a single provisioning step
@@ -46,26 +146,357 @@ type ProvisionStep struct {
 	Container *ProvisionContainerStep `toml:"container,omitempty"`
 	Shell     *ProvisionShellStep     `toml:"shell,omitempty"`
 	Rsync     *ProvisionRsyncStep     `toml:"rsync,omitempty"`
+	Reboot    *ProvisionRebootStep    `toml:"reboot,omitempty"`
+	Ansible   *ProvisionAnsibleStep   `toml:"ansible,omitempty"`
+
+	// VMIndices and VMNames restrict the step to some of the VMs. VMNames may contain glob patterns.
+	VMIndices []int    `toml:"vm_indices,omitempty"`
+	VMNames   []string `toml:"vm_names,omitempty"`
+	// When is a template that has to evaluate to "true" for the step to run on a VM.
+	When string `toml:"when,omitempty"`
+	// Guard is a command that has to succeed on a VM for the step to run on that VM.
+	Guard string `toml:"guard,omitempty"`
+
+	// Retries is the number of times a failed step is run again on a VM, waiting RetryDelay in between.
+	Retries    int           `toml:"retries,omitempty"`
+	RetryDelay time.Duration `toml:"retry_delay,omitempty"`
+	// Timeout limits each attempt of the step. Zero means no limit.
+	Timeout time.Duration `toml:"timeout,omitempty"`
+	// AllowFailure makes provisioning continue if the step still fails after all retries.
+	AllowFailure bool `toml:"allow_failure,omitempty"`
+	// Checkpoint commits a layer after the step when building an image, so that later builds can resume from it.
+	Checkpoint bool `toml:"checkpoint,omitempty"`
+}
+
+// ProvisionCapture is the output captured by a shell step. Templates can refer to it as .Captures.<name>
+type ProvisionCapture struct {
+	// First is the output from the first VM the step ran on, in the order the VMs were given
+	First string
+	// Self is the output from the VM the template is executed for. It is empty for steps that run once for all VMs.
+	Self string
+	// ByVM contains the output from each VM by VM name
+	ByVM map[string]string
+}
+
+var captureNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ProvisionVM describes a VM targeted by provisioning. Templates can refer to it as .VM and to all VMs as .VMs
+type ProvisionVM struct {
+	// Index is the position of the VM in the list of VMs being provisioned
+	Index int
+	Name  string
+	// ID is the virter ID of the VM, which determines its IP address
+	ID   uint
+	IP   string
+	User string
+}
+
+// typeName returns the name of the step type, as used in provisioning files.
+func (s *ProvisionStep) typeName() string {
+	switch {
+	case s.Container != nil:
+		return "container"
+	case s.Shell != nil:
+		return "shell"
+	case s.Rsync != nil:
+		return "rsync"
+	case s.Reboot != nil:
+		return "reboot"
+	case s.Ansible != nil:
+		return "ansible"
+	}
+	return "unknown"
+}
+
+// matchesVM checks if the VM is selected by the VMIndices and VMNames of the step.
+func (s *ProvisionStep) matchesVM(vm ProvisionVM) bool {
+	if len(s.VMIndices) == 0 && len(s.VMNames) == 0 {
+		return true
+	}
+
+	for _, idx := range s.VMIndices {
+		if idx == vm.Index {
+			return true
+		}
+	}
+
+	for _, pattern := range s.VMNames {
+		if matched, _ := path.Match(pattern, vm.Name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkOptions checks the options shared by all step types.
+func (s *ProvisionStep) checkOptions() error {
+	if s.Retries < 0 {
+		return fmt.Errorf("invalid retries %d", s.Retries)
+	}
+
+	if s.RetryDelay < 0 {
+		return fmt.Errorf("invalid retry_delay %s", s.RetryDelay)
+	}
+
+	if s.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %s", s.Timeout)
+	}
+
+	if s.Rsync != nil && s.Rsync.Direction != "" && s.Rsync.Direction != ProvisionRsyncToVM && s.Rsync.Direction != ProvisionRsyncFromVM {
+		return fmt.Errorf("invalid rsync direction %q: must be %q or %q", s.Rsync.Direction, ProvisionRsyncToVM, ProvisionRsyncFromVM)
+	}
+
+	if s.Shell != nil && s.Shell.Capture != "" && !captureNameRegexp.MatchString(s.Shell.Capture) {
+		return fmt.Errorf("invalid capture name %q: only letters, digits and underscores are allowed", s.Shell.Capture)
+	}
+
+	return s.checkTargeting()
+}
+
+// checkTargeting checks the fields of the step that select the VMs it runs on.
+func (s *ProvisionStep) checkTargeting() error {
+	for _, idx := range s.VMIndices {
+		if idx < 0 {
+			return fmt.Errorf("invalid vm_indices entry %d", idx)
+		}
+	}
+
+	for _, pattern := range s.VMNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid vm_names pattern %q: %w", pattern, err)
+		}
+	}
+
+	if _, err := newProvisionTemplate().Parse(s.When); err != nil {
+		return fmt.Errorf("invalid template for when: %w", err)
+	}
+
+	if _, err := newProvisionTemplate().Parse(s.Guard); err != nil {
+		return fmt.Errorf("invalid template for guard: %w", err)
+	}
+
+	return nil
 }
 
 // ProvisionConfig holds the configuration of the whole provisioning
 type ProvisionConfig struct {
 	Version int               `toml:"version"`
+	Include []string          `toml:"include,omitempty"`
 	Values  map[string]string `toml:"values"`
-	Env     map[string]string `toml:"env"`
-	Steps   []ProvisionStep   `toml:"steps"`
+	// Secrets are like Values, but read from files, the environment or commands and redacted from all log output
+	Secrets map[string]ProvisionSecret `toml:"secrets,omitempty"`
+	Env     map[string]string          `toml:"env"`
+	Steps   []ProvisionStep            `toml:"steps"`
+
+	// secretValues are the resolved values of the Secrets
+	secretValues map[string]string
+}
+
+// templateData returns the data for templates that are executed without runtime data: the values and the secrets
+// as .Secrets.
+func (p *ProvisionConfig) templateData() map[string]interface{} {
+	data := make(map[string]interface{}, len(p.Values)+1)
+	for k, v := range p.Values {
+		data[k] = v
+	}
+
+	secrets := p.secretValues
+	if secrets == nil {
+		secrets = map[string]string{}
+	}
+	data["Secrets"] = secrets
+
+	return data
 }
 
 // NeedsContainers checks if there is a provision step that requires a container provider (like Docker or Podman)
 func (p *ProvisionConfig) NeedsContainers() bool {
 	for _, s := range p.Steps {
-		if s.Container != nil {
+		if s.Container != nil || (s.Ansible != nil && s.Ansible.Image != "") {
 			return true
 		}
 	}
 	return false
 }
 
+// RegistryContainerImages returns the container images used by the provisioning that are pulled from a registry,
+// i.e. all images except those with the pull policy Never. Each image is only returned once.
+func (p *ProvisionConfig) RegistryContainerImages() []string {
+	var images []string
+	seen := map[string]bool{}
+	add := func(image string, pull pullpolicy.PullPolicy) {
+		if image == "" || pull == pullpolicy.Never || seen[image] {
+			return
+		}
+		seen[image] = true
+		images = append(images, image)
+	}
+
+	for _, s := range p.Steps {
+		if s.Container != nil {
+			add(s.Container.Image, s.Container.Pull)
+		}
+		if s.Ansible != nil {
+			add(s.Ansible.Image, s.Ansible.Pull)
+		}
+	}
+
+	return images
+}
+
+// EncodeTOML writes the provisioning configuration in TOML format. The values of secrets are replaced, as the output
+// is meant to be shown to the user.
+func (p *ProvisionConfig) EncodeTOML(w io.Writer) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(p); err != nil {
+		return err
+	}
+
+	redactor, err := p.secretRedactor(func(value string) (string, error) {
+		var escaped bytes.Buffer
+		if err := toml.NewEncoder(&escaped).Encode(map[string]string{"v": value}); err != nil {
+			return "", err
+		}
+		return strings.Trim(strings.TrimPrefix(strings.TrimSpace(escaped.String()), "v = "), `"`), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, redactor.redact(buf.String()))
+	return err
+}
+
+// validationVM is used to check templates that refer to .VM before the target VMs are known
+var validationVM = ProvisionVM{Index: 0, Name: "vm-0", ID: 1, IP: "192.0.2.1", User: "root"}
+
+// Validate checks the parts of the ProvisionConfig that are otherwise only checked when the steps run:
+// templates that refer to runtime data, host paths and container image references.
+// Captured output is replaced by placeholders, so only references to captures of earlier steps are valid.
+// All problems found are returned together.
+func (p *ProvisionConfig) Validate() error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	var errs error
+	addErr := func(i int, format string, a ...interface{}) {
+		errs = multierror.Append(errs, fmt.Errorf("step %d: %s", i, fmt.Sprintf(format, a...)))
+	}
+
+	captures := map[string]ProvisionCapture{}
+	for i, s := range p.Steps {
+		vms := []ProvisionVM{validationVM}
+		vmData := runtimeTemplateData(p.templateData(), vms, &validationVM, captures)
+
+		if s.When != "" {
+			if _, err := evaluateCondition(s.When, vmData); err != nil {
+				addErr(i, "invalid when condition: %v", err)
+			}
+		}
+
+		if s.Guard != "" {
+			if _, err := executeTemplate(s.Guard, vmData); err != nil {
+				addErr(i, "failed to execute template for guard: %v", err)
+			}
+		}
+
+		if s.Container != nil {
+			if _, err := name.ParseReference(s.Container.Image); err != nil {
+				addErr(i, "invalid container image %q: %v", s.Container.Image, err)
+			}
+
+			if _, err := executeRuntimeTemplateArray(s.Container.Command, runtimeTemplateData(p.templateData(), vms, nil, captures)); err != nil {
+				addErr(i, "failed to execute template for container.command: %v", err)
+			}
+
+			for _, copyStep := range s.Container.copySteps() {
+				if err := checkPathInWorkDir(copyStep.Dest, wd); err != nil {
+					addErr(i, "container copy destination not allowed: %v", err)
+				}
+			}
+
+			for _, mount := range s.Container.Mounts {
+				if err := checkPathInWorkDir(mount.Source, wd); err != nil {
+					addErr(i, "container mount source not allowed: %v", err)
+				}
+			}
+
+			for _, input := range s.Container.CacheInputs {
+				if err := checkPathInWorkDir(input, wd); err != nil {
+					addErr(i, "container cache input not allowed: %v", err)
+				}
+			}
+		} else if s.Shell != nil {
+			if !s.Shell.Verbatim {
+				if _, err := executeTemplate(s.Shell.Script, vmData); err != nil {
+					addErr(i, "failed to execute template for shell.script: %v", err)
+				}
+			}
+
+			if _, err := executeRuntimeTemplateMap(s.Shell.Env, vmData); err != nil {
+				addErr(i, "failed to execute template for shell.env: %v", err)
+			}
+
+			if _, err := executeTemplate(s.Shell.User, vmData); err != nil {
+				addErr(i, "failed to execute template for shell.user: %v", err)
+			}
+
+			if _, err := executeTemplate(s.Shell.Workdir, vmData); err != nil {
+				addErr(i, "failed to execute template for shell.workdir: %v", err)
+			}
+
+			if s.Shell.Capture != "" {
+				placeholder := "captured-" + s.Shell.Capture
+				captures[s.Shell.Capture] = ProvisionCapture{
+					First: placeholder,
+					Self:  placeholder,
+					ByVM:  map[string]string{validationVM.Name: placeholder},
+				}
+			}
+		} else if s.Rsync != nil {
+			source, err := executeRuntimeTemplate(s.Rsync.Source, vmData)
+			if err != nil {
+				addErr(i, "failed to execute template for rsync.source: %v", err)
+			} else if s.Rsync.fromVM() {
+				if err := checkPathInWorkDir(s.Rsync.Dest, wd); err != nil {
+					addErr(i, "rsync destination not allowed: %v", err)
+				}
+			} else if _, err := resolveRsyncSource(source, wd); err != nil {
+				addErr(i, "%v", err)
+			}
+		} else if s.Ansible != nil {
+			if s.Ansible.Image != "" {
+				if _, err := name.ParseReference(s.Ansible.Image); err != nil {
+					addErr(i, "invalid container image %q: %v", s.Ansible.Image, err)
+				}
+
+				if err := checkPathInWorkDir(s.Ansible.Playbook, wd); err != nil {
+					addErr(i, "ansible playbook not available in container: %v", err)
+				}
+			}
+
+			if _, err := os.Stat(s.Ansible.Playbook); err != nil {
+				addErr(i, "ansible playbook not found: %v", err)
+			}
+
+			if _, err := executeRuntimeTemplateArray(s.Ansible.ExtraArgs, runtimeTemplateData(p.templateData(), vms, nil, captures)); err != nil {
+				addErr(i, "failed to execute template for ansible.extra_args: %v", err)
+			}
+		} else if s.Reboot == nil {
+			addErr(i, "no provisioning type given")
+		}
+
+		if s.Checkpoint && len(captures) > 0 {
+			addErr(i, "checkpoints are not possible after a step that captures output")
+		}
+	}
+
+	return errs
+}
+
 // mergeEnv takes two pointers to env Maps and merges them, lower keys overriding upper ones
 func mergeEnv(upper, lower *map[string]string) map[string]string {
 	envMap := make(map[string]string)
@@ -96,6 +527,51 @@ type ProvisionOption struct {
 	Overrides          []string
 	DefaultPullPolicy  pullpolicy.PullPolicy
 	OverridePullPolicy pullpolicy.PullPolicy
+	// Format is the format of the given provisioning files. If empty, it is detected from the file extension.
+	Format ProvisionFormat
+}
+
+// ProvisionFormat is the file format of a provisioning file
+type ProvisionFormat string
+
+const (
+	ProvisionFormatTOML ProvisionFormat = "toml"
+	ProvisionFormatYAML ProvisionFormat = "yaml"
+	ProvisionFormatJSON ProvisionFormat = "json"
+)
+
+func (f *ProvisionFormat) UnmarshalText(text []byte) error {
+	return f.Set(string(text))
+}
+
+func (f *ProvisionFormat) String() string {
+	return string(*f)
+}
+
+func (f *ProvisionFormat) Set(s string) error {
+	switch ProvisionFormat(strings.ToLower(s)) {
+	case ProvisionFormatTOML, ProvisionFormatYAML, ProvisionFormatJSON:
+		*f = ProvisionFormat(strings.ToLower(s))
+		return nil
+	default:
+		return fmt.Errorf("unknown provisioning file format. [%s, %s, %s]", ProvisionFormatTOML, ProvisionFormatYAML, ProvisionFormatJSON)
+	}
+}
+
+func (f *ProvisionFormat) Type() string {
+	return "provisionFormat"
+}
+
+// provisionFormatFromPath detects the format of a provisioning file from its extension. TOML is the default.
+func provisionFormatFromPath(p string) ProvisionFormat {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".yaml", ".yml":
+		return ProvisionFormatYAML
+	case ".json":
+		return ProvisionFormatJSON
+	default:
+		return ProvisionFormatTOML
+	}
 }
 
 // NewProvisionConfig returns a ProvisionConfig from a ProvisionOption
@@ -103,29 +579,195 @@ func NewProvisionConfig(reader io.ReadCloser, provOpt ProvisionOption) (Provisio
 	return newProvisionConfigReader(reader, provOpt)
 }
 
+// NewProvisionConfigFiles returns a ProvisionConfig from a list of provisioning files, which are concatenated in order
+func NewProvisionConfigFiles(paths []string, provOpt ProvisionOption) (ProvisionConfig, error) {
+	loader := newProvisionLoader()
+	for _, p := range paths {
+		format := provOpt.Format
+		if format == "" {
+			format = provisionFormatFromPath(p)
+		}
+
+		if err := loader.loadFile(p, format); err != nil {
+			return ProvisionConfig{}, err
+		}
+	}
+
+	return finishProvisionConfig(loader.result, provOpt)
+}
+
 // newProvisionConfigReader returns a ProvisionConfig and does some necesary checks and for example merges the global env to the individual steps.
 func newProvisionConfigReader(provReader io.ReadCloser, provOpt ProvisionOption) (ProvisionConfig, error) {
-	var pc ProvisionConfig
+	loader := newProvisionLoader()
 
 	if provReader != nil {
 		defer provReader.Close()
 
-		decoder := toml.NewDecoder(provReader)
+		format := provOpt.Format
+		if format == "" {
+			format = ProvisionFormatTOML
+		}
+
+		// Without a file name, includes are resolved relative to the working directory
+		if err := loader.loadReader(provReader, "<input>", ".", format); err != nil {
+			return ProvisionConfig{}, err
+		}
+	}
+
+	return finishProvisionConfig(loader.result, provOpt)
+}
+
+// provisionLoader reads provisioning files and their includes and merges them into a single ProvisionConfig.
+//
+// Files are merged in the order they are read, with included files being read before the file including them.
+// Steps are concatenated, values and env of later files override those of earlier files.
+// Every file is read at most once, including a file again has no effect. Include cycles are an error.
+type provisionLoader struct {
+	result ProvisionConfig
+	loaded map[string]bool
+	stack  []string
+}
+
+func newProvisionLoader() *provisionLoader {
+	return &provisionLoader{
+		result: ProvisionConfig{
+			Values:  map[string]string{},
+			Secrets: map[string]ProvisionSecret{},
+			Env:     map[string]string{},
+		},
+		loaded: map[string]bool{},
+	}
+}
+
+func (l *provisionLoader) loadFile(p string, format ProvisionFormat) error {
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+
+	for _, open := range l.stack {
+		if open == absPath {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(l.stack, absPath), " -> "))
+		}
+	}
+
+	if l.loaded[absPath] {
+		log.Debugf("provisioning file %s already included, skipping", absPath)
+		return nil
+	}
+
+	f, err := os.Open(absPath)
+	if err != nil {
+		return fmt.Errorf("failed to open provisioning file: %w", err)
+	}
+	defer f.Close()
+
+	l.loaded[absPath] = true
+	l.stack = append(l.stack, absPath)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	return l.loadReader(f, absPath, filepath.Dir(absPath), format)
+}
+
+func (l *provisionLoader) loadReader(reader io.Reader, name, dir string, format ProvisionFormat) error {
+	pc, err := decodeProvisionFile(reader, format)
+	if err != nil {
+		return fmt.Errorf("failed to parse provisioning file %s: %w", name, err)
+	}
+
+	// Included files may leave out the version, everything else is checked once all files are merged
+	if pc.Version != 0 && pc.Version != CurrentProvisionFileVersion {
+		return fmt.Errorf("unsupported provision file version %d in %s (want %d)", pc.Version, name, CurrentProvisionFileVersion)
+	}
+
+	for _, include := range pc.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+
+		if err := l.loadFile(include, provisionFormatFromPath(include)); err != nil {
+			return fmt.Errorf("failed to include %s from %s: %w", include, name, err)
+		}
+	}
+
+	if pc.Version != 0 {
+		l.result.Version = pc.Version
+	}
+	for k, v := range pc.Values {
+		l.result.Values[k] = v
+	}
+	for k, v := range pc.Secrets {
+		if v.File != "" && !filepath.IsAbs(v.File) {
+			v.File = filepath.Join(dir, v.File)
+		}
+		l.result.Secrets[k] = v
+	}
+	for k, v := range pc.Env {
+		l.result.Env[k] = v
+	}
+	for _, s := range pc.Steps {
+		if s.Shell != nil && s.Shell.ScriptFile != "" && !filepath.IsAbs(s.Shell.ScriptFile) {
+			s.Shell.ScriptFile = filepath.Join(dir, s.Shell.ScriptFile)
+		}
+	}
+	l.result.Steps = append(l.result.Steps, pc.Steps...)
+
+	return nil
+}
+
+// decodeProvisionFile decodes a single provisioning file. Unknown keys are an error in all formats.
+func decodeProvisionFile(reader io.Reader, format ProvisionFormat) (ProvisionConfig, error) {
+	var pc ProvisionConfig
+	m := map[string]interface{}{}
+
+	switch format {
+	case ProvisionFormatTOML:
+		decoder := toml.NewDecoder(reader)
 		md, err := decoder.Decode(&pc)
 		if err != nil {
 			return pc, err
 		}
 
 		if undecoded := md.Undecoded(); len(undecoded) > 0 {
-			return pc, fmt.Errorf("unknown keys in provisioning file: %v", undecoded)
+			return pc, fmt.Errorf("unknown keys: %v", undecoded)
+		}
+
+		return pc, nil
+	case ProvisionFormatYAML:
+		err := yaml.NewDecoder(reader).Decode(&m)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return pc, err
+		}
+	case ProvisionFormatJSON:
+		err := json.NewDecoder(reader).Decode(&m)
+		if err != nil {
+			return pc, err
 		}
+	default:
+		return pc, fmt.Errorf("unknown provisioning file format %q", format)
+	}
+
+	// YAML and JSON are decoded via a generic map, so that the same key names as for TOML apply
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:  mapstructure.StringToTimeDurationHookFunc(),
+		TagName:     "toml",
+		ErrorUnused: true,
+		Result:      &pc,
+	})
+	if err != nil {
+		return pc, err
 	}
 
+	return pc, decoder.Decode(m)
+}
+
+// finishProvisionConfig applies the options to the merged ProvisionConfig, checks it and for example merges the global env to the individual steps.
+func finishProvisionConfig(pc ProvisionConfig, provOpt ProvisionOption) (ProvisionConfig, error) {
 	m, err := genValueMap(provOpt)
 	if err != nil {
 		return pc, err
 	}
-	if err := mapstructure.Decode(m, &pc); err != nil {
+	if err := decodeValueMap(m, &pc); err != nil {
 		return pc, err
 	}
 
@@ -133,28 +775,79 @@ func newProvisionConfigReader(provReader io.ReadCloser, provOpt ProvisionOption)
 		return pc, fmt.Errorf("unsupported provision file version %d (want %d)", pc.Version, CurrentProvisionFileVersion)
 	}
 
+	pc.secretValues, err = resolveSecrets(pc.Secrets)
+	if err != nil {
+		return pc, err
+	}
+	data := pc.templateData()
+
 	for i, s := range pc.Steps {
+		if err := s.checkOptions(); err != nil {
+			return pc, fmt.Errorf("step %d: %w", i, err)
+		}
+
 		if s.Container != nil {
 			s.Container.Env = mergeEnv(&pc.Env, &s.Container.Env)
 
-			if s.Container.Image, err = executeTemplate(s.Container.Image, pc.Values); err != nil {
+			if s.Container.Image, err = executeTemplate(s.Container.Image, data); err != nil {
 				return pc, fmt.Errorf("failed to execute template for container.image for step %d: %w", i, err)
 			}
 
-			if err := executeTemplateMap(s.Container.Env, pc.Values); err != nil {
+			if err := executeTemplateMap(s.Container.Env, data); err != nil {
 				return pc, fmt.Errorf("failed to execute template for container.env for step %d: %w", i, err)
 			}
 
-			if err := executeTemplateArray(s.Container.Command, pc.Values); err != nil {
+			// Templates referring to runtime data are executed once the step runs.
+			if err := executeStaticTemplateArray(s.Container.Command, data); err != nil {
 				return pc, fmt.Errorf("failed to execute tempalte for container.command for step %d: %w", i, err)
 			}
 
 			if copyStep := s.Container.Copy; copyStep != nil {
-				if copyStep.Dest, err = executeTemplate(copyStep.Dest, pc.Values); err != nil {
+				if copyStep.Dest, err = executeTemplate(copyStep.Dest, data); err != nil {
 					return pc, fmt.Errorf("failed to execute template for container.copy.dest for step %d: %w", i, err)
 				}
 			}
 
+			for j := range s.Container.Copies {
+				copyStep := &s.Container.Copies[j]
+				if copyStep.Dest, err = executeTemplate(copyStep.Dest, data); err != nil {
+					return pc, fmt.Errorf("failed to execute template for container.copies.dest for step %d: %w", i, err)
+				}
+			}
+
+			for j := range s.Container.Mounts {
+				mount := &s.Container.Mounts[j]
+				if mount.Source, err = executeTemplate(mount.Source, data); err != nil {
+					return pc, fmt.Errorf("failed to execute template for container.mounts.source for step %d: %w", i, err)
+				}
+
+				if mount.Source == "" || !path.IsAbs(mount.Target) {
+					return pc, fmt.Errorf("step %d: container mounts need a source and an absolute target", i)
+				}
+			}
+
+			for j := range s.Container.CacheInputs {
+				if s.Container.CacheInputs[j], err = executeTemplate(s.Container.CacheInputs[j], data); err != nil {
+					return pc, fmt.Errorf("failed to execute template for container.cache_inputs for step %d: %w", i, err)
+				}
+			}
+
+			if s.Container.User, err = executeTemplate(s.Container.User, data); err != nil {
+				return pc, fmt.Errorf("failed to execute template for container.user for step %d: %w", i, err)
+			}
+
+			if s.Container.Workdir, err = executeTemplate(s.Container.Workdir, data); err != nil {
+				return pc, fmt.Errorf("failed to execute template for container.workdir for step %d: %w", i, err)
+			}
+
+			if s.Container.Workdir != "" && !path.IsAbs(s.Container.Workdir) {
+				return pc, fmt.Errorf("step %d: container.workdir must be an absolute path", i)
+			}
+
+			if (s.Container.User != "" || s.Container.Workdir != "") && len(s.Container.Command) == 0 {
+				return pc, fmt.Errorf("step %d: container.user and container.workdir need a command", i)
+			}
+
 			if s.Container.Pull == "" {
 				s.Container.Pull = provOpt.DefaultPullPolicy
 			}
@@ -163,14 +856,65 @@ func newProvisionConfigReader(provReader io.ReadCloser, provOpt ProvisionOption)
 				s.Container.Pull = provOpt.OverridePullPolicy
 			}
 		} else if s.Shell != nil {
+			if s.Shell.ScriptFile != "" {
+				if s.Shell.Script != "" {
+					return pc, fmt.Errorf("step %d: shell.script and shell.script_file are mutually exclusive", i)
+				}
+
+				if s.Shell.Script, err = readScriptFile(s.Shell.ScriptFile); err != nil {
+					return pc, fmt.Errorf("step %d: %w", i, err)
+				}
+				// The merged config contains the script itself
+				s.Shell.ScriptFile = ""
+			}
+
 			s.Shell.Env = mergeEnv(&pc.Env, &s.Shell.Env)
 
-			if err := executeTemplateMap(s.Shell.Env, pc.Values); err != nil {
+			// Templates referring to runtime data are executed once the step runs.
+			if err := executeStaticTemplateMap(s.Shell.Env, data); err != nil {
 				return pc, fmt.Errorf("failed to execute template for shell.env for step %d: %w", i, err)
 			}
 		} else if s.Rsync != nil {
-			if s.Rsync.Source, err = executeTemplate(s.Rsync.Source, pc.Values); err != nil {
-				return pc, fmt.Errorf("failed to execute template for rsync.source for step %d: %w", i, err)
+			if !templateUsesRuntimeData(s.Rsync.Source) {
+				if s.Rsync.Source, err = executeTemplate(s.Rsync.Source, data); err != nil {
+					return pc, fmt.Errorf("failed to execute template for rsync.source for step %d: %w", i, err)
+				}
+			}
+		} else if s.Reboot != nil {
+			if s.Reboot.Timeout == 0 {
+				s.Reboot.Timeout = DefaultRebootTimeout
+			}
+		} else if s.Ansible != nil {
+			if s.Ansible.Playbook, err = executeTemplate(s.Ansible.Playbook, data); err != nil {
+				return pc, fmt.Errorf("failed to execute template for ansible.playbook for step %d: %w", i, err)
+			}
+
+			if s.Ansible.Playbook == "" {
+				return pc, fmt.Errorf("step %d: ansible.playbook is required", i)
+			}
+
+			if s.Ansible.Image, err = executeTemplate(s.Ansible.Image, data); err != nil {
+				return pc, fmt.Errorf("failed to execute template for ansible.image for step %d: %w", i, err)
+			}
+
+			s.Ansible.Env = mergeEnv(&pc.Env, &s.Ansible.Env)
+			if err := executeTemplateMap(s.Ansible.Env, data); err != nil {
+				return pc, fmt.Errorf("failed to execute template for ansible.env for step %d: %w", i, err)
+			}
+
+			// Templates referring to runtime data are executed once the step runs.
+			if err := executeStaticTemplateArray(s.Ansible.ExtraArgs, data); err != nil {
+				return pc, fmt.Errorf("failed to execute template for ansible.extra_args for step %d: %w", i, err)
+			}
+
+			if s.Ansible.Image != "" {
+				if s.Ansible.Pull == "" {
+					s.Ansible.Pull = provOpt.DefaultPullPolicy
+				}
+
+				if provOpt.OverridePullPolicy != "" {
+					s.Ansible.Pull = provOpt.OverridePullPolicy
+				}
 			}
 		}
 	}
@@ -190,8 +934,30 @@ func genValueMap(provOpt ProvisionOption) (map[string]interface{}, error) {
 	return base, nil
 }
 
-func executeTemplateMap(templates map[string]string, templateData map[string]string) error {
+// decodeValueMap decodes the values set on the command line into the ProvisionConfig.
+//
+// The keys are matched against the same names as used in the provisioning file.
+func decodeValueMap(m map[string]interface{}, pc *ProvisionConfig) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		TagName:          "toml",
+		WeaklyTypedInput: true,
+		Result:           pc,
+	})
+	if err != nil {
+		return err
+	}
+
+	return decoder.Decode(m)
+}
+
+// executeStaticTemplateMap executes the templates in the map that do not refer to runtime data
+func executeStaticTemplateMap(templates map[string]string, templateData interface{}) error {
 	for k, v := range templates {
+		if templateUsesRuntimeData(v) {
+			continue
+		}
+
 		result, err := executeTemplate(v, templateData)
 		if err != nil {
 			return err
@@ -201,8 +967,13 @@ func executeTemplateMap(templates map[string]string, templateData map[string]str
 	return nil
 }
 
-func executeTemplateArray(templates []string, templateData map[string]string) error {
+// executeStaticTemplateArray executes the templates in the array that do not refer to runtime data
+func executeStaticTemplateArray(templates []string, templateData interface{}) error {
 	for i, t := range templates {
+		if templateUsesRuntimeData(t) {
+			continue
+		}
+
 		result, err := executeTemplate(t, templateData)
 		if err != nil {
 			return err
@@ -212,8 +983,178 @@ func executeTemplateArray(templates []string, templateData map[string]string) er
 	return nil
 }
 
-func executeTemplate(templateText string, templateData map[string]string) (string, error) {
-	tmpl, err := template.New("").Option("missingkey=error").Parse(templateText)
+// executeRuntimeTemplate executes the template if it refers to runtime data, otherwise it is returned unchanged
+func executeRuntimeTemplate(templateText string, templateData interface{}) (string, error) {
+	if !templateUsesRuntimeData(templateText) {
+		return templateText, nil
+	}
+
+	return executeTemplate(templateText, templateData)
+}
+
+// executeRuntimeTemplateMap returns a copy of the map where all templates referring to runtime data are executed
+func executeRuntimeTemplateMap(templates map[string]string, templateData interface{}) (map[string]string, error) {
+	result := make(map[string]string, len(templates))
+	for k, v := range templates {
+		executed, err := executeRuntimeTemplate(v, templateData)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = executed
+	}
+	return result, nil
+}
+
+// executeRuntimeTemplateArray returns a copy of the array where all templates referring to runtime data are executed
+func executeRuntimeTemplateArray(templates []string, templateData interface{}) ([]string, error) {
+	if templates == nil {
+		return nil, nil
+	}
+
+	result := make([]string, len(templates))
+	for i, t := range templates {
+		executed, err := executeRuntimeTemplate(t, templateData)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = executed
+	}
+	return result, nil
+}
+
+// runtimeTemplateData returns the data for templates executed while provisioning runs: the static template data,
+// all VMs being provisioned as .VMs, the VM the template is executed for as .VM and the output captured by previous
+// steps as .Captures. The VM is nil for steps that run once for all VMs.
+func runtimeTemplateData(static map[string]interface{}, vms []ProvisionVM, vm *ProvisionVM, captures map[string]ProvisionCapture) map[string]interface{} {
+	data := make(map[string]interface{}, len(static)+3)
+	for k, v := range static {
+		data[k] = v
+	}
+	if vms == nil {
+		vms = []ProvisionVM{}
+	}
+	data["VMs"] = vms
+	if vm != nil {
+		data["VM"] = *vm
+	}
+	if captures == nil {
+		captures = map[string]ProvisionCapture{}
+	}
+	data["Captures"] = captures
+	return data
+}
+
+// evaluateCondition executes a template and interprets the result as boolean. An empty result counts as false.
+func evaluateCondition(condition string, templateData interface{}) (bool, error) {
+	result, err := executeTemplate(condition, templateData)
+	if err != nil {
+		return false, err
+	}
+
+	result = strings.TrimSpace(result)
+	if result == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(result)
+}
+
+// templateUsesRuntimeData checks if a template refers to .VM, .VMs or .Captures, i.e. it can only be executed while
+// provisioning runs.
+func templateUsesRuntimeData(templateText string) bool {
+	tmpl, err := newProvisionTemplate().Parse(templateText)
+	if err != nil {
+		// Report the error when actually executing the template
+		return false
+	}
+
+	return nodeUsesField(tmpl.Root, "VM") || nodeUsesField(tmpl.Root, "VMs") || nodeUsesField(tmpl.Root, "Captures")
+}
+
+// nodeUsesField checks if a template node or one of its children accesses the given top level field.
+func nodeUsesField(node parse.Node, field string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if nodeUsesField(child, field) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesField(n.Pipe, field)
+	case *parse.TemplateNode:
+		return nodeUsesField(n.Pipe, field)
+	case *parse.IfNode:
+		return branchUsesField(&n.BranchNode, field)
+	case *parse.RangeNode:
+		return branchUsesField(&n.BranchNode, field)
+	case *parse.WithNode:
+		return branchUsesField(&n.BranchNode, field)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeUsesField(cmd, field) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUsesField(arg, field) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return nodeUsesField(n.Node, field)
+	case *parse.FieldNode:
+		return n.Ident[0] == field
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == field
+	}
+
+	return false
+}
+
+func branchUsesField(n *parse.BranchNode, field string) bool {
+	return nodeUsesField(n.Pipe, field) || nodeUsesField(n.List, field) || nodeUsesField(n.ElseList, field)
+}
+
+func executeTemplateMap(templates map[string]string, templateData interface{}) error {
+	for k, v := range templates {
+		result, err := executeTemplate(v, templateData)
+		if err != nil {
+			return err
+		}
+		templates[k] = result
+	}
+	return nil
+}
+
+// readScriptFile reads a script for a shell step. Like other host paths, it has to be in the working directory.
+func readScriptFile(path string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	if err := checkPathInWorkDir(path, wd); err != nil {
+		return "", fmt.Errorf("shell.script_file not allowed: %w", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read shell.script_file: %w", err)
+	}
+
+	return string(content), nil
+}
+
+func executeTemplate(templateText string, templateData interface{}) (string, error) {
+	tmpl, err := newProvisionTemplate().Option("missingkey=error").Parse(templateText)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,578 @@
+package virter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LINBIT/containerapi"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/LINBIT/virter/pkg/netcopy"
+)
+
+// ProvisionTools includes the dependencies for running provisioning steps
+type ProvisionTools struct {
+	ShellClientBuilder ShellClientBuilder
+	ContainerProvider  containerapi.ContainerProvider
+	NetworkCopier      netcopy.NetworkCopier
+}
+
+// ProvisionExecConfig contains the configuration for running provisioning steps
+type ProvisionExecConfig struct {
+	// ContainerName is the name used for container steps. If empty, a name is derived from the target VMs.
+	ContainerName string
+	ReadyConfig   VmReadyConfig
+	// LogDir is the directory to write one log file per VM and step to. If empty, no log files are written.
+	LogDir string
+	// Report collects the results of all steps. May be nil.
+	Report *ProvisionReport
+	// StepOffset is added to the index of every step in logs and reports. Used when only the later steps of a
+	// provisioning configuration run.
+	StepOffset int
+}
+
+// provisionRun holds the state of a single provisioning run
+type provisionRun struct {
+	values map[string]string
+	// staticData is the template data that does not change while provisioning runs
+	staticData map[string]interface{}
+	vms        []ProvisionVM
+
+	capturesMutex sync.Mutex
+	// captures maps capture names to the output captured on each VM
+	captures map[string]map[string]string
+}
+
+// capture stores the output of a shell step on a VM.
+func (r *provisionRun) capture(name, vmName, output string) {
+	r.capturesMutex.Lock()
+	defer r.capturesMutex.Unlock()
+
+	if r.captures[name] == nil {
+		r.captures[name] = map[string]string{}
+	}
+	r.captures[name][vmName] = strings.TrimSpace(output)
+}
+
+// templateData returns the data for templates executed for the given VM, or for all VMs if vm is nil.
+func (r *provisionRun) templateData(vm *ProvisionVM) map[string]interface{} {
+	r.capturesMutex.Lock()
+	defer r.capturesMutex.Unlock()
+
+	captures := make(map[string]ProvisionCapture, len(r.captures))
+	for name, byVM := range r.captures {
+		c := ProvisionCapture{ByVM: make(map[string]string, len(byVM))}
+		for vmName, output := range byVM {
+			c.ByVM[vmName] = output
+		}
+
+		for _, runVM := range r.vms {
+			if output, ok := byVM[runVM.Name]; ok {
+				c.First = output
+				break
+			}
+		}
+
+		if vm != nil {
+			c.Self = byVM[vm.Name]
+		}
+
+		captures[name] = c
+	}
+
+	return runtimeTemplateData(r.staticData, r.vms, vm, captures)
+}
+
+// VMExecProvision runs all steps of a provisioning configuration against some VMs.
+// Each step only runs on the VMs selected by its vm_indices, vm_names, when and guard settings.
+func (v *Virter) VMExecProvision(ctx context.Context, tools ProvisionTools, vmNames []string, pc ProvisionConfig, execConfig ProvisionExecConfig) error {
+	ips, err := v.getIPs(vmNames)
+	if err != nil {
+		return err
+	}
+
+	run := &provisionRun{
+		values:     pc.Values,
+		staticData: pc.templateData(),
+		vms:        make([]ProvisionVM, len(vmNames)),
+		captures:   map[string]map[string]string{},
+	}
+	for i, vmName := range vmNames {
+		info, err := v.VMInfo(vmName)
+		if err != nil {
+			return fmt.Errorf("failed to get information about VM %s: %w", vmName, err)
+		}
+
+		run.vms[i] = ProvisionVM{Index: i, Name: vmName, ID: info.ID, IP: ips[i], User: v.getSSHUserName(vmName)}
+	}
+
+	for j, s := range pc.Steps {
+		i := execConfig.StepOffset + j
+		targets, err := v.stepTargets(ctx, s, run)
+		if err != nil {
+			return fmt.Errorf("failed to determine target VMs for step %d: %w", i, err)
+		}
+
+		recordSkippedVMs(execConfig.Report, s, i, run.vms, targets)
+
+		if len(targets) == 0 {
+			log.Infof("Skipping provisioning step %d: no matching VMs", i)
+			continue
+		}
+
+		targetNames := make([]string, len(targets))
+		for j, vm := range targets {
+			targetNames[j] = vm.Name
+		}
+
+		if s.Container != nil || s.Ansible != nil {
+			err = v.execProvisionGroupStep(ctx, tools, s, i, targetNames, execConfig, run)
+		} else {
+			var g errgroup.Group
+			for _, vm := range targets {
+				vm := vm
+				g.Go(func() error {
+					stepLog, err := openStepLog(execConfig.LogDir, i, s.typeName(), []string{vm.Name})
+					if err != nil {
+						return err
+					}
+					defer stepLog.Close()
+
+					start := time.Now()
+					attempts, err := runStepAttempts(ctx, s, i, vm.Name, stepLog.writer(), func(ctx context.Context) error {
+						return v.execProvisionStepOnVM(ctx, tools, s, vm, execConfig, run, stepLog.writer())
+					})
+					return finishStep(execConfig.Report, s, i, []string{vm.Name}, start, attempts, err)
+				})
+			}
+			err = g.Wait()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// execProvisionGroupStep runs a container or ansible step. These run once for all target VMs, so they are also
+// retried for all of them.
+func (v *Virter) execProvisionGroupStep(ctx context.Context, tools ProvisionTools, s ProvisionStep, stepIndex int, targetNames []string, execConfig ProvisionExecConfig, run *provisionRun) error {
+	stepLog, err := openStepLog(execConfig.LogDir, stepIndex, s.typeName(), targetNames)
+	if err != nil {
+		return err
+	}
+	defer stepLog.Close()
+
+	start := time.Now()
+	attempts, err := runStepAttempts(ctx, s, stepIndex, strings.Join(targetNames, ","), stepLog.writer(), func(ctx context.Context) error {
+		if s.Ansible != nil {
+			return v.execProvisionAnsible(ctx, tools.ContainerProvider, targetNames, s.Ansible, execConfig.ContainerName, run, stepLog.writer())
+		}
+		return v.execProvisionContainer(ctx, tools.ContainerProvider, targetNames, s.Container, execConfig.ContainerName, run, stepLog.writer())
+	})
+	return finishStep(execConfig.Report, s, stepIndex, targetNames, start, attempts, err)
+}
+
+// finishStep records the result of a step on its target VMs.
+// It returns the error that should abort provisioning, which is nil if the step is allowed to fail.
+func finishStep(report *ProvisionReport, s ProvisionStep, stepIndex int, vmNames []string, start time.Time, attempts int, err error) error {
+	status := ProvisionStepPassed
+	errMessage := ""
+	if err != nil {
+		status = ProvisionStepFailed
+		if s.AllowFailure {
+			status = ProvisionStepAllowedFailure
+		}
+		errMessage = RedactSecrets(err.Error())
+	}
+
+	duration := time.Since(start).Seconds()
+	exitCode := stepExitCode(err)
+	for _, vmName := range vmNames {
+		report.add(ProvisionStepResult{
+			Step:     stepIndex,
+			Type:     s.typeName(),
+			VM:       vmName,
+			Status:   status,
+			Attempts: attempts,
+			Start:    start,
+			Duration: duration,
+			ExitCode: exitCode,
+			Error:    errMessage,
+		})
+	}
+
+	if err != nil && s.AllowFailure {
+		log.WithFields(log.Fields{"step": stepIndex, "vm": strings.Join(vmNames, ",")}).
+			Warnf("Provisioning step failed, continuing because failure is allowed: %v", err)
+		return nil
+	}
+
+	return err
+}
+
+// recordSkippedVMs records all VMs that are not targeted by a step as skipped.
+func recordSkippedVMs(report *ProvisionReport, s ProvisionStep, stepIndex int, vms []ProvisionVM, targets []ProvisionVM) {
+	if report == nil {
+		return
+	}
+
+	targeted := make(map[string]bool, len(targets))
+	for _, vm := range targets {
+		targeted[vm.Name] = true
+	}
+
+	now := time.Now()
+	for _, vm := range vms {
+		if targeted[vm.Name] {
+			continue
+		}
+
+		report.add(ProvisionStepResult{
+			Step:   stepIndex,
+			Type:   s.typeName(),
+			VM:     vm.Name,
+			Status: ProvisionStepSkipped,
+			Start:  now,
+		})
+	}
+}
+
+// stepLog writes the output of a step to one log file per target VM.
+type stepLog struct {
+	mutex sync.Mutex
+	w     io.Writer
+	files []*os.File
+}
+
+// openStepLog creates the log files for a step in logDir. If logDir is empty, no files are created and nil is returned.
+func openStepLog(logDir string, stepIndex int, stepType string, vmNames []string) (*stepLog, error) {
+	if logDir == "" {
+		return nil, nil
+	}
+
+	l := &stepLog{}
+	writers := make([]io.Writer, 0, len(vmNames))
+	for _, vmName := range vmNames {
+		dir := filepath.Join(logDir, vmName)
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to create log directory: %w", err)
+		}
+
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("step-%03d-%s.log", stepIndex, stepType)))
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to create log file: %w", err)
+		}
+
+		l.files = append(l.files, f)
+		writers = append(writers, f)
+	}
+	l.w = io.MultiWriter(writers...)
+
+	return l, nil
+}
+
+// Write writes to all log files of the step. It is safe for concurrent use.
+func (l *stepLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, err := l.w.Write([]byte(RedactSecrets(string(p))))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writer returns the step log as io.Writer, or nil if no log files are written.
+func (l *stepLog) writer() io.Writer {
+	if l == nil {
+		return nil
+	}
+	return l
+}
+
+// Close closes all log files of the step.
+func (l *stepLog) Close() {
+	if l == nil {
+		return
+	}
+
+	for _, f := range l.files {
+		if err := f.Close(); err != nil {
+			log.Warnf("failed to close log file %s: %v", f.Name(), err)
+		}
+	}
+}
+
+// stepTargets returns the VMs a step should run on.
+func (v *Virter) stepTargets(ctx context.Context, s ProvisionStep, run *provisionRun) ([]ProvisionVM, error) {
+	var targets []ProvisionVM
+	for _, vm := range run.vms {
+		vm := vm
+		if !s.matchesVM(vm) {
+			continue
+		}
+
+		if s.When != "" {
+			ok, err := evaluateCondition(s.When, run.templateData(&vm))
+			if err != nil {
+				return nil, fmt.Errorf("failed to evaluate when condition for VM %s: %w", vm.Name, err)
+			}
+
+			if !ok {
+				log.Debugf("Condition %q is false for VM %s", s.When, vm.Name)
+				continue
+			}
+		}
+
+		targets = append(targets, vm)
+	}
+
+	if s.Guard == "" {
+		return targets, nil
+	}
+
+	return v.guardedTargets(ctx, s.Guard, targets, run)
+}
+
+// guardedTargets runs the guard command on all VMs in parallel and returns the VMs where it succeeded.
+func (v *Virter) guardedTargets(ctx context.Context, guard string, vms []ProvisionVM, run *provisionRun) ([]ProvisionVM, error) {
+	passed := make([]bool, len(vms))
+
+	g, ctx := errgroup.WithContext(ctx)
+	for i, vm := range vms {
+		i, vm := i, vm
+		g.Go(func() error {
+			script, err := executeTemplate(guard, run.templateData(&vm))
+			if err != nil {
+				return fmt.Errorf("failed to execute template for guard for VM %s: %w", vm.Name, err)
+			}
+
+			err = v.VMExecShell(ctx, []string{vm.Name}, &ProvisionShellStep{Script: script})
+			var exitErr *ssh.ExitError
+			if errors.As(err, &exitErr) {
+				log.Debugf("Guard failed on VM %s with status %d", vm.Name, exitErr.ExitStatus())
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			passed[i] = true
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var result []ProvisionVM
+	for i, vm := range vms {
+		if passed[i] {
+			result = append(result, vm)
+		}
+	}
+	return result, nil
+}
+
+func (v *Virter) execProvisionContainer(ctx context.Context, containerProvider containerapi.ContainerProvider, vmNames []string, s *ProvisionContainerStep, containerName string, run *provisionRun, logFile io.Writer) error {
+	if containerName == "" {
+		containerName = "virter-" + strings.Join(vmNames, "-")
+	}
+
+	command, err := executeRuntimeTemplateArray(s.Command, run.templateData(nil))
+	if err != nil {
+		return fmt.Errorf("failed to execute template for container.command: %w", err)
+	}
+
+	containerCfg := containerapi.NewContainerConfig(
+		containerName,
+		s.Image,
+		s.Env,
+		containerapi.WithCommand(s.wrapCommand(command)...),
+		containerapi.WithPullConfig(s.Pull.ForContainer()),
+	)
+
+	for _, mount := range s.Mounts {
+		hostPath, err := prepareContainerMount(mount.Source)
+		if err != nil {
+			return err
+		}
+
+		containerCfg.AddMount(containerapi.Mount{HostPath: hostPath, ContainerPath: mount.Target, ReadOnly: mount.ReadOnly})
+	}
+
+	return v.vmExecContainer(ctx, containerProvider, vmNames, containerCfg, s.copySteps(), logFile)
+}
+
+func (v *Virter) execProvisionAnsible(ctx context.Context, containerProvider containerapi.ContainerProvider, vmNames []string, s *ProvisionAnsibleStep, containerName string, run *provisionRun, logFile io.Writer) error {
+	if containerName == "" {
+		containerName = "virter-" + strings.Join(vmNames, "-")
+	}
+
+	ansibleStep := *s
+
+	var err error
+	ansibleStep.ExtraArgs, err = executeRuntimeTemplateArray(s.ExtraArgs, run.templateData(nil))
+	if err != nil {
+		return fmt.Errorf("failed to execute template for ansible.extra_args: %w", err)
+	}
+
+	return v.vmExecAnsible(ctx, containerProvider, vmNames, &ansibleStep, run.values, containerName, logFile)
+}
+
+// execProvisionStepOnVM runs a step that is not a container step on a single VM.
+// If logFile is not nil, the output of the step is written to it.
+func (v *Virter) execProvisionStepOnVM(ctx context.Context, tools ProvisionTools, s ProvisionStep, vm ProvisionVM, execConfig ProvisionExecConfig, run *provisionRun, logFile io.Writer) error {
+	vmNames := []string{vm.Name}
+	templateData := run.templateData(&vm)
+
+	if s.Shell != nil {
+		shellStep := *s.Shell
+
+		var err error
+		if !s.Shell.Verbatim {
+			shellStep.Script, err = executeTemplate(s.Shell.Script, templateData)
+			if err != nil {
+				return fmt.Errorf("failed to execute template for shell.script for VM %s: %w", vm.Name, err)
+			}
+		}
+
+		shellStep.Env, err = executeRuntimeTemplateMap(s.Shell.Env, templateData)
+		if err != nil {
+			return fmt.Errorf("failed to execute template for shell.env for VM %s: %w", vm.Name, err)
+		}
+
+		shellStep.User, err = executeTemplate(s.Shell.User, templateData)
+		if err != nil {
+			return fmt.Errorf("failed to execute template for shell.user for VM %s: %w", vm.Name, err)
+		}
+
+		shellStep.Workdir, err = executeTemplate(s.Shell.Workdir, templateData)
+		if err != nil {
+			return fmt.Errorf("failed to execute template for shell.workdir for VM %s: %w", vm.Name, err)
+		}
+
+		if shellStep.Capture == "" {
+			return v.vmExecShell(ctx, vmNames, &shellStep, nil, logFile)
+		}
+
+		output, err := v.vmExecShellCapture(ctx, vm.Name, &shellStep, logFile)
+		if err != nil {
+			return err
+		}
+
+		run.capture(shellStep.Capture, vm.Name, output)
+		return nil
+	} else if s.Rsync != nil {
+		rsyncStep := *s.Rsync
+
+		var err error
+		rsyncStep.Source, err = executeRuntimeTemplate(s.Rsync.Source, templateData)
+		if err != nil {
+			return fmt.Errorf("failed to execute template for rsync.source for VM %s: %w", vm.Name, err)
+		}
+
+		return v.vmExecRsync(ctx, tools.NetworkCopier, vmNames, &rsyncStep, logFile)
+	} else if s.Reboot != nil {
+		if logFile != nil {
+			_, _ = fmt.Fprintf(logFile, "reboot: rebooting %s\n", vm.Name)
+		}
+
+		err := v.VMExecReboot(ctx, tools.ShellClientBuilder, vmNames, execConfig.ReadyConfig, s.Reboot)
+		if logFile != nil {
+			if err != nil {
+				writeLogFileLine(logFile, err.Error(), true)
+			} else {
+				_, _ = fmt.Fprintf(logFile, "reboot: %s is ready\n", vm.Name)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// runStepAttempts runs a step on a target, retrying it and limiting each attempt as configured for the step.
+// It returns the number of attempts made and the error of the last attempt.
+// If logFile is not nil, the start of each attempt and its error are written to it.
+func runStepAttempts(ctx context.Context, s ProvisionStep, stepIndex int, target string, logFile io.Writer, run func(ctx context.Context) error) (int, error) {
+	logger := log.WithFields(log.Fields{"step": stepIndex, "vm": target})
+
+	var err error
+	attempt := 1
+	for ; attempt <= s.Retries+1; attempt++ {
+		if attempt > 1 {
+			logger.Warnf("Provisioning step failed, retrying in %s (attempt %d of %d): %v", s.RetryDelay, attempt, s.Retries+1, err)
+
+			select {
+			case <-ctx.Done():
+				return attempt - 1, ctx.Err()
+			case <-time.After(s.RetryDelay):
+			}
+		}
+
+		if logFile != nil && s.Retries > 0 {
+			_, _ = fmt.Fprintf(logFile, "=== attempt %d of %d ===\n", attempt, s.Retries+1)
+		}
+
+		err = runStepAttempt(ctx, s.Timeout, run)
+		if err == nil {
+			if attempt > 1 {
+				logger.Infof("Provisioning step succeeded after %d attempts", attempt)
+			}
+			return attempt, nil
+		}
+
+		if logFile != nil {
+			writeLogFileLine(logFile, err.Error(), true)
+		}
+
+		if ctx.Err() != nil {
+			// Provisioning as a whole was aborted, there is no point in retrying
+			break
+		}
+	}
+
+	if attempt > s.Retries+1 {
+		attempt = s.Retries + 1
+	}
+
+	if s.Retries > 0 && !s.AllowFailure {
+		logger.Errorf("Provisioning step failed after %d attempts", attempt)
+	}
+
+	return attempt, err
+}
+
+func runStepAttempt(ctx context.Context, timeout time.Duration, run func(ctx context.Context) error) error {
+	if timeout == 0 {
+		return run(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := run(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("provisioning step timed out after %s: %w", timeout, err)
+	}
+
+	return err
+}
@@ -0,0 +1,274 @@
+package virter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunStepAttempts(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		description   string
+		step          ProvisionStep
+		failures      int
+		expectedCalls int
+		expectErr     bool
+	}{
+		{"success", ProvisionStep{}, 0, 1, false},
+		{"failure", ProvisionStep{}, 1, 1, true},
+		{"retry-success", ProvisionStep{Retries: 2}, 2, 3, false},
+		{"retry-failure", ProvisionStep{Retries: 2}, 3, 3, true},
+		{"retry-delay", ProvisionStep{Retries: 1, RetryDelay: time.Millisecond}, 1, 2, false},
+		{"allow-failure", ProvisionStep{Retries: 1, AllowFailure: true}, 2, 2, true},
+	}
+
+	for _, tc := range tests {
+		calls := 0
+		attempts, err := runStepAttempts(context.Background(), tc.step, 0, "some-vm", nil, func(ctx context.Context) error {
+			calls++
+			if calls <= tc.failures {
+				return errFailed
+			}
+			return nil
+		})
+
+		if calls != tc.expectedCalls {
+			t.Errorf("unexpected number of attempts for test %s: %d", tc.description, calls)
+		}
+		if attempts != calls {
+			t.Errorf("reported %d attempts for test %s, made %d", attempts, tc.description, calls)
+		}
+		if tc.expectErr && !errors.Is(err, errFailed) {
+			t.Errorf("expected error for test %s, got %v", tc.description, err)
+		}
+		if !tc.expectErr && err != nil {
+			t.Errorf("unexpected error for test %s: %v", tc.description, err)
+		}
+	}
+}
+
+func TestRunStepAttemptsTimeout(t *testing.T) {
+	step := ProvisionStep{Timeout: 10 * time.Millisecond, Retries: 1}
+
+	calls := 0
+	_, err := runStepAttempts(context.Background(), step, 0, "some-vm", nil, func(ctx context.Context) error {
+		calls++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected every attempt to time out separately, got %d attempts", calls)
+	}
+}
+
+func TestRunStepAttemptsCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	step := ProvisionStep{Retries: 5}
+
+	calls := 0
+	attempts, err := runStepAttempts(ctx, step, 0, "some-vm", nil, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return ctx.Err()
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled, got %v", err)
+	}
+	if calls != 1 || attempts != 1 {
+		t.Errorf("expected no retries after cancel, got %d attempts", calls)
+	}
+}
+
+func TestRunStepAttemptsLog(t *testing.T) {
+	step := ProvisionStep{Retries: 1}
+
+	var logFile bytes.Buffer
+	calls := 0
+	_, err := runStepAttempts(context.Background(), step, 0, "some-vm", &logFile, func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "=== attempt 1 of 2 ===\nerr: failed\n=== attempt 2 of 2 ===\n"
+	if logFile.String() != expected {
+		t.Errorf("unexpected log file contents %q", logFile.String())
+	}
+}
+
+func TestFinishStep(t *testing.T) {
+	exitErr := &ContainerExitError{Status: 3}
+
+	tests := []struct {
+		description    string
+		step           ProvisionStep
+		err            error
+		expectErr      bool
+		expectedStatus ProvisionStepStatus
+		expectedCode   *int
+	}{
+		{"passed", ProvisionStep{}, nil, false, ProvisionStepPassed, intPtr(0)},
+		{"failed", ProvisionStep{}, exitErr, true, ProvisionStepFailed, intPtr(3)},
+		{"allowed-failure", ProvisionStep{AllowFailure: true}, exitErr, false, ProvisionStepAllowedFailure, intPtr(3)},
+		{"unknown-exit-code", ProvisionStep{}, errors.New("failed"), true, ProvisionStepFailed, nil},
+	}
+
+	for _, tc := range tests {
+		report := &ProvisionReport{}
+		step := tc.step
+		step.Container = &ProvisionContainerStep{}
+
+		err := finishStep(report, step, 1, []string{"vm-0", "vm-1"}, time.Now(), 2, tc.err)
+		if tc.expectErr != (err != nil) {
+			t.Errorf("unexpected error for test %s: %v", tc.description, err)
+		}
+
+		if len(report.Results) != 2 {
+			t.Fatalf("expected one result per VM for test %s, got %d", tc.description, len(report.Results))
+		}
+
+		for i, result := range report.Results {
+			if result.VM != []string{"vm-0", "vm-1"}[i] || result.Step != 1 || result.Type != "container" || result.Attempts != 2 {
+				t.Errorf("unexpected result for test %s: %+v", tc.description, result)
+			}
+			if result.Status != tc.expectedStatus {
+				t.Errorf("unexpected status for test %s: %s", tc.description, result.Status)
+			}
+			if (tc.expectedCode == nil) != (result.ExitCode == nil) || (tc.expectedCode != nil && *tc.expectedCode != *result.ExitCode) {
+				t.Errorf("unexpected exit code for test %s: %v", tc.description, result.ExitCode)
+			}
+		}
+	}
+}
+
+func TestRecordSkippedVMs(t *testing.T) {
+	report := &ProvisionReport{}
+	vms := []ProvisionVM{{Index: 0, Name: "vm-0"}, {Index: 1, Name: "vm-1"}}
+
+	recordSkippedVMs(report, ProvisionStep{Shell: &ProvisionShellStep{}}, 0, vms, vms[1:])
+
+	if len(report.Results) != 1 || report.Results[0].VM != "vm-0" || report.Results[0].Status != ProvisionStepSkipped {
+		t.Errorf("unexpected results %+v", report.Results)
+	}
+
+	// Recording to no report at all must not fail
+	recordSkippedVMs(nil, ProvisionStep{}, 0, vms, nil)
+}
+
+func TestOpenStepLog(t *testing.T) {
+	l, err := openStepLog("", 0, "shell", []string{"vm-0"})
+	if err != nil || l != nil || l.writer() != nil {
+		t.Fatalf("expected no step log without log directory, got %v, %v", l, err)
+	}
+	l.Close()
+
+	dir := t.TempDir()
+	l, err = openStepLog(dir, 3, "container", []string{"vm-0", "vm-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = l.writer().Write([]byte("out: hello\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l.Close()
+
+	for _, vmName := range []string{"vm-0", "vm-1"} {
+		content, err := os.ReadFile(filepath.Join(dir, vmName, "step-003-container.log"))
+		if err != nil {
+			t.Fatalf("failed to read log file: %v", err)
+		}
+		if string(content) != "out: hello\n" {
+			t.Errorf("unexpected log file contents for %s: %q", vmName, content)
+		}
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestProvisionRunTemplateData(t *testing.T) {
+	run := &provisionRun{
+		staticData: map[string]interface{}{"Port": "6443"},
+		vms: []ProvisionVM{
+			{Index: 0, Name: "vm-0"},
+			{Index: 1, Name: "vm-1"},
+			{Index: 2, Name: "vm-2"},
+		},
+		captures: map[string]map[string]string{},
+	}
+
+	run.capture("token", "vm-2", "token-2\n")
+	run.capture("token", "vm-1", "  token-1 ")
+
+	tests := []struct {
+		template string
+		vm       *ProvisionVM
+		expected string
+	}{
+		{"{{ .Captures.token.First }}:{{ .Port }}", nil, "token-1:6443"},
+		{"{{ .Captures.token.Self }}", &run.vms[2], "token-2"},
+		{"{{ .Captures.token.Self }}", &run.vms[0], ""},
+		{"{{ index .Captures.token.ByVM \"vm-2\" }}", &run.vms[0], "token-2"},
+		{"{{ .VM.Name }}", &run.vms[1], "vm-1"},
+		{"{{ range .VMs }}{{ .Name }} {{ end }}", nil, "vm-0 vm-1 vm-2 "},
+		{"{{ (index .VMs 2).Index }}", &run.vms[0], "2"},
+	}
+
+	for _, tc := range tests {
+		actual, err := executeTemplate(tc.template, run.templateData(tc.vm))
+		if err != nil {
+			t.Errorf("unexpected error for template %q: %v", tc.template, err)
+		} else if actual != tc.expected {
+			t.Errorf("unexpected result for template %q: %q", tc.template, actual)
+		}
+	}
+
+	if _, err := executeTemplate("{{ .Captures.missing.First }}", run.templateData(nil)); err == nil {
+		t.Errorf("did not get expected error for missing capture")
+	}
+}
+
+func TestPrepareContainerMount(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	hostPath, err := prepareContainerMount("cache/build")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if hostPath != filepath.Join(dir, "cache", "build") {
+		t.Errorf("unexpected host path %q", hostPath)
+	}
+
+	if info, err := os.Stat(hostPath); err != nil || !info.IsDir() {
+		t.Errorf("expected mount source to be created: %v", err)
+	}
+
+	if err := os.Symlink(t.TempDir(), filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := prepareContainerMount("escape"); err == nil {
+		t.Errorf("expected error for mount source outside of the working directory")
+	}
+}
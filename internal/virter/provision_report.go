@@ -0,0 +1,241 @@
+package virter
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ProvisionStepStatus is the outcome of a provisioning step on a VM
+type ProvisionStepStatus string
+
+const (
+	ProvisionStepPassed         ProvisionStepStatus = "passed"
+	ProvisionStepFailed         ProvisionStepStatus = "failed"
+	ProvisionStepSkipped        ProvisionStepStatus = "skipped"
+	ProvisionStepAllowedFailure ProvisionStepStatus = "allowed_failure"
+)
+
+// ProvisionStepResult records how a provisioning step went on a single VM
+type ProvisionStepResult struct {
+	Step     int                 `json:"step"`
+	Type     string              `json:"type"`
+	VM       string              `json:"vm"`
+	Status   ProvisionStepStatus `json:"status"`
+	Attempts int                 `json:"attempts"`
+	Start    time.Time           `json:"start"`
+	// Duration is the time the step took in seconds
+	Duration float64 `json:"duration"`
+	// ExitCode is the exit code of the shell command, container or ansible-playbook, if known
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ProvisionReport collects the results of all steps of a provisioning run.
+// It is safe for concurrent use.
+type ProvisionReport struct {
+	mutex   sync.Mutex
+	Results []ProvisionStepResult
+}
+
+// add appends results to the report. It does nothing if the report is nil.
+func (r *ProvisionReport) add(results ...ProvisionStepResult) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Results = append(r.Results, results...)
+}
+
+// stepExitCode determines the exit code from the result of a step.
+func stepExitCode(err error) *int {
+	if err == nil {
+		code := 0
+		return &code
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitStatus()
+		return &code
+	}
+
+	var containerErr *ContainerExitError
+	if errors.As(err, &containerErr) {
+		code := containerErr.Status
+		return &code
+	}
+
+	var ansibleErr *AnsibleExitError
+	if errors.As(err, &ansibleErr) {
+		code := ansibleErr.Status
+		return &code
+	}
+
+	return nil
+}
+
+// WriteFile writes the report to a file. Files ending in ".xml" are written in JUnit format, all others as JSON.
+func (r *ProvisionReport) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report file: %w", err)
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".xml") {
+		err = r.WriteJUnit(f)
+	} else {
+		err = r.WriteJSON(f)
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// WriteJSON writes the report as JSON.
+func (r *ProvisionReport) WriteJSON(w io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	results := r.Results
+	if results == nil {
+		results = []ProvisionStepResult{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(struct {
+		Steps []ProvisionStepResult `json:"steps"`
+	}{results})
+	if err != nil {
+		return fmt.Errorf("failed to write JSON report: %w", err)
+	}
+
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
+
+// WriteJUnit writes the report in JUnit XML format. There is one test suite per VM and one test case per step.
+func (r *ProvisionReport) WriteJUnit(w io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	suites := junitTestSuites{Name: "virter provisioning"}
+	suiteIndex := map[string]int{}
+	var suiteTimes []float64
+	var totalTime float64
+	for _, result := range r.Results {
+		idx, ok := suiteIndex[result.VM]
+		if !ok {
+			idx = len(suites.Suites)
+			suiteIndex[result.VM] = idx
+			suites.Suites = append(suites.Suites, junitTestSuite{Name: result.VM})
+			suiteTimes = append(suiteTimes, 0)
+		}
+		suite := &suites.Suites[idx]
+
+		testCase := junitTestCase{
+			Name:      fmt.Sprintf("step %d (%s)", result.Step, result.Type),
+			ClassName: result.VM,
+			Time:      junitTime(result.Duration),
+		}
+
+		switch result.Status {
+		case ProvisionStepFailed:
+			testCase.Failure = &junitFailure{Message: result.Error, Text: result.Error}
+			if result.ExitCode != nil {
+				testCase.Failure.Type = fmt.Sprintf("exit code %d", *result.ExitCode)
+			}
+			suite.Failures++
+			suites.Failures++
+		case ProvisionStepSkipped:
+			testCase.Skipped = &struct{}{}
+			suite.Skipped++
+			suites.Skipped++
+		case ProvisionStepAllowedFailure:
+			testCase.SystemErr = "failure allowed: " + result.Error
+		}
+
+		suite.Tests++
+		suites.Tests++
+		suite.Cases = append(suite.Cases, testCase)
+
+		suiteTimes[idx] += result.Duration
+		totalTime += result.Duration
+	}
+
+	for i := range suites.Suites {
+		suites.Suites[i].Time = junitTime(suiteTimes[i])
+	}
+	suites.Time = junitTime(totalTime)
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return fmt.Errorf("failed to write JUnit report: %w", err)
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(suites)
+	if err != nil {
+		return fmt.Errorf("failed to write JUnit report: %w", err)
+	}
+
+	_, err = io.WriteString(w, "\n")
+	if err != nil {
+		return fmt.Errorf("failed to write JUnit report: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package virter
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testProvisionReport() *ProvisionReport {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	report := &ProvisionReport{}
+	report.add(
+		ProvisionStepResult{Step: 0, Type: "shell", VM: "vm-0", Status: ProvisionStepPassed, Attempts: 1, Start: start, Duration: 1.5, ExitCode: intPtr(0)},
+		ProvisionStepResult{Step: 0, Type: "shell", VM: "vm-1", Status: ProvisionStepSkipped, Start: start},
+		ProvisionStepResult{Step: 1, Type: "container", VM: "vm-0", Status: ProvisionStepFailed, Attempts: 2, Start: start, Duration: 2, ExitCode: intPtr(3), Error: "container exited with status 3"},
+		ProvisionStepResult{Step: 1, Type: "container", VM: "vm-1", Status: ProvisionStepAllowedFailure, Attempts: 1, Start: start, Duration: 0.25, Error: "timed out"},
+	)
+	return report
+}
+
+func TestProvisionReportWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	err := testProvisionReport().WriteJSON(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var decoded struct {
+		Steps []map[string]interface{} `json:"steps"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &decoded)
+	if err != nil {
+		t.Fatalf("report is not valid JSON: %v", err)
+	}
+
+	if len(decoded.Steps) != 4 {
+		t.Fatalf("expected 4 steps, got %d", len(decoded.Steps))
+	}
+
+	failed := decoded.Steps[2]
+	if failed["status"] != "failed" || failed["exit_code"] != float64(3) || failed["vm"] != "vm-0" || failed["duration"] != float64(2) {
+		t.Errorf("unexpected failed step %v", failed)
+	}
+
+	if _, ok := decoded.Steps[3]["exit_code"]; ok {
+		t.Errorf("expected no exit code for unknown exit code, got %v", decoded.Steps[3])
+	}
+}
+
+func TestProvisionReportWriteJSONEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	err := (&ProvisionReport{}).WriteJSON(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), `"steps": []`) {
+		t.Errorf("expected empty step list, got %s", buf.String())
+	}
+}
+
+func TestProvisionReportWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	err := testProvisionReport().WriteJUnit(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var suites junitTestSuites
+	err = xml.Unmarshal(buf.Bytes(), &suites)
+	if err != nil {
+		t.Fatalf("report is not valid XML: %v", err)
+	}
+
+	if suites.Tests != 4 || suites.Failures != 1 || suites.Skipped != 1 || suites.Time != "3.750" {
+		t.Errorf("unexpected totals %+v", suites)
+	}
+
+	if len(suites.Suites) != 2 || suites.Suites[0].Name != "vm-0" || suites.Suites[1].Name != "vm-1" {
+		t.Fatalf("expected one suite per VM, got %+v", suites.Suites)
+	}
+
+	vm0 := suites.Suites[0]
+	if vm0.Tests != 2 || vm0.Failures != 1 || vm0.Time != "3.500" {
+		t.Errorf("unexpected suite %+v", vm0)
+	}
+	if vm0.Cases[1].Name != "step 1 (container)" || vm0.Cases[1].Failure == nil || vm0.Cases[1].Failure.Type != "exit code 3" {
+		t.Errorf("unexpected failed test case %+v", vm0.Cases[1])
+	}
+
+	vm1 := suites.Suites[1]
+	if vm1.Cases[0].Skipped == nil {
+		t.Errorf("expected skipped test case, got %+v", vm1.Cases[0])
+	}
+	if vm1.Cases[1].Failure != nil || !strings.Contains(vm1.Cases[1].SystemErr, "timed out") {
+		t.Errorf("expected allowed failure to pass, got %+v", vm1.Cases[1])
+	}
+}
+
+func TestProvisionReportWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	report := testProvisionReport()
+
+	xmlPath := filepath.Join(dir, "junit.xml")
+	err := report.WriteFile(xmlPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, err := os.ReadFile(xmlPath)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	if !strings.HasPrefix(string(content), "<?xml") {
+		t.Errorf("expected JUnit report, got %s", content)
+	}
+
+	jsonPath := filepath.Join(dir, "report.json")
+	err = report.WriteFile(jsonPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, err = os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	if !json.Valid(content) {
+		t.Errorf("expected JSON report, got %s", content)
+	}
+}
@@ -0,0 +1,143 @@
+package virter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// provisionTemplateFuncs are the functions available in provisioning templates, in addition to the builtin ones.
+// Names, argument order and behavior follow the Sprig library, so that the last argument can be piped in.
+var provisionTemplateFuncs = template.FuncMap{
+	"default":    templateDefault,
+	"empty":      templateEmpty,
+	"coalesce":   templateCoalesce,
+	"required":   templateRequired,
+	"list":       templateList,
+	"join":       templateJoin,
+	"split":      templateSplit,
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"quote":      func(v interface{}) string { return fmt.Sprintf("%q", fmt.Sprint(v)) },
+	"squote":     templateSquote,
+	"indent":     templateIndent,
+	"b64enc":     func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec":     templateB64dec,
+	"env":        os.Getenv,
+	"toJson":     templateToJSON,
+}
+
+// newProvisionTemplate returns a new template with the provisioning template functions.
+func newProvisionTemplate() *template.Template {
+	return template.New("").Funcs(provisionTemplateFuncs)
+}
+
+// templateEmpty checks if a value is the zero value of its type, or an empty slice or map.
+func templateEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+
+	return rv.IsZero()
+}
+
+// templateDefault returns the value if it is not empty, otherwise the default.
+func templateDefault(def interface{}, v ...interface{}) interface{} {
+	if len(v) == 0 || templateEmpty(v[0]) {
+		return def
+	}
+	return v[0]
+}
+
+// templateCoalesce returns the first value that is not empty.
+func templateCoalesce(v ...interface{}) interface{} {
+	for _, item := range v {
+		if !templateEmpty(item) {
+			return item
+		}
+	}
+	return nil
+}
+
+// templateRequired fails the template with the message if the value is empty.
+func templateRequired(msg string, v interface{}) (interface{}, error) {
+	if templateEmpty(v) {
+		return nil, fmt.Errorf("%s", msg)
+	}
+	return v, nil
+}
+
+func templateList(v ...interface{}) []interface{} {
+	return v
+}
+
+// templateJoin joins the elements of a list, converting them to strings.
+func templateJoin(sep string, v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: cannot join %T", v)
+	}
+
+	items := make([]string, rv.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return strings.Join(items, sep), nil
+}
+
+// templateSplit splits a string into a list. An empty string results in an empty list.
+func templateSplit(sep, s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, sep)
+}
+
+func templateSquote(v interface{}) string {
+	return shellQuote(fmt.Sprint(v))
+}
+
+// templateIndent indents every line of s by n spaces.
+func templateIndent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func templateB64dec(s string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("b64dec: %w", err)
+	}
+	return string(decoded), nil
+}
+
+func templateToJSON(v interface{}) (string, error) {
+	result, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("toJson: %w", err)
+	}
+	return string(result), nil
+}
@@ -0,0 +1,70 @@
+package virter
+
+import (
+	"os"
+	"testing"
+)
+
+func TestProvisionTemplateFuncs(t *testing.T) {
+	os.Setenv("VIRTER_TEMPLATE_TEST", "from-env")
+	defer os.Unsetenv("VIRTER_TEMPLATE_TEST")
+
+	data := map[string]interface{}{
+		"Empty": "",
+		"Name":  "virter",
+		"List":  "a,b,c",
+		"VMs": []ProvisionVM{
+			{Index: 0, Name: "vm-0", IP: "192.168.122.2"},
+			{Index: 1, Name: "vm-1", IP: "192.168.122.3"},
+		},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{`{{ .Empty | default "fallback" }}`, "fallback"},
+		{`{{ .Name | default "fallback" }}`, "virter"},
+		{`{{ empty .Empty }}`, "true"},
+		{`{{ coalesce .Empty .Name }}`, "virter"},
+		{`{{ .List | split "," | join "-" }}`, "a-b-c"},
+		{`{{ list 1 2 3 | join "," }}`, "1,2,3"},
+		{`{{ .Name | upper }} {{ "ViRTer" | lower }}`, "VIRTER virter"},
+		{`{{ "  x " | trim }}`, "x"},
+		{`{{ .Name | trimPrefix "vir" | trimSuffix "er" }}`, "t"},
+		{`{{ .Name | replace "t" "T" }}`, "virTer"},
+		{`{{ .Name | contains "rt" }} {{ .Name | hasPrefix "vir" }} {{ .Name | hasSuffix "x" }}`, "true true false"},
+		{`{{ .Name | quote }}`, `"virter"`},
+		{`{{ "it's" | squote }}`, `'it'\''s'`},
+		{`{{ "a\nb" | indent 2 }}`, "  a\n  b"},
+		{`{{ .Name | b64enc }}`, "dmlydGVy"},
+		{`{{ "dmlydGVy" | b64dec }}`, "virter"},
+		{`{{ env "VIRTER_TEMPLATE_TEST" }}`, "from-env"},
+		{`{{ .List | split "," | toJson }}`, `["a","b","c"]`},
+		{`{{ range .VMs }}{{ .Name }}={{ .IP }};{{ end }}`, "vm-0=192.168.122.2;vm-1=192.168.122.3;"},
+		{`{{ .Empty | split "," | len }}`, "0"},
+	}
+
+	for _, tc := range tests {
+		actual, err := executeTemplate(tc.template, data)
+		if err != nil {
+			t.Errorf("unexpected error for template %q: %v", tc.template, err)
+		} else if actual != tc.expected {
+			t.Errorf("unexpected result for template %q: %q", tc.template, actual)
+		}
+	}
+}
+
+func TestProvisionTemplateFuncsErrors(t *testing.T) {
+	tests := []string{
+		`{{ .Empty | required "Empty must be set" }}`,
+		`{{ "not base64!" | b64dec }}`,
+		`{{ 5 | join "," }}`,
+	}
+
+	for _, tmpl := range tests {
+		if _, err := executeTemplate(tmpl, map[string]interface{}{"Empty": ""}); err == nil {
+			t.Errorf("expected error for template %q", tmpl)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package virter
 
 import (
+	"encoding/json"
 	"io"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kr/pretty"
 
@@ -326,3 +330,1091 @@ foo = "{{.ShellEnv"
 		}
 	}
 }
+
+func TestNewProvisionConfigReboot(t *testing.T) {
+	withTimeout := `
+version = 1
+
+[[steps]]
+reboot = { timeout = "90s" }
+`
+
+	withoutTimeout := `
+version = 1
+
+[[steps]]
+[steps.reboot]
+`
+
+	tests := []struct {
+		description string
+		input       string
+		provOpts    ProvisionOption
+		expected    time.Duration
+	}{
+		{"with-timeout", withTimeout, ProvisionOption{}, 90 * time.Second},
+		{"default-timeout", withoutTimeout, ProvisionOption{}, DefaultRebootTimeout},
+		{"override-timeout", withTimeout, ProvisionOption{Overrides: []string{"steps[0].reboot.timeout=10m"}}, 10 * time.Minute},
+	}
+
+	for _, tc := range tests {
+		r := strings.NewReader(tc.input)
+		pc, err := newProvisionConfigReader(io.NopCloser(r), tc.provOpts)
+		if err != nil {
+			t.Errorf("unexpected error for test %s: %+v", tc.description, err)
+			continue
+		}
+
+		if pc.Steps[0].Reboot == nil {
+			t.Errorf("expected reboot step for test %s", tc.description)
+			continue
+		}
+
+		if pc.Steps[0].Reboot.Timeout != tc.expected {
+			t.Errorf("unexpected timeout for test %s: %s", tc.description, pc.Steps[0].Reboot.Timeout)
+		}
+	}
+}
+
+func TestNewProvisionConfigAnsible(t *testing.T) {
+	onHost := `
+version = 1
+
+[values]
+Playbook = "site.yml"
+
+[env]
+foo = "bar"
+
+[[steps]]
+[steps.ansible]
+playbook = "playbooks/{{ .Playbook }}"
+extra_args = ["--tags", "{{ .Playbook }}"]
+env = { ANSIBLE_FORCE_COLOR = "1" }
+`
+
+	inContainer := `
+version = 1
+
+[[steps]]
+[steps.ansible]
+playbook = "site.yml"
+image = "registry.example.com/ansible:latest"
+`
+
+	noPlaybook := `
+version = 1
+
+[[steps]]
+[steps.ansible]
+image = "registry.example.com/ansible:latest"
+`
+
+	pc, err := newProvisionConfigReader(io.NopCloser(strings.NewReader(onHost)), ProvisionOption{DefaultPullPolicy: pullpolicy.IfNotExist})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := &ProvisionAnsibleStep{
+		Playbook:  "playbooks/site.yml",
+		Env:       map[string]string{"foo": "bar", "ANSIBLE_FORCE_COLOR": "1"},
+		ExtraArgs: []string{"--tags", "site.yml"},
+	}
+	if !reflect.DeepEqual(expected, pc.Steps[0].Ansible) {
+		t.Errorf("unexpected ansible step")
+		pretty.Ldiff(t, expected, pc.Steps[0].Ansible)
+	}
+
+	if pc.NeedsContainers() {
+		t.Errorf("ansible step without image should not need containers")
+	}
+
+	pc, err = newProvisionConfigReader(io.NopCloser(strings.NewReader(inContainer)), ProvisionOption{DefaultPullPolicy: pullpolicy.IfNotExist})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pc.Steps[0].Ansible.Pull != pullpolicy.IfNotExist {
+		t.Errorf("unexpected pull policy %q", pc.Steps[0].Ansible.Pull)
+	}
+
+	if !pc.NeedsContainers() {
+		t.Errorf("ansible step with image should need containers")
+	}
+
+	_, err = newProvisionConfigReader(io.NopCloser(strings.NewReader(noPlaybook)), ProvisionOption{})
+	if err == nil {
+		t.Errorf("expected error for ansible step without playbook")
+	}
+}
+
+func TestNewProvisionConfigTargeting(t *testing.T) {
+	targeted := `
+version = 1
+
+[[steps]]
+vm_indices = [0, 2]
+vm_names = ["db-*"]
+when = "{{ eq .VM.Index 0 }}"
+guard = "test -f /etc/{{ .VM.Name }}"
+[steps.shell]
+script = "echo jrc"
+[steps.shell.env]
+static = "{{ .Foo }}"
+node = "{{ .VM.Name }}-{{ .Foo }}"
+`
+
+	tests := []struct {
+		description string
+		input       string
+		valid       bool
+		provOpts    ProvisionOption
+		expected    ProvisionStep
+	}{
+		{
+			"targeted", targeted, true, ProvisionOption{Overrides: []string{"values.Foo=bar"}},
+			ProvisionStep{
+				VMIndices: []int{0, 2},
+				VMNames:   []string{"db-*"},
+				When:      "{{ eq .VM.Index 0 }}",
+				Guard:     "test -f /etc/{{ .VM.Name }}",
+				Shell: &ProvisionShellStep{
+					Script: "echo jrc",
+					Env:    map[string]string{"static": "bar", "node": "{{ .VM.Name }}-{{ .Foo }}"},
+				},
+			},
+		},
+		{
+			"override", "version = 1", true, ProvisionOption{Overrides: []string{
+				"steps[0].shell.script=env", "steps[0].vm_indices={1}", "steps[0].vm_names={node-1}",
+			}},
+			ProvisionStep{
+				VMIndices: []int{1},
+				VMNames:   []string{"node-1"},
+				Shell:     &ProvisionShellStep{Script: "env", Env: map[string]string{}},
+			},
+		},
+		{
+			"negative-index", "version = 1", false, ProvisionOption{Overrides: []string{
+				"steps[0].shell.script=env", "steps[0].vm_indices={-1}",
+			}}, ProvisionStep{},
+		},
+		{
+			"broken-pattern", "version = 1", false, ProvisionOption{Overrides: []string{
+				"steps[0].shell.script=env", "steps[0].vm_names={[}",
+			}}, ProvisionStep{},
+		},
+		{
+			"broken-when", "version = 1", false, ProvisionOption{Overrides: []string{
+				"steps[0].shell.script=env", "steps[0].when={{ .VM",
+			}}, ProvisionStep{},
+		},
+	}
+
+	for _, tc := range tests {
+		r := strings.NewReader(tc.input)
+		pc, err := newProvisionConfigReader(io.NopCloser(r), tc.provOpts)
+
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("did not get expected error for test %s", tc.description)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for test %s: %+v", tc.description, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(pc.Steps[0], tc.expected) {
+			t.Errorf("unexpected result for test %s:", tc.description)
+			pretty.Ldiff(t, tc.expected, pc.Steps[0])
+		}
+	}
+}
+
+func TestProvisionStepMatchesVM(t *testing.T) {
+	vms := []ProvisionVM{
+		{Index: 0, Name: "web-0"},
+		{Index: 1, Name: "db-0"},
+		{Index: 2, Name: "db-1"},
+	}
+
+	tests := []struct {
+		description string
+		step        ProvisionStep
+		expected    []bool
+	}{
+		{"all", ProvisionStep{}, []bool{true, true, true}},
+		{"indices", ProvisionStep{VMIndices: []int{0, 2}}, []bool{true, false, true}},
+		{"names", ProvisionStep{VMNames: []string{"db-*"}}, []bool{false, true, true}},
+		{"union", ProvisionStep{VMIndices: []int{0}, VMNames: []string{"db-1"}}, []bool{true, false, true}},
+	}
+
+	for _, tc := range tests {
+		for i, vm := range vms {
+			if actual := tc.step.matchesVM(vm); actual != tc.expected[i] {
+				t.Errorf("unexpected match result for test %s and VM %s: %v", tc.description, vm.Name, actual)
+			}
+		}
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	vm := ProvisionVM{Index: 1, Name: "db-0", IP: "192.168.122.3"}
+	values := map[string]interface{}{"Role": "db"}
+
+	tests := []struct {
+		condition string
+		valid     bool
+		expected  bool
+	}{
+		{"true", true, true},
+		{"", true, false},
+		{"{{ eq .VM.Index 1 }}", true, true},
+		{"{{ eq .VM.Name \"web-0\" }}", true, false},
+		{"{{ if eq .Role \"db\" }}true{{ end }}", true, true},
+		{"{{ if eq .Role \"web\" }}true{{ end }}", true, false},
+		{"maybe", false, false},
+		{"{{ .Missing }}", false, false},
+	}
+
+	for _, tc := range tests {
+		actual, err := evaluateCondition(tc.condition, runtimeTemplateData(values, nil, &vm, nil))
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("did not get expected error for condition %q", tc.condition)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for condition %q: %v", tc.condition, err)
+		} else if actual != tc.expected {
+			t.Errorf("unexpected result for condition %q: %v", tc.condition, actual)
+		}
+	}
+}
+
+func TestTemplateUsesRuntimeData(t *testing.T) {
+	tests := []struct {
+		template string
+		expected bool
+	}{
+		{"plain", false},
+		{"{{ .Foo }}", false},
+		{"{{ .VM.Name }}", true},
+		{"{{ $.VM.IP }}", true},
+		{"{{ if eq .VM.Index 0 }}first{{ end }}", true},
+		{"{{ range .Foo }}{{ end }}{{ with .Bar }}{{ .VM }}{{ end }}", true},
+		{"{{ printf \"%s-%d\" .Foo .VM.Index }}", true},
+		{"{{ .VMFoo }}", false},
+		{"{{ .Captures.token.First }}", true},
+		{"{{ index .Captures.token.ByVM \"vm-1\" }}", true},
+		{"{{ .CapturesFoo }}", false},
+		{"{{ range .VMs }}{{ .IP }} {{ end }}", true},
+		{"{{ .Foo | default \"bar\" | upper }}", false},
+	}
+
+	for _, tc := range tests {
+		if actual := templateUsesRuntimeData(tc.template); actual != tc.expected {
+			t.Errorf("unexpected result for template %q: %v", tc.template, actual)
+		}
+	}
+}
+
+func writeProvisionFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewProvisionConfigFilesInclude(t *testing.T) {
+	dir := t.TempDir()
+
+	writeProvisionFile(t, dir, "common/base.toml", `
+include = ["repos.toml"]
+
+[values]
+Package = "vim"
+Repo = "base"
+
+[env]
+foo = "base"
+bar = "base"
+
+[[steps]]
+[steps.shell]
+script = "install {{.Package}}"
+`)
+	writeProvisionFile(t, dir, "common/repos.toml", `
+[[steps]]
+[steps.shell]
+script = "add-repo"
+`)
+	main := writeProvisionFile(t, dir, "main.toml", `
+version = 1
+include = ["common/base.toml", "common/repos.toml"]
+
+[values]
+Repo = "main"
+
+[env]
+foo = "main"
+
+[[steps]]
+[steps.shell]
+script = "echo {{.Repo}}"
+`)
+	extra := writeProvisionFile(t, dir, "extra.toml", `
+version = 1
+
+[values]
+Repo = "extra"
+
+[[steps]]
+[steps.shell]
+script = "echo extra"
+`)
+
+	pc, err := NewProvisionConfigFiles([]string{main, extra}, ProvisionOption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedScripts := []string{"add-repo", "install {{.Package}}", "echo {{.Repo}}", "echo extra"}
+	if len(pc.Steps) != len(expectedScripts) {
+		t.Fatalf("expected %d steps, got %d", len(expectedScripts), len(pc.Steps))
+	}
+	for i, script := range expectedScripts {
+		if pc.Steps[i].Shell.Script != script {
+			t.Errorf("unexpected script for step %d: %q", i, pc.Steps[i].Shell.Script)
+		}
+		if !envEqual(EnvmapToSlice(pc.Steps[i].Shell.Env), []string{"foo=main", "bar=base"}) {
+			t.Errorf("unexpected env for step %d: %v", i, pc.Steps[i].Shell.Env)
+		}
+	}
+
+	expectedValues := map[string]string{"Package": "vim", "Repo": "extra"}
+	if !reflect.DeepEqual(pc.Values, expectedValues) {
+		t.Errorf("unexpected values: %v", pc.Values)
+	}
+}
+
+func TestNewProvisionConfigFilesIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	cycleA := writeProvisionFile(t, dir, "cycle-a.toml", `
+version = 1
+include = ["cycle-b.toml"]
+`)
+	writeProvisionFile(t, dir, "cycle-b.toml", `
+include = ["cycle-a.toml"]
+`)
+	missing := writeProvisionFile(t, dir, "missing.toml", `
+version = 1
+include = ["does-not-exist.toml"]
+`)
+	writeProvisionFile(t, dir, "typo.toml", `
+[[steps]]
+[steps.shell]
+scirpt = "echo rck"
+`)
+	unknownKey := writeProvisionFile(t, dir, "unknown-key.toml", `
+version = 1
+include = ["typo.toml"]
+`)
+	writeProvisionFile(t, dir, "wrong-version.toml", `
+version = 2
+`)
+	wrongVersion := writeProvisionFile(t, dir, "includes-wrong-version.toml", `
+version = 1
+include = ["wrong-version.toml"]
+`)
+
+	tests := []struct {
+		description string
+		path        string
+	}{
+		{"cycle", cycleA},
+		{"missing", missing},
+		{"unknown-key", unknownKey},
+		{"wrong-version", wrongVersion},
+	}
+
+	for _, tc := range tests {
+		_, err := NewProvisionConfigFiles([]string{tc.path}, ProvisionOption{})
+		if err == nil {
+			t.Errorf("did not get expected error for test %s", tc.description)
+		}
+	}
+}
+
+func TestNewProvisionConfigFormats(t *testing.T) {
+	yamlInput := `
+version: 1
+values:
+  Greeting: hello
+steps:
+  - vm_indices: [0]
+    shell:
+      script: |
+        echo first
+        echo second
+      env:
+        foo: "{{ .Greeting }}"
+  - reboot:
+      timeout: 90s
+`
+
+	jsonInput := `{
+  "version": 1,
+  "values": {"Greeting": "hello"},
+  "steps": [
+    {"vm_indices": [0], "shell": {"script": "echo first\necho second\n", "env": {"foo": "{{ .Greeting }}"}}},
+    {"reboot": {"timeout": "90s"}}
+  ]
+}`
+
+	expected := []ProvisionStep{
+		{
+			VMIndices: []int{0},
+			Shell: &ProvisionShellStep{
+				Script: "echo first\necho second\n",
+				Env:    map[string]string{"foo": "hello"},
+			},
+		},
+		{
+			Reboot: &ProvisionRebootStep{Timeout: 90 * time.Second},
+		},
+	}
+
+	tests := []struct {
+		description string
+		input       string
+		valid       bool
+		format      ProvisionFormat
+	}{
+		{"yaml", yamlInput, true, ProvisionFormatYAML},
+		{"json", jsonInput, true, ProvisionFormatJSON},
+		{"yaml-unknown-key", "version: 1\ntypo: oops\n", false, ProvisionFormatYAML},
+		{"yaml-unknown-step-key", "version: 1\nsteps:\n  - shell:\n      scirpt: echo\n", false, ProvisionFormatYAML},
+		{"json-unknown-key", `{"version": 1, "steps": [{"rsync": {"source": "a", "dest": "b", "mirror": true}}]}`, false, ProvisionFormatJSON},
+		{"json-as-toml", jsonInput, false, ProvisionFormatTOML},
+	}
+
+	for _, tc := range tests {
+		r := strings.NewReader(tc.input)
+		pc, err := newProvisionConfigReader(io.NopCloser(r), ProvisionOption{Format: tc.format})
+
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("did not get expected error for test %s", tc.description)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for test %s: %+v", tc.description, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(pc.Steps, expected) {
+			t.Errorf("unexpected result for test %s:", tc.description)
+			pretty.Ldiff(t, expected, pc.Steps)
+		}
+	}
+}
+
+func TestNewProvisionConfigFilesFormatDetection(t *testing.T) {
+	dir := t.TempDir()
+
+	writeProvisionFile(t, dir, "common.json", `{"steps": [{"shell": {"script": "from json"}}]}`)
+	writeProvisionFile(t, dir, "common.toml", `
+[[steps]]
+[steps.shell]
+script = "from toml"
+`)
+	main := writeProvisionFile(t, dir, "main.yml", `
+version: 1
+include: [common.json, common.toml]
+steps:
+  - shell:
+      script: from yaml
+`)
+
+	pc, err := NewProvisionConfigFiles([]string{main}, ProvisionOption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedScripts := []string{"from json", "from toml", "from yaml"}
+	if len(pc.Steps) != len(expectedScripts) {
+		t.Fatalf("expected %d steps, got %d", len(expectedScripts), len(pc.Steps))
+	}
+	for i, script := range expectedScripts {
+		if pc.Steps[i].Shell.Script != script {
+			t.Errorf("unexpected script for step %d: %q", i, pc.Steps[i].Shell.Script)
+		}
+	}
+}
+
+// TestProvisionSchema checks that the published JSON Schema knows about every key of the provisioning file.
+func TestProvisionSchema(t *testing.T) {
+	content, err := os.ReadFile("../../doc/provisioning.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(content, &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+
+	checkSchemaKeys(t, schema, schema, reflect.TypeOf(ProvisionConfig{}), "")
+}
+
+func checkSchemaKeys(t *testing.T, root, node map[string]interface{}, typ reflect.Type, path string) {
+	t.Helper()
+
+	if ref, ok := node["$ref"].(string); ok {
+		definitions := root["definitions"].(map[string]interface{})
+		node = definitions[strings.TrimPrefix(ref, "#/definitions/")].(map[string]interface{})
+	}
+
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+		if items, ok := node["items"].(map[string]interface{}); ok {
+			checkSchemaKeys(t, root, items, typ, strings.TrimSuffix(path, ".")+"[].")
+			return
+		}
+	}
+
+	if typ.Kind() == reflect.Map {
+		if additional, ok := node["additionalProperties"].(map[string]interface{}); ok {
+			checkSchemaKeys(t, root, additional, typ.Elem(), path+"*.")
+		}
+		return
+	}
+
+	if typ.Kind() != reflect.Struct || typ.PkgPath() != reflect.TypeOf(ProvisionConfig{}).PkgPath() {
+		return
+	}
+
+	properties, _ := node["properties"].(map[string]interface{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key := strings.Split(field.Tag.Get("toml"), ",")[0]
+
+		property, ok := properties[key].(map[string]interface{})
+		if !ok {
+			t.Errorf("schema does not describe key %s%s", path, key)
+			continue
+		}
+
+		checkSchemaKeys(t, root, property, field.Type, path+key+".")
+	}
+}
+
+func TestProvisionConfigValidate(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		valid       bool
+	}{
+		{"valid", `
+version = 1
+
+[values]
+Image = "alpine"
+
+[[steps]]
+when = "{{ eq .VM.Index 0 }}"
+guard = "test -f /etc/{{ .VM.Name }}"
+[steps.container]
+image = "{{ .Image }}:latest"
+[steps.container.copy]
+source = "/out"
+dest = "."
+
+[[steps]]
+[steps.shell]
+script = "echo rck"
+[steps.shell.env]
+NODE = "{{ .VM.Name }}-{{ .Image }}"
+
+[[steps]]
+[steps.rsync]
+source = "*.go"
+dest = "/tmp"
+`, true},
+		{"shell-env-missing-value", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "echo rck"
+[steps.shell.env]
+NODE = "{{ .VM.Name }}-{{ .Missing }}"
+`, false},
+		{"when-not-bool", `
+version = 1
+
+[[steps]]
+when = "{{ .VM.Name }}"
+[steps.shell]
+script = "echo rck"
+`, false},
+		{"guard-missing-value", `
+version = 1
+
+[[steps]]
+guard = "test -f {{ .Missing }}"
+[steps.shell]
+script = "echo rck"
+`, false},
+		{"invalid-image", `
+version = 1
+
+[[steps]]
+[steps.container]
+image = "Not A Valid Image"
+`, false},
+		{"copy-outside-workdir", `
+version = 1
+
+[[steps]]
+[steps.container]
+image = "alpine"
+[steps.container.copy]
+source = "/out"
+dest = "/etc"
+`, false},
+		{"container-mounts-and-copies", `
+version = 1
+
+[[steps]]
+[steps.container]
+image = "alpine"
+[[steps.container.mounts]]
+source = "cache"
+target = "/var/cache/build"
+[[steps.container.copies]]
+source = "/out/rpms"
+dest = "."
+[[steps.container.copies]]
+source = "/out/logs"
+dest = "."
+`, true},
+		{"container-copies-outside-workdir", `
+version = 1
+
+[[steps]]
+[steps.container]
+image = "alpine"
+[[steps.container.copies]]
+source = "/out"
+dest = "/etc"
+`, false},
+		{"container-mount-outside-workdir", `
+version = 1
+
+[[steps]]
+[steps.container]
+image = "alpine"
+[[steps.container.mounts]]
+source = "/etc"
+target = "/host-etc"
+`, false},
+		{"rsync-outside-workdir", `
+version = 1
+
+[[steps]]
+[steps.rsync]
+source = "../../doc/*.md"
+dest = "/tmp"
+`, false},
+		{"rsync-from-vm", `
+version = 1
+
+[[steps]]
+[steps.rsync]
+source = "/var/log/{{ .VM.Name }}/"
+dest = "results"
+direction = "from_vm"
+exclude = ["*.tmp"]
+delete = true
+`, true},
+		{"rsync-from-vm-outside-workdir", `
+version = 1
+
+[[steps]]
+[steps.rsync]
+source = "/var/log/"
+dest = "/tmp/results"
+direction = "from_vm"
+`, false},
+		{"no-type", `
+version = 1
+
+[[steps]]
+vm_indices = [0]
+`, false},
+		{"checkpoint", `
+version = 1
+
+[[steps]]
+checkpoint = true
+[steps.shell]
+script = "true"
+
+[[steps]]
+[steps.shell]
+script = "echo hello"
+capture = "greeting"
+`, true},
+		{"script-template-unknown-field", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "docker inspect -f '{{ .State.Status }}' db"
+`, false},
+		{"script-verbatim", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "docker inspect -f '{{ .State.Status }}' db"
+verbatim = true
+`, true},
+		{"script-template-missing-value", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "echo {{ .Missing }}"
+`, false},
+		{"checkpoint-after-capture", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "echo hello"
+capture = "greeting"
+
+[[steps]]
+checkpoint = true
+[steps.shell]
+script = "echo {{ .Captures.greeting.Self }}"
+`, false},
+	}
+
+	for _, tc := range tests {
+		r := strings.NewReader(tc.input)
+		pc, err := newProvisionConfigReader(io.NopCloser(r), ProvisionOption{})
+		if err != nil {
+			t.Errorf("unexpected error loading test %s: %+v", tc.description, err)
+			continue
+		}
+
+		err = pc.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("unexpected error for test %s: %v", tc.description, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("did not get expected error for test %s", tc.description)
+		}
+	}
+}
+
+func TestNewProvisionConfigRetries(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		valid       bool
+		provOpts    ProvisionOption
+		expected    ProvisionStep
+	}{
+		{
+			"all-options", `
+version = 1
+
+[[steps]]
+retries = 3
+retry_delay = "10s"
+timeout = "5m"
+allow_failure = true
+[steps.shell]
+script = "dnf install -y make"
+`, true, ProvisionOption{},
+			ProvisionStep{
+				Retries:      3,
+				RetryDelay:   10 * time.Second,
+				Timeout:      5 * time.Minute,
+				AllowFailure: true,
+				Shell:        &ProvisionShellStep{Script: "dnf install -y make", Env: map[string]string{}},
+			},
+		},
+		{
+			"override", "version = 1", true, ProvisionOption{Overrides: []string{
+				"steps[0].rsync.source=foo", "steps[0].retries=2", "steps[0].timeout=1m", "steps[0].allow_failure=true",
+			}},
+			ProvisionStep{
+				Retries:      2,
+				Timeout:      time.Minute,
+				AllowFailure: true,
+				Rsync:        &ProvisionRsyncStep{Source: "foo"},
+			},
+		},
+		{
+			"negative-retries", "version = 1", false, ProvisionOption{Overrides: []string{
+				"steps[0].rsync.source=foo", "steps[0].retries=-1",
+			}}, ProvisionStep{},
+		},
+		{
+			"negative-timeout", "version = 1", false, ProvisionOption{Overrides: []string{
+				"steps[0].rsync.source=foo", "steps[0].timeout=-1s",
+			}}, ProvisionStep{},
+		},
+	}
+
+	for _, tc := range tests {
+		r := strings.NewReader(tc.input)
+		pc, err := newProvisionConfigReader(io.NopCloser(r), tc.provOpts)
+
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("did not get expected error for test %s", tc.description)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for test %s: %+v", tc.description, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(pc.Steps[0], tc.expected) {
+			t.Errorf("unexpected result for test %s:", tc.description)
+			pretty.Ldiff(t, tc.expected, pc.Steps[0])
+		}
+	}
+}
+
+func TestNewProvisionConfigCapture(t *testing.T) {
+	input := `
+version = 1
+
+[values]
+Port = "6443"
+
+[[steps]]
+vm_indices = [0]
+[steps.shell]
+script = "cat /etc/token"
+capture = "token"
+
+[[steps]]
+[steps.shell]
+script = "join {{ .Captures.token.First }}:{{ .Port }}"
+[steps.shell.env]
+TOKEN = "{{ .Captures.token.First }}"
+PORT = "{{ .Port }}"
+
+[[steps]]
+[steps.container]
+image = "alpine"
+command = ["echo", "{{ index .Captures.token.ByVM \"vm-0\" }}", "{{ .Port }}"]
+
+[[steps]]
+[steps.rsync]
+source = "{{ .Captures.token.Self }}.txt"
+dest = "/tmp"
+`
+
+	pc, err := newProvisionConfigReader(io.NopCloser(strings.NewReader(input)), ProvisionOption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pc.Steps[0].Shell.Capture != "token" {
+		t.Errorf("unexpected capture name: %q", pc.Steps[0].Shell.Capture)
+	}
+
+	expectedEnv := map[string]string{"TOKEN": "{{ .Captures.token.First }}", "PORT": "6443"}
+	if !reflect.DeepEqual(pc.Steps[1].Shell.Env, expectedEnv) {
+		t.Errorf("unexpected env: %v", pc.Steps[1].Shell.Env)
+	}
+
+	expectedCommand := []string{"echo", "{{ index .Captures.token.ByVM \"vm-0\" }}", "6443"}
+	if !reflect.DeepEqual(pc.Steps[2].Container.Command, expectedCommand) {
+		t.Errorf("unexpected command: %v", pc.Steps[2].Container.Command)
+	}
+
+	if pc.Steps[3].Rsync.Source != "{{ .Captures.token.Self }}.txt" {
+		t.Errorf("unexpected rsync source: %q", pc.Steps[3].Rsync.Source)
+	}
+
+	invalidName := `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "cat /etc/token"
+capture = "my-token"
+`
+	if _, err := newProvisionConfigReader(io.NopCloser(strings.NewReader(invalidName)), ProvisionOption{}); err == nil {
+		t.Errorf("did not get expected error for invalid capture name")
+	}
+}
+
+func TestNewProvisionConfigRsyncDirection(t *testing.T) {
+	input := `
+version = 1
+
+[[steps]]
+[steps.rsync]
+source = "/var/log"
+dest = "results"
+direction = "sideways"
+`
+	if _, err := newProvisionConfigReader(io.NopCloser(strings.NewReader(input)), ProvisionOption{}); err == nil {
+		t.Errorf("did not get expected error for invalid rsync direction")
+	}
+}
+
+func TestNewProvisionConfigContainerUserWorkdir(t *testing.T) {
+	tests := []struct {
+		description string
+		step        string
+		expectError bool
+	}{
+		{"user-and-workdir", `command = ["make"]
+user = "builder"
+workdir = "/virter/workspace/src"`, false},
+		{"relative-workdir", `command = ["make"]
+workdir = "src"`, true},
+		{"user-without-command", `user = "builder"`, true},
+		{"workdir-without-command", `workdir = "/tmp"`, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			input := `
+version = 1
+
+[[steps]]
+[steps.container]
+image = "alpine:3"
+` + tc.step + "\n"
+			_, err := newProvisionConfigReader(io.NopCloser(strings.NewReader(input)), ProvisionOption{})
+			if tc.expectError && err == nil {
+				t.Errorf("did not get expected error")
+			}
+			if !tc.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestProvisionConfigValidateCapture(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		valid       bool
+	}{
+		{"captured-earlier", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "cat /etc/token"
+capture = "token"
+
+[[steps]]
+when = "{{ ne .Captures.token.Self \"\" }}"
+[steps.shell]
+script = "join {{ .Captures.token.First }}"
+`, true},
+		{"captured-later", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "join {{ .Captures.token.First }}"
+
+[[steps]]
+[steps.shell]
+script = "cat /etc/token"
+capture = "token"
+`, false},
+		{"captured-self", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "echo {{ .Captures.token.First }}"
+capture = "token"
+`, false},
+	}
+
+	for _, tc := range tests {
+		pc, err := newProvisionConfigReader(io.NopCloser(strings.NewReader(tc.input)), ProvisionOption{})
+		if err != nil {
+			t.Errorf("unexpected error loading test %s: %+v", tc.description, err)
+			continue
+		}
+
+		err = pc.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("unexpected error for test %s: %v", tc.description, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("did not get expected error for test %s", tc.description)
+		}
+	}
+}
+
+func TestProvisionConfigRegistryContainerImages(t *testing.T) {
+	pc, err := newProvisionConfigReader(io.NopCloser(strings.NewReader(`
+version = 1
+
+[[steps]]
+[steps.container]
+image = "registry.example.com/build:1"
+
+[[steps]]
+[steps.container]
+image = "local-only"
+pull = "Never"
+
+[[steps]]
+[steps.ansible]
+playbook = "site.yml"
+image = "registry.example.com/ansible:2"
+
+[[steps]]
+[steps.container]
+image = "registry.example.com/build:1"
+`)), ProvisionOption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"registry.example.com/build:1", "registry.example.com/ansible:2"}
+	if images := pc.RegistryContainerImages(); !reflect.DeepEqual(images, expected) {
+		t.Errorf("unexpected images %v", images)
+	}
+}
@@ -0,0 +1,198 @@
+package virter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// redactedSecret replaces secret values in log output
+const redactedSecret = "[REDACTED]"
+
+// ProvisionSecret describes where the value of a secret comes from. Exactly one source has to be given.
+type ProvisionSecret struct {
+	// File is read to get the value. Relative paths are relative to the provisioning file.
+	File string `toml:"file,omitempty"`
+	// Env is the name of an environment variable on the host that contains the value.
+	Env string `toml:"env,omitempty"`
+	// Command is run with "sh -c" on the host, its standard output is the value.
+	Command string `toml:"command,omitempty"`
+}
+
+// resolve reads the value of the secret. A trailing newline is removed.
+func (s ProvisionSecret) resolve(name string) (string, error) {
+	sources := 0
+	for _, source := range []string{s.File, s.Env, s.Command} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return "", fmt.Errorf("secret %s: exactly one of file, env and command must be given", name)
+	}
+
+	var value string
+	switch {
+	case s.File != "":
+		content, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: failed to read file: %w", name, err)
+		}
+		value = string(content)
+	case s.Env != "":
+		envValue, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("secret %s: environment variable %s is not set", name, s.Env)
+		}
+		value = envValue
+	case s.Command != "":
+		cmd := exec.Command("sh", "-c", s.Command)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("secret %s: failed to run command: %w", name, err)
+		}
+		value = string(output)
+	}
+
+	return strings.TrimRight(value, "\r\n"), nil
+}
+
+// resolveSecrets reads the values of all secrets and registers them for redaction.
+func resolveSecrets(secrets map[string]ProvisionSecret) (map[string]string, error) {
+	values := make(map[string]string, len(secrets))
+	for name, secret := range secrets {
+		value, err := secret.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+
+		registerSecret(value)
+		values[name] = value
+	}
+
+	return values, nil
+}
+
+// secretRedactor replaces all registered secret values in strings
+type secretRedactor struct {
+	mutex  sync.RWMutex
+	values []string
+}
+
+var (
+	secretRedaction = &secretRedactor{}
+	secretHookOnce  sync.Once
+)
+
+// registerSecret makes sure that the value does not show up in log output. Each line of a multi-line value is
+// redacted on its own, as output is logged line by line.
+func registerSecret(value string) {
+	if strings.TrimSpace(value) == "" {
+		return
+	}
+
+	secretHookOnce.Do(func() {
+		log.AddHook(&secretRedactionHook{redactor: secretRedaction})
+	})
+
+	secretRedaction.add(value)
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != value {
+			secretRedaction.add(line)
+		}
+	}
+}
+
+func (r *secretRedactor) add(value string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, existing := range r.values {
+		if existing == value {
+			return
+		}
+	}
+
+	r.values = append(r.values, value)
+	// Replace longer values first, so that a value containing another one is redacted completely
+	sort.SliceStable(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+}
+
+func (r *secretRedactor) redact(s string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, value := range r.values {
+		s = strings.ReplaceAll(s, value, redactedSecret)
+	}
+	return s
+}
+
+// secretRedactor returns a redactor for the secret values of the provisioning configuration. Each value is also
+// redacted in the form returned by escape, which is how it appears in the encoded configuration.
+func (p *ProvisionConfig) secretRedactor(escape func(string) (string, error)) (*secretRedactor, error) {
+	redactor := &secretRedactor{}
+	for _, value := range p.secretValues {
+		if value == "" {
+			continue
+		}
+
+		redactor.add(value)
+
+		escaped, err := escape(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode secret: %w", err)
+		}
+		redactor.add(escaped)
+	}
+
+	return redactor, nil
+}
+
+// RedactSecrets replaces the values of all secrets used for provisioning in s.
+func RedactSecrets(s string) string {
+	return secretRedaction.redact(s)
+}
+
+// secretRedactionHook removes secret values from log messages and fields
+type secretRedactionHook struct {
+	redactor *secretRedactor
+}
+
+func (h *secretRedactionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *secretRedactionHook) Fire(entry *log.Entry) error {
+	entry.Message = h.redactor.redact(entry.Message)
+
+	for k, v := range entry.Data {
+		var text string
+		switch value := v.(type) {
+		case string:
+			text = value
+		case error:
+			text = value.Error()
+		case fmt.Stringer:
+			text = value.String()
+		default:
+			continue
+		}
+
+		// Only replace fields that actually contain a secret, to keep their type otherwise
+		if redacted := h.redactor.redact(text); redacted != text {
+			entry.Data[k] = redacted
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package virter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestProvisionSecretResolve(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("VIRTER_SECRET_TEST", "from-env")
+	defer os.Unsetenv("VIRTER_SECRET_TEST")
+
+	tests := []struct {
+		description string
+		secret      ProvisionSecret
+		expected    string
+		expectErr   bool
+	}{
+		{"file", ProvisionSecret{File: secretFile}, "from-file", false},
+		{"env", ProvisionSecret{Env: "VIRTER_SECRET_TEST"}, "from-env", false},
+		{"command", ProvisionSecret{Command: "echo from-command"}, "from-command", false},
+		{"missing-file", ProvisionSecret{File: filepath.Join(dir, "missing")}, "", true},
+		{"missing-env", ProvisionSecret{Env: "VIRTER_SECRET_TEST_MISSING"}, "", true},
+		{"failed-command", ProvisionSecret{Command: "exit 1"}, "", true},
+		{"no-source", ProvisionSecret{}, "", true},
+		{"multiple-sources", ProvisionSecret{File: secretFile, Env: "VIRTER_SECRET_TEST"}, "", true},
+	}
+
+	for _, tc := range tests {
+		actual, err := tc.secret.resolve(tc.description)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("expected error for test %s", tc.description)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for test %s: %v", tc.description, err)
+		} else if actual != tc.expected {
+			t.Errorf("unexpected value for test %s: %q", tc.description, actual)
+		}
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	registerSecret("hunter2-redact-test")
+	registerSecret("-----BEGIN KEY-----\nline-redact-test\n-----END KEY-----")
+
+	redacted := RedactSecrets("password hunter2-redact-test and key line-redact-test")
+	if strings.Contains(redacted, "hunter2-redact-test") || strings.Contains(redacted, "line-redact-test") {
+		t.Errorf("secret not redacted: %q", redacted)
+	}
+
+	if RedactSecrets("nothing secret") != "nothing secret" {
+		t.Errorf("unexpected redaction")
+	}
+}
+
+func TestSecretRedactionHook(t *testing.T) {
+	registerSecret("hook-redact-test")
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	log.WithField("script", "echo hook-redact-test").
+		WithError(errors.New("failed with hook-redact-test")).
+		Info("Provisioning via SSH: hook-redact-test")
+
+	if strings.Contains(buf.String(), "hook-redact-test") {
+		t.Errorf("secret not redacted from log output: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), redactedSecret) {
+		t.Errorf("expected redaction marker in log output: %s", buf.String())
+	}
+}
+
+func TestNewProvisionConfigSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "token.txt"), []byte("config-secret-test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeProvisionFile(t, dir, "provision.toml", `
+version = 1
+
+[secrets]
+token = { file = "token.txt" }
+
+[[steps]]
+[steps.container]
+image = "some-image"
+env = { TOKEN = "{{ .Secrets.token }}" }
+`)
+
+	pc, err := NewProvisionConfigFiles([]string{path}, ProvisionOption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pc.Steps[0].Container.Env["TOKEN"] != "config-secret-test" {
+		t.Errorf("unexpected env %v", pc.Steps[0].Container.Env)
+	}
+
+	if pc.Secrets["token"].File != filepath.Join(dir, "token.txt") {
+		t.Errorf("expected secret file relative to provisioning file, got %q", pc.Secrets["token"].File)
+	}
+
+	if RedactSecrets("config-secret-test") != redactedSecret {
+		t.Errorf("secret from provisioning file not registered for redaction")
+	}
+
+	_, err = newProvisionConfigReader(io.NopCloser(strings.NewReader(`
+version = 1
+
+[secrets]
+missing = { env = "VIRTER_SECRET_TEST_MISSING" }
+`)), ProvisionOption{})
+	if err == nil {
+		t.Errorf("expected error for missing secret")
+	}
+}
+
+func TestProvisionConfigEncodeTOMLSecrets(t *testing.T) {
+	t.Setenv("VIRTER_SECRET_TEST_PRINT", "print-secret-\"test\"")
+
+	pc, err := newProvisionConfigReader(io.NopCloser(strings.NewReader(`
+version = 1
+
+[secrets]
+token = { env = "VIRTER_SECRET_TEST_PRINT" }
+
+[[steps]]
+[steps.container]
+image = "some-image"
+env = { TOKEN = "{{ .Secrets.token }}" }
+command = ["login", "{{ .Secrets.token }}"]
+
+[[steps]]
+[steps.shell]
+script = "login"
+env = { TOKEN = "{{ .Secrets.token }}" }
+`)), ProvisionOption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := pc.EncodeTOML(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "print-secret-") {
+		t.Errorf("secret in encoded configuration: %s", buf.String())
+	}
+	if strings.Count(buf.String(), redactedSecret) != 3 {
+		t.Errorf("expected secret to be redacted in 3 places: %s", buf.String())
+	}
+}
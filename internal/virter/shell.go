@@ -0,0 +1,103 @@
+package virter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultShellInterpreter runs scripts of shell steps that set a user, workdir or interpreter
+const defaultShellInterpreter = "sh"
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// wrapCommand returns the command that runs command as User in Workdir. The container API can not set them when
+// creating the container, so the command is wrapped in a shell that changes the directory, and in su to switch to
+// the user. Switching the user needs the container to run as root.
+func (s *ProvisionContainerStep) wrapCommand(command []string) []string {
+	if s.User == "" && s.Workdir == "" {
+		return command
+	}
+
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = shellQuote(arg)
+	}
+
+	script := "exec " + strings.Join(quoted, " ")
+	if s.Workdir != "" {
+		script = fmt.Sprintf("cd -- %s || exit 1\n%s", shellQuote(s.Workdir), script)
+	}
+
+	if s.User != "" {
+		return []string{"su", "-s", "/bin/sh", "-c", script, s.User}
+	}
+
+	return []string{defaultShellInterpreter, "-c", script}
+}
+
+// command returns the script that is run in the login shell of the SSH user and the environment for it.
+//
+// Without user, workdir and interpreter, this is just the script. Otherwise the script is wrapped: the wrapper
+// changes to the workdir and passes the script on standard input to the interpreter, via sudo or doas if it has to
+// run as a different user. The environment is passed explicitly in that case, as sudo does not keep it.
+func (s *ProvisionShellStep) command() (string, []string) {
+	if s.User == "" && s.Workdir == "" && s.Interpreter == "" {
+		return s.Script, EnvmapToSlice(s.Env)
+	}
+
+	var b strings.Builder
+
+	if s.Workdir != "" {
+		fmt.Fprintf(&b, "cd -- %s || exit 1\n", shellQuote(s.Workdir))
+	}
+
+	run := ""
+	if s.User != "" {
+		user := shellQuote(s.User)
+		fmt.Fprintf(&b, "virter_run() {\n")
+		fmt.Fprintf(&b, "\tif [ \"$(id -un)\" = %s ]; then \"$@\"\n", user)
+		fmt.Fprintf(&b, "\telif command -v sudo >/dev/null 2>&1; then sudo -u %s -- \"$@\"\n", user)
+		fmt.Fprintf(&b, "\telif command -v doas >/dev/null 2>&1; then doas -u %s \"$@\"\n", user)
+		fmt.Fprintf(&b, "\telse echo \"neither sudo nor doas found to run as user \"%s >&2; exit 1\n", user)
+		fmt.Fprintf(&b, "\tfi\n}\n")
+		run = "virter_run "
+	}
+
+	envKeys := make([]string, 0, len(s.Env))
+	for k := range s.Env {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+
+	envArgs := ""
+	if len(envKeys) > 0 {
+		envArgs = "env "
+		for _, k := range envKeys {
+			envArgs += shellQuote(k+"="+s.Env[k]) + " "
+		}
+	}
+
+	interpreter := s.Interpreter
+	if interpreter == "" {
+		interpreter = defaultShellInterpreter
+	}
+
+	// The delimiter of the here-document must not appear in the script itself
+	delimiter := "VIRTER_SCRIPT_EOF"
+	for strings.Contains(s.Script, delimiter) {
+		delimiter += "_"
+	}
+
+	script := s.Script
+	if !strings.HasSuffix(script, "\n") {
+		script += "\n"
+	}
+
+	fmt.Fprintf(&b, "%s%s%s <<'%s'\n%s%s\n", run, envArgs, interpreter, delimiter, script, delimiter)
+
+	return b.String(), nil
+}
@@ -0,0 +1,110 @@
+package virter
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShellStepCommand(t *testing.T) {
+	plain := ProvisionShellStep{Script: "echo hi", Env: map[string]string{"A": "1"}}
+	script, env := plain.command()
+	if script != "echo hi" || len(env) != 1 || env[0] != "A=1" {
+		t.Errorf("expected plain script to be unchanged, got %q %q", script, env)
+	}
+
+	wrapped := ProvisionShellStep{
+		Script:      "print('VIRTER_SCRIPT_EOF')",
+		Env:         map[string]string{"B": "it's", "A": "1"},
+		User:        "app",
+		Workdir:     "/opt/app",
+		Interpreter: "python3",
+	}
+	script, env = wrapped.command()
+	if len(env) != 0 {
+		t.Errorf("expected env to be part of the wrapper, got %q", env)
+	}
+
+	for _, expected := range []string{
+		"cd -- '/opt/app' || exit 1\n",
+		"sudo -u 'app' -- \"$@\"",
+		"virter_run env 'A=1' 'B=it'\\''s' python3 <<'VIRTER_SCRIPT_EOF_'\nprint('VIRTER_SCRIPT_EOF')\nVIRTER_SCRIPT_EOF_\n",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("expected %q in wrapper:\n%s", expected, script)
+		}
+	}
+}
+
+func TestContainerStepWrapCommand(t *testing.T) {
+	command := []string{"echo", "it's"}
+
+	plain := ProvisionContainerStep{}
+	if wrapped := plain.wrapCommand(command); !reflect.DeepEqual(wrapped, command) {
+		t.Errorf("expected plain command to be unchanged, got %q", wrapped)
+	}
+
+	workdir := ProvisionContainerStep{Workdir: "/src"}
+	expected := []string{"sh", "-c", "cd -- '/src' || exit 1\nexec 'echo' 'it'\\''s'"}
+	if wrapped := workdir.wrapCommand(command); !reflect.DeepEqual(wrapped, expected) {
+		t.Errorf("unexpected command with workdir: %q", wrapped)
+	}
+
+	user := ProvisionContainerStep{User: "builder", Workdir: "/src"}
+	expected = []string{"su", "-s", "/bin/sh", "-c", "cd -- '/src' || exit 1\nexec 'echo' 'it'\\''s'", "builder"}
+	if wrapped := user.wrapCommand(command); !reflect.DeepEqual(wrapped, expected) {
+		t.Errorf("unexpected command with user: %q", wrapped)
+	}
+}
+
+func TestNewProvisionConfigScriptFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	writeProvisionFile(t, dir, "provision/setup.sh", "echo {{ .Values.Name }}\n")
+	path := writeProvisionFile(t, dir, "provision/provision.toml", `
+version = 1
+
+[values]
+Name = "test"
+
+[[steps]]
+[steps.shell]
+script_file = "setup.sh"
+`)
+
+	pc, err := NewProvisionConfigFiles([]string{path}, ProvisionOption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pc.Steps[0].Shell.Script != "echo {{ .Values.Name }}\n" {
+		t.Errorf("unexpected script %q", pc.Steps[0].Shell.Script)
+	}
+
+	path = writeProvisionFile(t, dir, "provision/both.toml", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script = "true"
+script_file = "setup.sh"
+`)
+	if _, err := NewProvisionConfigFiles([]string{path}, ProvisionOption{}); err == nil {
+		t.Errorf("expected error for script and script_file")
+	}
+
+	outside := t.TempDir()
+	writeProvisionFile(t, outside, "setup.sh", "true\n")
+	path = writeProvisionFile(t, dir, "provision/outside.toml", `
+version = 1
+
+[[steps]]
+[steps.shell]
+script_file = "`+filepath.Join(outside, "setup.sh")+`"
+`)
+	if _, err := NewProvisionConfigFiles([]string{path}, ProvisionOption{}); err == nil {
+		t.Errorf("expected error for script_file outside of the working directory")
+	}
+}
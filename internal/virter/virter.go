@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 	"text/template"
 	"time"
 
@@ -60,6 +61,10 @@ type Virter struct {
 	provisionStoragePool libvirt.StoragePool
 	provisionNetwork     libvirt.Network
 	sshkeys              sshkeys.KeyStore
+
+	// handedOutVMIDs are the IDs GetVMID returned when searching for a free ID
+	vmIDLock       sync.Mutex
+	handedOutVMIDs map[uint]bool
 }
 
 // New configures a new Virter.
@@ -152,7 +157,9 @@ type VMConfig struct {
 	ExtraNics          []NIC
 	Mounts             []Mount
 	GDBPort            uint
+	Firmware           string
 	SecureBoot         bool
+	BootDiskBus        string
 	VNCEnabled         bool
 	VNCPort            int
 	VNCIPv4BindAddress string
@@ -196,6 +203,8 @@ func CheckVMConfig(vmConfig VMConfig) (VMConfig, error) {
 		return vmConfig, fmt.Errorf("cannot start a VM with reserved ID (i.e., IP) 'x.y.z.%d'", vmConfig.ID)
 	} else if err := checkDisks(vmConfig); err != nil {
 		return vmConfig, fmt.Errorf("cannot start VM: %w", err)
+	} else if err := (ImageDefaults{Firmware: vmConfig.Firmware, DiskBus: vmConfig.BootDiskBus}).Check(); err != nil {
+		return vmConfig, fmt.Errorf("cannot start VM: %w", err)
 	} else if vmConfig.VNCEnabled && (vmConfig.VNCPort < 5900 || vmConfig.VNCPort > 65535) {
 		return vmConfig, fmt.Errorf("VNC port must be in the range [5900 65535]: port is %v", vmConfig.VNCPort)
 	}
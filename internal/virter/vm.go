@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -462,70 +464,75 @@ type CommitConfig struct {
 // before committing. If shutdown is false, the caller is responsible for
 // ensuring that the VM is not running.
 func (v *Virter) VMCommit(ctx context.Context, afterNotifier AfterNotifier, vmName string, commitConfig CommitConfig, staticDHCP bool, opts ...LayerOperationOption) error {
+	volumeLayer, err := v.vmCommitLayer(ctx, afterNotifier, vmName, commitConfig, staticDHCP, opts...)
+	if err != nil {
+		return err
+	}
+
+	_, err = v.MakeImage(commitConfig.ImageName, volumeLayer, opts...)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// vmCommitLayer removes the VM and turns its root volume into a layer. The ImageName of the commitConfig is ignored.
+func (v *Virter) vmCommitLayer(ctx context.Context, afterNotifier AfterNotifier, vmName string, commitConfig CommitConfig, staticDHCP bool, opts ...LayerOperationOption) (*VolumeLayer, error) {
 	domain, err := v.libvirt.DomainLookupByName(vmName)
 	if err != nil {
-		return fmt.Errorf("could not get domain: %w", err)
+		return nil, fmt.Errorf("could not get domain: %w", err)
 	}
 
 	active, err := v.libvirt.DomainIsActive(domain)
 	if err != nil {
-		return fmt.Errorf("could not check if domain is active: %w", err)
+		return nil, fmt.Errorf("could not check if domain is active: %w", err)
 	}
 
 	running := active != 0
 
 	// Check if shutdown is allowed before resetting machine ID.
 	if running && !commitConfig.Shutdown {
-		return fmt.Errorf("must allow shutdown to commit a running VM")
+		return nil, fmt.Errorf("must allow shutdown to commit a running VM")
 	}
 
 	if commitConfig.ResetMachineID {
 		if !running {
-			return fmt.Errorf("cannot reset machine ID of VM '%s' that is not running", vmName)
+			return nil, fmt.Errorf("cannot reset machine ID of VM '%s' that is not running", vmName)
 		}
 
 		// Starting the VM creates a machine ID.
 		// We want these IDs to be unique, so reset to empty.
 		err = v.VMExecShell(
 			ctx, []string{vmName},
-			&ProvisionShellStep{Script: "CMD='truncate -c -s 0 /etc/machine-id'; [ \"$(id -u)\" -eq 0 ] && $CMD || { ESC=$(command -v sudo || command -v doas || command -v please || echo ''); $ESC $CMD; }"})
+			&ProvisionShellStep{Script: withPrivilegeEscalation("truncate -c -s 0 /etc/machine-id")})
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	if running && commitConfig.Shutdown {
 		err = v.vmShutdown(ctx, afterNotifier, commitConfig.ShutdownTimeout, domain)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	err = v.VMRm(vmName, !staticDHCP, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	layer, err := v.FindDynamicLayer(vmName, v.provisionStoragePool)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if layer == nil {
-		return fmt.Errorf("could not commit: missing root layer")
+		return nil, fmt.Errorf("could not commit: missing root layer")
 	}
 
-	volumeLayer, err := layer.ToVolumeLayer(nil, opts...)
-	if err != nil {
-		return err
-	}
-
-	_, err = v.MakeImage(commitConfig.ImageName, volumeLayer, opts...)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return layer.ToVolumeLayer(nil, opts...)
 }
 
 // vmShutdown sends a command to libvirt to shut down a domain. It then waits for
@@ -675,7 +682,13 @@ func (v *Virter) getSSHUserNames(vmNames []string) []string {
 
 // VMExecContainer runs a container against some VMs.
 func (v *Virter) VMExecContainer(ctx context.Context, containerProvider containerapi.ContainerProvider,
-	vmNames []string, containerCfg *containerapi.ContainerConfig, copyStep *ProvisionContainerCopyStep) error {
+	vmNames []string, containerCfg *containerapi.ContainerConfig, copySteps []ProvisionContainerCopyStep) error {
+	return v.vmExecContainer(ctx, containerProvider, vmNames, containerCfg, copySteps, nil)
+}
+
+// vmExecContainer runs a container against some VMs. If logFile is not nil, the container output is also written to it.
+func (v *Virter) vmExecContainer(ctx context.Context, containerProvider containerapi.ContainerProvider,
+	vmNames []string, containerCfg *containerapi.ContainerConfig, copySteps []ProvisionContainerCopyStep, logFile io.Writer) error {
 
 	accessIPNet, err := v.getIPNet(v.provisionNetwork)
 	if err != nil {
@@ -718,7 +731,7 @@ func (v *Virter) VMExecContainer(ctx context.Context, containerProvider containe
 	}
 	containerCfg.AddDNSServer(dnsserver)
 
-	err = containerRun(ctx, containerProvider, containerCfg, vmNames, vmSSHUserNames, ips, v.sshkeys, knownHosts, copyStep)
+	err = containerRun(ctx, containerProvider, containerCfg, vmNames, vmSSHUserNames, ips, v.sshkeys, knownHosts, copySteps, logFile)
 	if err != nil {
 		return fmt.Errorf("failed to run container provisioning: %w", err)
 	}
@@ -764,6 +777,19 @@ func (v *Virter) VMSSHSession(ctx context.Context, vmName string) error {
 
 // VMExecShell runs a simple shell command against some VMs.
 func (v *Virter) VMExecShell(ctx context.Context, vmNames []string, shellStep *ProvisionShellStep) error {
+	return v.vmExecShell(ctx, vmNames, shellStep, nil, nil)
+}
+
+// vmExecShellCapture runs a simple shell command on a single VM and returns its standard output.
+func (v *Virter) vmExecShellCapture(ctx context.Context, vmName string, shellStep *ProvisionShellStep, logFile io.Writer) (string, error) {
+	var stdout bytes.Buffer
+	err := v.vmExecShell(ctx, []string{vmName}, shellStep, &stdout, logFile)
+	return stdout.String(), err
+}
+
+// vmExecShell runs a shell command against some VMs. If stdout is not nil, the standard output is also written to it.
+// If logFile is not nil, all output is also written to it.
+func (v *Virter) vmExecShell(ctx context.Context, vmNames []string, shellStep *ProvisionShellStep, stdout io.Writer, logFile io.Writer) error {
 	ips, err := v.getIPs(vmNames)
 	if err != nil {
 		return err
@@ -789,42 +815,247 @@ func (v *Virter) VMExecShell(ctx context.Context, vmNames []string, shellStep *P
 			HostKeyAlgorithms: supportedAlgos,
 		}
 
-		log.Debugln("Provisioning via SSH:", shellStep.Script, "in", ip)
+		script, env := shellStep.command()
+		log.Debugln("Provisioning via SSH:", script, "in", ip)
 		g.Go(func() error {
-			return runSSHCommand(ctx, &sshConfig, vmName, net.JoinHostPort(ip, "22"), shellStep.Script, EnvmapToSlice(shellStep.Env))
+			return runSSHCommand(ctx, &sshConfig, vmName, net.JoinHostPort(ip, "22"), script, env, stdout, logFile)
 		})
 	}
 
 	return g.Wait()
 }
 
+// VMExecReboot reboots some VMs and waits for them to come back.
+//
+// A VM counts as rebooted once it reports a new boot ID and is ready again according to WaitVmReady. All VMs are
+// rebooted in parallel, each of them has to be back within the timeout of the reboot step.
+func (v *Virter) VMExecReboot(ctx context.Context, shellClientBuilder ShellClientBuilder, vmNames []string, readyConfig VmReadyConfig, rebootStep *ProvisionRebootStep) error {
+	g, ctx := errgroup.WithContext(ctx)
+	for _, vmName := range vmNames {
+		vmName := vmName
+		g.Go(func() error {
+			return v.vmReboot(ctx, shellClientBuilder, vmName, readyConfig, rebootStep.Timeout)
+		})
+	}
+	return g.Wait()
+}
+
+func (v *Virter) vmReboot(ctx context.Context, shellClientBuilder ShellClientBuilder, vmName string, readyConfig VmReadyConfig, timeout time.Duration) error {
+	logger := log.WithField("vm", vmName)
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ips, err := v.getIPs([]string{vmName})
+	if err != nil {
+		return err
+	}
+
+	knownHosts, err := v.getKnownHostsFor(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to fetch host keys: %w", err)
+	}
+
+	hostkeyCheck, supportedAlgos := knownHosts.AsHostKeyConfig()
+
+	sshConfig := ssh.ClientConfig{
+		Auth:              v.sshkeys.Auth(),
+		Timeout:           readyConfig.CheckTimeout,
+		User:              v.getSSHUserName(vmName),
+		HostKeyCallback:   hostkeyCheck,
+		HostKeyAlgorithms: supportedAlgos,
+	}
+	hostPort := net.JoinHostPort(ips[0], "ssh")
+
+	bootID, err := readBootID(ctx, shellClientBuilder, hostPort, sshConfig)
+	if err != nil {
+		return fmt.Errorf("failed to read boot ID of VM '%s': %w", vmName, err)
+	}
+
+	logger.Debug("Reboot VM")
+	sshClient := shellClientBuilder.NewShellClient(hostPort, sshConfig)
+	if err := sshClient.DialContext(ctx); err != nil {
+		return fmt.Errorf("failed to connect to VM '%s': %w", vmName, err)
+	}
+	err = sshClient.ExecScript(withPrivilegeEscalation("reboot"))
+	_ = sshClient.Close()
+
+	// The connection is expected to go away while the VM is shutting down, so only a proper exit status of the
+	// reboot command is considered a failure.
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && exitErr.Signal() == "" {
+		return fmt.Errorf("failed to reboot VM '%s': %w", vmName, err)
+	} else if err != nil {
+		logger.Debugf("Connection closed while rebooting: %v", err)
+	}
+
+	logger.Debug("Wait for boot ID to change")
+	for {
+		newBootID, err := readBootID(ctx, shellClientBuilder, hostPort, sshConfig)
+		if err != nil {
+			logger.Debugf("Could not read boot ID: %v", err)
+		} else if newBootID != bootID {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for VM '%s' to reboot: %w", vmName, ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+
+	err = v.WaitVmReady(ctx, shellClientBuilder, vmName, readyConfig)
+	if err != nil {
+		return fmt.Errorf("VM '%s' did not come back after reboot: %w", vmName, err)
+	}
+
+	logger.Debug("VM rebooted")
+	return nil
+}
+
+// readBootID returns the ID of the current boot of a VM, which changes on every reboot.
+func readBootID(ctx context.Context, shellClientBuilder ShellClientBuilder, hostPort string, sshConfig ssh.ClientConfig) (string, error) {
+	sshClient := shellClientBuilder.NewShellClient(hostPort, sshConfig)
+	if err := sshClient.DialContext(ctx); err != nil {
+		return "", err
+	}
+	defer sshClient.Close()
+
+	outp, err := sshClient.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(&out, outp)
+		copyDone <- err
+	}()
+
+	err = sshClient.ExecScript("cat /proc/sys/kernel/random/boot_id")
+	copyErr := <-copyDone
+	if err != nil {
+		return "", err
+	}
+	if copyErr != nil {
+		return "", copyErr
+	}
+
+	bootID := strings.TrimSpace(out.String())
+	if bootID == "" {
+		return "", fmt.Errorf("got empty boot ID")
+	}
+
+	return bootID, nil
+}
+
+// withPrivilegeEscalation wraps a simple command so that it runs as root, using sudo or a similar tool if the SSH
+// user is not root.
+func withPrivilegeEscalation(cmd string) string {
+	return "CMD='" + cmd + "'; [ \"$(id -u)\" -eq 0 ] && $CMD || { ESC=$(command -v sudo || command -v doas || command -v please || echo ''); $ESC $CMD; }"
+}
+
 func (v *Virter) VMExecRsync(ctx context.Context, copier netcopy.NetworkCopier, vmNames []string, rsyncStep *ProvisionRsyncStep) error {
+	return v.vmExecRsync(ctx, copier, vmNames, rsyncStep, nil)
+}
+
+// vmExecRsync copies files to or from some VMs. If logFile is not nil, the copied files and errors are also written
+// to it.
+func (v *Virter) vmExecRsync(ctx context.Context, copier netcopy.NetworkCopier, vmNames []string, rsyncStep *ProvisionRsyncStep, logFile io.Writer) error {
 	wd, err := os.Getwd()
 	if err != nil {
 		return fmt.Errorf("failed to get working directory: %w", err)
 	}
 
+	if rsyncStep.fromVM() {
+		return v.vmExecRsyncFromVM(ctx, copier, vmNames, rsyncStep, wd, logFile)
+	}
+
+	resolved, err := resolveRsyncSource(rsyncStep.Source, wd)
+	if err != nil {
+		return err
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	for _, vmName := range vmNames {
+		vmName := vmName
+		log.Debugf(`Copying files via rsync: %s to %s on %s`, rsyncStep.Source, rsyncStep.Dest, vmName)
+		g.Go(func() error {
+			dest := fmt.Sprintf("%s:%s", vmName, rsyncStep.Dest)
+			if logFile != nil {
+				_, _ = fmt.Fprintf(logFile, "rsync: %s -> %s\n", strings.Join(resolved, " "), dest)
+			}
+
+			err := v.vmExecCopy(ctx, copier, resolved, dest, rsyncStep.copyOptions())
+			if err != nil && logFile != nil {
+				writeLogFileLine(logFile, err.Error(), true)
+			}
+			return err
+		})
+	}
+	return g.Wait()
+}
+
+// vmExecRsyncFromVM copies files from some VMs to the host. The files of each VM end up in a subdirectory of the
+// destination named after the VM, so that files from different VMs do not collide.
+func (v *Virter) vmExecRsyncFromVM(ctx context.Context, copier netcopy.NetworkCopier, vmNames []string, rsyncStep *ProvisionRsyncStep, workDir string, logFile io.Writer) error {
+	if err := checkPathInWorkDir(rsyncStep.Dest, workDir); err != nil {
+		return fmt.Errorf("rsync destination not allowed: %w", err)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	for _, vmName := range vmNames {
+		vmName := vmName
+		log.Debugf(`Copying files via rsync: %s on %s to %s`, rsyncStep.Source, vmName, rsyncStep.Dest)
+		g.Go(func() error {
+			source := fmt.Sprintf("%s:%s", vmName, rsyncStep.Source)
+			dest := filepath.Join(rsyncStep.Dest, vmName) + string(filepath.Separator)
+			if logFile != nil {
+				_, _ = fmt.Fprintf(logFile, "rsync: %s -> %s\n", source, dest)
+			}
+
+			err := os.MkdirAll(dest, 0755)
+			if err == nil {
+				err = v.vmExecCopy(ctx, copier, []string{source}, dest, rsyncStep.copyOptions())
+			}
+			if err != nil && logFile != nil {
+				writeLogFileLine(logFile, err.Error(), true)
+			}
+			return err
+		})
+	}
+	return g.Wait()
+}
+
+// resolveRsyncSource expands the glob pattern of an rsync source and checks that all
+// matching files are within the working directory.
+func resolveRsyncSource(source, workDir string) ([]string, error) {
 	// Check the non-glob prefix of the pattern first, so that patterns
 	// pointing outside the working directory are rejected even when no
 	// files match. This mirrors Docker/BuildKit's approach for COPY.
-	globPrefix, _ := splitGlobPrefix(rsyncStep.Source)
-	if err := checkPathInWorkDir(globPrefix, wd); err != nil {
-		return fmt.Errorf("rsync source not allowed: %w", err)
+	globPrefix, _ := splitGlobPrefix(source)
+	if err := checkPathInWorkDir(globPrefix, workDir); err != nil {
+		return nil, fmt.Errorf("rsync source not allowed: %w", err)
 	}
 
-	files, err := filepath.Glob(rsyncStep.Source)
+	files, err := filepath.Glob(source)
 	if err != nil {
-		return fmt.Errorf("failed to parse glob pattern: %w", err)
+		return nil, fmt.Errorf("failed to parse glob pattern: %w", err)
 	}
 
 	resolved := make([]string, 0, len(files))
 	for _, f := range files {
 		realPath, err := filepath.EvalSymlinks(f)
 		if err != nil {
-			return fmt.Errorf("failed to resolve path %q: %w", f, err)
+			return nil, fmt.Errorf("failed to resolve path %q: %w", f, err)
 		}
-		if err := checkPathInWorkDir(realPath, wd); err != nil {
-			return fmt.Errorf("rsync source not allowed: %w", err)
+		if err := checkPathInWorkDir(realPath, workDir); err != nil {
+			return nil, fmt.Errorf("rsync source not allowed: %w", err)
 		}
 		// Preserve trailing slash: it is semantically significant for
 		// rsync (copy directory contents vs. copy directory itself).
@@ -834,19 +1065,14 @@ func (v *Virter) VMExecRsync(ctx context.Context, copier netcopy.NetworkCopier,
 		resolved = append(resolved, realPath)
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
-	for _, vmName := range vmNames {
-		vmName := vmName
-		log.Debugf(`Copying files via rsync: %s to %s on %s`, rsyncStep.Source, rsyncStep.Dest, vmName)
-		g.Go(func() error {
-			dest := fmt.Sprintf("%s:%s", vmName, rsyncStep.Dest)
-			return v.VMExecCopy(ctx, copier, resolved, dest)
-		})
-	}
-	return g.Wait()
+	return resolved, nil
 }
 
 func (v *Virter) VMExecCopy(ctx context.Context, copier netcopy.NetworkCopier, sourceSpecs []string, destSpec string) error {
+	return v.vmExecCopy(ctx, copier, sourceSpecs, destSpec, netcopy.CopyOptions{})
+}
+
+func (v *Virter) vmExecCopy(ctx context.Context, copier netcopy.NetworkCopier, sourceSpecs []string, destSpec string, opts netcopy.CopyOptions) error {
 	sources := make([]netcopy.HostPath, len(sourceSpecs))
 	var vmNames []string
 	for i, srcSpec := range sourceSpecs {
@@ -882,10 +1108,10 @@ func (v *Virter) VMExecCopy(ctx context.Context, copier netcopy.NetworkCopier, s
 		return err
 	}
 
-	return copier.Copy(ctx, sources, dest, v.sshkeys, knownHosts)
+	return copier.Copy(ctx, sources, dest, v.sshkeys, knownHosts, opts)
 }
 
-func runSSHCommand(ctx context.Context, config *ssh.ClientConfig, vmName, ipPort, script string, env []string) error {
+func runSSHCommand(ctx context.Context, config *ssh.ClientConfig, vmName, ipPort, script string, env []string, stdout io.Writer, logFile io.Writer) error {
 	script, err := sshclient.AddEnv(script, env)
 	if err != nil {
 		return err
@@ -901,23 +1127,42 @@ func runSSHCommand(ctx context.Context, config *ssh.ClientConfig, vmName, ipPort
 	}
 	defer sshClient.Close()
 
-	outp, err := sshClient.StdoutPipe()
+	var outp io.Reader
+	outp, err = sshClient.StdoutPipe()
 	if err != nil {
 		return err
 	}
+	if stdout != nil {
+		outp = io.TeeReader(outp, stdout)
+	}
 	errp, err := sshClient.StderrPipe()
 	if err != nil {
 		return err
 	}
 
+	// ExecScript does not know about the context, so close the connection to abort the command
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = sshClient.Close()
+		case <-done:
+		}
+	}()
+
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go logLines(&wg, vmName, false, outp)
-	go logLines(&wg, vmName, true, errp)
+	go logLines(&wg, vmName, false, outp, logFile)
+	go logLines(&wg, vmName, true, errp, logFile)
 
 	err = sshClient.ExecScript(script)
 	wg.Wait()
 
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("command on %s aborted: %w", vmName, ctx.Err())
+	}
+
 	return err
 }
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -41,6 +42,19 @@ func TestCheckVMConfig(t *testing.T) {
 	c.ID = 2
 	_, err = virter.CheckVMConfig(c)
 	assert.NoError(t, err)
+
+	c.Firmware = "coreboot"
+	_, err = virter.CheckVMConfig(c)
+	assert.Error(t, err)
+
+	c.Firmware = virter.FirmwareEFI
+	c.BootDiskBus = "floppy"
+	_, err = virter.CheckVMConfig(c)
+	assert.Error(t, err)
+
+	c.BootDiskBus = "scsi"
+	_, err = virter.CheckVMConfig(c)
+	assert.NoError(t, err)
 }
 
 func TestVMRun(t *testing.T) {
@@ -164,6 +178,38 @@ func addDisk(domain *FakeLibvirtDomain, volumeName, pool, typ, dev, bus string)
 	})
 }
 
+func TestVMExecReboot(t *testing.T) {
+	shell := new(mocks.MockShellClient)
+	shell.On("DialContext", mock.Anything).Return(nil)
+	shell.On("Close").Return(nil)
+	shell.On("StdoutPipe").Return(strings.NewReader("old-boot-id\n"), nil).Once()
+	shell.On("StdoutPipe").Return(strings.NewReader("new-boot-id\n"), nil).Once()
+	shell.On("ExecScript", "cat /proc/sys/kernel/random/boot_id").Return(nil).Twice()
+	shell.On("ExecScript", mock.MatchedBy(func(script string) bool {
+		return strings.Contains(script, "reboot")
+	})).Return(nil).Once()
+	shell.On("ExecScript", "test -f /run/cloud-init/result.json").Return(nil).Once()
+
+	readyConfig := virter.VmReadyConfig{
+		Retries:      1,
+		CheckTimeout: time.Second, // ignored
+	}
+
+	l := newFakeLibvirtConnection()
+
+	domain := newFakeLibvirtDomain(vmName, vmMAC)
+	domain.active = true
+	l.domains[vmName] = domain
+	fakeNetworkAddHost(l.networks[networkName], vmMAC, vmIP)
+
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+
+	err := v.VMExecReboot(context.Background(), MockShellClientBuilder{shell}, []string{vmName}, readyConfig, &virter.ProvisionRebootStep{Timeout: time.Minute})
+	assert.NoError(t, err)
+
+	shell.AssertExpectations(t)
+}
+
 func TestVMRm(t *testing.T) {
 	log.SetLevel(log.TraceLevel)
 	for i := range vmRmTests {
@@ -326,6 +372,48 @@ func TestVMExecContainer(t *testing.T) {
 	container.AssertExpectations(t)
 }
 
+func TestVMExecContainerCopies(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	domain := newFakeLibvirtDomain(vmName, vmMAC)
+	domain.persistent = true
+	domain.active = true
+	l.domains[vmName] = domain
+
+	fakeNetworkAddHost(l.networks[networkName], vmMAC, vmIP)
+
+	container := mockContainerProvider()
+
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dir, err := os.MkdirTemp(wd, "virter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	copySteps := []virter.ProvisionContainerCopyStep{
+		{Source: "/out/rpms", Dest: dir},
+		{Source: "/out/logs", Dest: dir},
+	}
+
+	containerCfg := containerapi.NewContainerConfig("test", containerImageName, nil)
+	err = v.VMExecContainer(context.Background(), container, []string{vmName}, containerCfg, copySteps)
+	assert.NoError(t, err)
+
+	container.AssertExpectations(t)
+	assert.Equal(t, []string{"/out/rpms", "/out/logs"}, container.copied)
+
+	// A destination outside the working directory fails, but the other files are still copied
+	container = mockContainerProvider()
+	copySteps[0].Dest = "/tmp"
+	containerCfg = containerapi.NewContainerConfig("test", containerImageName, nil)
+	err = v.VMExecContainer(context.Background(), container, []string{vmName}, containerCfg, copySteps)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"/out/logs"}, container.copied)
+}
+
 func TestVMExecRsync(t *testing.T) {
 	l := newFakeLibvirtConnection()
 
@@ -361,7 +449,7 @@ func TestVMExecRsync(t *testing.T) {
 	copier.On("Copy", mock.Anything, []netcopy.HostPath{
 		{Path: filepath.Join(dir, "file1.txt")},
 		{Path: filepath.Join(dir, "file2.txt")},
-	}, netcopy.HostPath{User: "root", Path: "/tmp", Host: "192.168.122.42"}, mock.Anything, mock.Anything).Return(nil)
+	}, netcopy.HostPath{User: "root", Path: "/tmp", Host: "192.168.122.42"}, mock.Anything, mock.Anything, netcopy.CopyOptions{}).Return(nil)
 
 	err = v.VMExecRsync(context.Background(), copier, []string{vmName}, step)
 	assert.NoError(t, err)
@@ -391,6 +479,52 @@ func TestVMExecRsync(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestVMExecRsyncFromVM(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	domain := newFakeLibvirtDomain(vmName, vmMAC)
+	domain.persistent = true
+	domain.active = true
+	l.domains[vmName] = domain
+
+	fakeNetworkAddHost(l.networks[networkName], vmMAC, vmIP)
+
+	v := virter.New(l, poolName, networkName, newMockKeystore())
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dir, err := os.MkdirTemp(wd, "virter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	step := &virter.ProvisionRsyncStep{
+		Source:    "/var/log/results/",
+		Dest:      dir,
+		Exclude:   []string{"*.tmp"},
+		Delete:    true,
+		Direction: virter.ProvisionRsyncFromVM,
+	}
+
+	copier := new(mocks.MockNetworkCopier)
+	copier.On("Copy", mock.Anything, []netcopy.HostPath{
+		{User: "root", Path: "/var/log/results/", Host: "192.168.122.42"},
+	}, netcopy.HostPath{Path: filepath.Join(dir, vmName) + "/"}, mock.Anything, mock.Anything, netcopy.CopyOptions{
+		Exclude: []string{"*.tmp"},
+		Delete:  true,
+	}).Return(nil)
+
+	err = v.VMExecRsync(context.Background(), copier, []string{vmName}, step)
+	assert.NoError(t, err)
+	copier.AssertExpectations(t)
+	assert.DirExists(t, filepath.Join(dir, vmName))
+
+	// Destination outside working directory should fail
+	step.Dest = "/tmp"
+	err = v.VMExecRsync(context.Background(), new(mocks.MockNetworkCopier), []string{vmName}, step)
+	assert.Error(t, err)
+}
+
 func TestVMExecCopy(t *testing.T) {
 	l := newFakeLibvirtConnection()
 
@@ -410,10 +544,10 @@ func TestVMExecCopy(t *testing.T) {
 	copier := new(mocks.MockNetworkCopier)
 	copier.On("Copy", mock.Anything, []netcopy.HostPath{
 		{Path: filepath.Join(dir, "file1.txt")},
-	}, netcopy.HostPath{User: "root", Path: "/tmp", Host: "192.168.122.42"}, mock.Anything, mock.Anything).Return(nil)
+	}, netcopy.HostPath{User: "root", Path: "/tmp", Host: "192.168.122.42"}, mock.Anything, mock.Anything, netcopy.CopyOptions{}).Return(nil)
 	copier.On("Copy", mock.Anything, []netcopy.HostPath{
 		{User: "root", Path: "/tmp", Host: "192.168.122.42"},
-	}, netcopy.HostPath{Path: filepath.Join(dir, "file1.txt")}, mock.Anything, mock.Anything).Return(nil)
+	}, netcopy.HostPath{Path: filepath.Join(dir, "file1.txt")}, mock.Anything, mock.Anything, netcopy.CopyOptions{}).Return(nil)
 
 	existingRemotePath := vmName + ":/tmp"
 	existingLocalPathPath := filepath.Join(dir, "file1.txt")
@@ -16,7 +16,15 @@ import (
 type NetworkCopier interface {
 	// Copy transfers a list of files (source) to a given directory (destination).
 	// Any one of the paths may be located on the host or remotely.
-	Copy(ctx context.Context, source []HostPath, destination HostPath, keyStore sshkeys.KeyStore, knownHosts sshkeys.KnownHosts) error
+	Copy(ctx context.Context, source []HostPath, destination HostPath, keyStore sshkeys.KeyStore, knownHosts sshkeys.KnownHosts, opts CopyOptions) error
+}
+
+// CopyOptions changes which files are copied
+type CopyOptions struct {
+	// Exclude lists patterns of files that are not copied, in the syntax of rsync's --exclude
+	Exclude []string
+	// Delete removes files from the destination directory that do not exist in the source
+	Delete bool
 }
 
 // The default copier. Uses `rsync` to do the actual work
@@ -61,7 +69,7 @@ func NewRsyncNetworkCopier() *RsyncNetworkCopier {
 	return &RsyncNetworkCopier{}
 }
 
-func (r *RsyncNetworkCopier) Copy(ctx context.Context, sources []HostPath, dest HostPath, keyStore sshkeys.KeyStore, knownHosts sshkeys.KnownHosts) error {
+func (r *RsyncNetworkCopier) Copy(ctx context.Context, sources []HostPath, dest HostPath, keyStore sshkeys.KeyStore, knownHosts sshkeys.KnownHosts, opts CopyOptions) error {
 	if len(sources) == 0 {
 		log.Debugf("got empty sources, nothing to copy. %v -> %v", sources, dest)
 		return nil
@@ -84,7 +92,7 @@ func (r *RsyncNetworkCopier) Copy(ctx context.Context, sources []HostPath, dest
 		return fmt.Errorf("failed to close known hosts file: %w", err)
 	}
 
-	args := []string{"--recursive", "--perms", "--times", "--protect-args"}
+	args := rsyncArgs(opts)
 
 	for _, src := range sources {
 		args = append(args, formatRsyncArg(src))
@@ -108,6 +116,21 @@ func (r *RsyncNetworkCopier) Copy(ctx context.Context, sources []HostPath, dest
 	return nil
 }
 
+// rsyncArgs returns the options passed to rsync, before the paths.
+func rsyncArgs(opts CopyOptions) []string {
+	args := []string{"--recursive", "--perms", "--times", "--protect-args"}
+
+	for _, exclude := range opts.Exclude {
+		args = append(args, "--exclude="+exclude)
+	}
+
+	if opts.Delete {
+		args = append(args, "--delete")
+	}
+
+	return args
+}
+
 func formatRsyncArg(spec HostPath) string {
 	if spec.Host == "" {
 		return spec.Path
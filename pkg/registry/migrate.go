@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+)
+
+// legacyArch is the CPU architecture of the images in version 1 registry files, which had no notion of architectures.
+const legacyArch = "amd64"
+
+// migrate converts a registry file to the current version.
+func migrate(rf *registryFile) {
+	if rf.Version == 1 {
+		for name, entry := range rf.Images {
+			if entry.URL != "" {
+				entry.Arch = map[string]ImageSource{legacyArch: entry.ImageSource}
+				entry.ImageSource = ImageSource{}
+			}
+			rf.Images[name] = entry
+		}
+	}
+
+	rf.Version = CurrentRegistryFileVersion
+}
+
+// MigrateFile rewrites the registry file at path in the current version. The original file is kept with the suffix
+// ".v<version>". Returns false if the file already is in the current version.
+func MigrateFile(path string) (bool, error) {
+	rf, err := readRegistryFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	if rf.Version == CurrentRegistryFileVersion {
+		return false, nil
+	}
+
+	original, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	backup := fmt.Sprintf("%s.v%d", path, rf.Version)
+	if err := os.WriteFile(backup, original, 0644); err != nil {
+		return false, fmt.Errorf("failed to back up image registry file: %w", err)
+	}
+
+	migrate(rf)
+
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf)
+	enc.Indent = ""
+	if err := enc.Encode(rf); err != nil {
+		return false, fmt.Errorf("failed to encode image registry file: %w", err)
+	}
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return false, fmt.Errorf("failed to write image registry file: %w", err)
+	}
+
+	return true, nil
+}
@@ -4,29 +4,91 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 
 	"github.com/BurntSushi/toml"
 	log "github.com/sirupsen/logrus"
 )
 
-const CurrentRegistryFileVersion = 1
+const CurrentRegistryFileVersion = 2
 
 var (
 	ErrNotFound = errors.New("not found")
 )
 
-type imageEntry struct {
-	URL string `toml:"url"`
+// ImageSource describes where an image can be downloaded, and how the download can be verified.
+type ImageSource struct {
+	URL string `toml:"url,omitempty"`
+	// SHA256 and SHA512 are the expected checksums of the file at URL
+	SHA256 string `toml:"sha256,omitempty"`
+	SHA512 string `toml:"sha512,omitempty"`
+	// Checksums is the URL of a checksum file listing the file at URL, like the SHA256SUMS files published by
+	// distributions. Both the GNU coreutils and the BSD format are supported.
+	Checksums string `toml:"checksums,omitempty"`
+	// Signature is the URL of a detached GPG signature of the checksum file. The checksum file may also be
+	// clearsigned instead.
+	Signature string `toml:"signature,omitempty"`
+	// SigningKey is the path to the GPG public key(s) used to verify the checksum file. Relative paths are relative
+	// to the registry file.
+	SigningKey string `toml:"signing_key,omitempty"`
+}
+
+// ImageDefaults are settings an image needs to work properly. They are applied when starting VMs from the image,
+// unless overridden by the user.
+type ImageDefaults struct {
+	// SSHUser is the user to log in as via SSH
+	SSHUser string `toml:"ssh_user,omitempty"`
+	// MinMemory is the minimum amount of memory, for example "2GiB"
+	MinMemory string `toml:"min_memory,omitempty"`
+	// Firmware is either "bios" or "efi"
+	Firmware   string `toml:"firmware,omitempty"`
+	SecureBoot bool   `toml:"secure_boot,omitempty"`
+	// DiskBus is the bus the boot disk is attached to
+	DiskBus string `toml:"disk_bus,omitempty"`
+}
+
+// ImageEntry is an image in the registry.
+//
+// The image is available for the CPU architectures in Arch. The source given directly in the entry is used for all
+// other architectures, so it should only be set for images that do not depend on the architecture.
+type ImageEntry struct {
+	ImageSource
+	Arch     map[string]ImageSource `toml:"arch,omitempty"`
+	Defaults ImageDefaults          `toml:"defaults,omitempty"`
+}
+
+// Source returns where to download the image for the given CPU architecture.
+func (e ImageEntry) Source(arch string) (ImageSource, error) {
+	if source, ok := e.Arch[arch]; ok {
+		return source, nil
+	}
+
+	if e.URL != "" {
+		return e.ImageSource, nil
+	}
+
+	return ImageSource{}, fmt.Errorf("image not available for architecture %s (available: %v): %w", arch, e.Architectures(), ErrNotFound)
+}
+
+// Architectures returns the CPU architectures the image is explicitly available for, sorted by name.
+func (e ImageEntry) Architectures() []string {
+	result := make([]string, 0, len(e.Arch))
+	for arch := range e.Arch {
+		result = append(result, arch)
+	}
+	sort.Strings(result)
+	return result
 }
 
 type registryFile struct {
-	Version int                    `toml:"version"`
-	Images  map[string]imageEntry  `toml:"images"`
+	Version int                   `toml:"version"`
+	Images  map[string]ImageEntry `toml:"images"`
 }
 
 type ImageRegistry struct {
 	sources []string
-	entries map[string]imageEntry
+	entries map[string]ImageEntry
 }
 
 func New(files ...string) *ImageRegistry {
@@ -38,29 +100,30 @@ func New(files ...string) *ImageRegistry {
 }
 
 func (r *ImageRegistry) load() error {
-	entries := make(map[string]imageEntry, 0)
+	entries := make(map[string]ImageEntry, 0)
 
 	for _, f := range r.sources {
 		log.Debugf("Loading image registry file: %s", f)
-		var rf registryFile
-		md, err := toml.DecodeFile(f, &rf)
+		rf, err := readRegistryFile(f)
 		if err != nil {
 			if os.IsNotExist(err) {
 				// ignore nonexistent files
 				continue
 			}
-			return fmt.Errorf("failed to decode image registry file '%v': %w", f, err)
+			return err
 		}
 
-		for _, k := range md.Undecoded() {
-			log.WithField("key", k).Warn("Unknown key in image registry file")
-		}
-
-		if rf.Version != CurrentRegistryFileVersion {
-			return fmt.Errorf("unsupported registry file version %d in '%v' (want %d)", rf.Version, f, CurrentRegistryFileVersion)
+		if rf.Version < CurrentRegistryFileVersion {
+			log.WithField("file", f).Debugf("Migrating image registry file from version %d", rf.Version)
+			migrate(rf)
 		}
 
 		for k, v := range rf.Images {
+			v.ImageSource = v.ImageSource.resolve(filepath.Dir(f))
+			for arch, source := range v.Arch {
+				v.Arch[arch] = source.resolve(filepath.Dir(f))
+			}
+
 			// if the key already exists, overwrite it
 			entries[k] = v
 		}
@@ -71,19 +134,65 @@ func (r *ImageRegistry) load() error {
 	return nil
 }
 
-func (r *ImageRegistry) Lookup(imageName string) (string, error) {
+func readRegistryFile(f string) (*registryFile, error) {
+	var rf registryFile
+	md, err := toml.DecodeFile(f, &rf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to decode image registry file '%v': %w", f, err)
+	}
+
+	for _, k := range md.Undecoded() {
+		log.WithField("key", k).Warn("Unknown key in image registry file")
+	}
+
+	if rf.Version < 1 || rf.Version > CurrentRegistryFileVersion {
+		return nil, fmt.Errorf("unsupported registry file version %d in '%v' (want %d)", rf.Version, f, CurrentRegistryFileVersion)
+	}
+
+	return &rf, nil
+}
+
+// resolve makes the path of the signing key absolute, relative to dir.
+func (s ImageSource) resolve(dir string) ImageSource {
+	if s.SigningKey != "" && !filepath.IsAbs(s.SigningKey) {
+		s.SigningKey = filepath.Join(dir, s.SigningKey)
+	}
+
+	return s
+}
+
+// Lookup returns the URL of the image for the given CPU architecture.
+func (r *ImageRegistry) Lookup(imageName, arch string) (string, error) {
+	entry, err := r.LookupEntry(imageName)
+	if err != nil {
+		return "", err
+	}
+
+	source, err := entry.Source(arch)
+	if err != nil {
+		return "", fmt.Errorf("could not look up image %v in registry: %w", imageName, err)
+	}
+
+	return source.URL, nil
+}
+
+// LookupEntry returns the complete registry entry of an image, including the information needed to verify it.
+func (r *ImageRegistry) LookupEntry(imageName string) (ImageEntry, error) {
 	if err := r.load(); err != nil {
-		return "", fmt.Errorf("failed to load image registry: %w", err)
+		return ImageEntry{}, fmt.Errorf("failed to load image registry: %w", err)
 	}
 	entry, ok := r.entries[imageName]
 	if !ok {
-		return "", fmt.Errorf("could not look up image %v in registry: %w", imageName, ErrNotFound)
+		return ImageEntry{}, fmt.Errorf("could not look up image %v in registry: %w", imageName, ErrNotFound)
 	}
 
-	return entry.URL, nil
+	return entry, nil
 }
 
-func (r *ImageRegistry) List() (map[string]imageEntry, error) {
+func (r *ImageRegistry) List() (map[string]ImageEntry, error) {
 	if err := r.load(); err != nil {
 		return nil, fmt.Errorf("failed to load image registry: %w", err)
 	}
@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -30,7 +31,7 @@ url = "https://example.com/debian-12.qcow2"
 
 	reg := New(path)
 
-	url, err := reg.Lookup("ubuntu-noble")
+	url, err := reg.Lookup("ubuntu-noble", "amd64")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -50,7 +51,7 @@ url = "https://example.com/ubuntu-noble.qcow2"
 
 	reg := New(path)
 
-	_, err := reg.Lookup("nonexistent")
+	_, err := reg.Lookup("nonexistent", "amd64")
 	if err == nil {
 		t.Fatal("expected error for nonexistent image")
 	}
@@ -65,7 +66,7 @@ url = "https://example.com/ubuntu-noble.qcow2"
 
 	reg := New(path)
 
-	_, err := reg.Lookup("ubuntu-noble")
+	_, err := reg.Lookup("ubuntu-noble", "amd64")
 	if err == nil {
 		t.Fatal("expected error for missing version")
 	}
@@ -82,7 +83,7 @@ url = "https://example.com/ubuntu-noble.qcow2"
 
 	reg := New(path)
 
-	_, err := reg.Lookup("ubuntu-noble")
+	_, err := reg.Lookup("ubuntu-noble", "amd64")
 	if err == nil {
 		t.Fatal("expected error for unsupported version")
 	}
@@ -105,7 +106,7 @@ url = "https://example.com/new.qcow2"
 
 	reg := New(path1, path2)
 
-	url, err := reg.Lookup("ubuntu-noble")
+	url, err := reg.Lookup("ubuntu-noble", "amd64")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -125,7 +126,7 @@ url = "https://example.com/ubuntu-noble.qcow2"
 
 	reg := New("/nonexistent/path/images.toml", path)
 
-	url, err := reg.Lookup("ubuntu-noble")
+	url, err := reg.Lookup("ubuntu-noble", "amd64")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -133,3 +134,184 @@ url = "https://example.com/ubuntu-noble.qcow2"
 		t.Fatalf("unexpected url: %s", url)
 	}
 }
+
+func TestLookupEntrySigningKey(t *testing.T) {
+	dir := t.TempDir()
+	path := writeRegistryFile(t, dir, "images.toml", `
+version = 2
+
+[images.ubuntu-noble.arch.amd64]
+url = "https://example.com/noble/disk.img"
+checksums = "https://example.com/noble/SHA256SUMS"
+signature = "https://example.com/noble/SHA256SUMS.gpg"
+signing_key = "keys/ubuntu.asc"
+
+[images.debian-12]
+url = "https://example.com/debian-12.qcow2"
+sha512 = "abc"
+signing_key = "/etc/keys/debian.asc"
+`)
+
+	reg := New(path)
+
+	entry, err := reg.LookupEntry("ubuntu-noble")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	source := entry.Arch["amd64"]
+	if source.SigningKey != filepath.Join(dir, "keys", "ubuntu.asc") {
+		t.Fatalf("unexpected signing key: %s", source.SigningKey)
+	}
+	if source.Signature != "https://example.com/noble/SHA256SUMS.gpg" {
+		t.Fatalf("unexpected signature: %s", source.Signature)
+	}
+
+	entry, err = reg.LookupEntry("debian-12")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.SigningKey != "/etc/keys/debian.asc" || entry.SHA512 != "abc" {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+}
+
+func TestLookupArch(t *testing.T) {
+	dir := t.TempDir()
+	path := writeRegistryFile(t, dir, "images.toml", `
+version = 2
+
+[images.ubuntu-noble.arch.amd64]
+url = "https://example.com/noble-amd64.img"
+
+[images.ubuntu-noble.arch.arm64]
+url = "https://example.com/noble-arm64.img"
+
+[images.ubuntu-noble.defaults]
+ssh_user = "ubuntu"
+min_memory = "2GiB"
+firmware = "efi"
+secure_boot = true
+disk_bus = "scsi"
+
+[images.netboot]
+url = "https://example.com/netboot.iso"
+`)
+
+	reg := New(path)
+
+	cases := []struct {
+		image   string
+		arch    string
+		url     string
+		wantErr bool
+	}{
+		{image: "ubuntu-noble", arch: "amd64", url: "https://example.com/noble-amd64.img"},
+		{image: "ubuntu-noble", arch: "arm64", url: "https://example.com/noble-arm64.img"},
+		{image: "ubuntu-noble", arch: "s390x", wantErr: true},
+		{image: "netboot", arch: "s390x", url: "https://example.com/netboot.iso"},
+	}
+
+	for _, c := range cases {
+		url, err := reg.Lookup(c.image, c.arch)
+		if c.wantErr {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s/%s: expected ErrNotFound, got: %v", c.image, c.arch, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s/%s: unexpected error: %v", c.image, c.arch, err)
+			continue
+		}
+
+		if url != c.url {
+			t.Errorf("%s/%s: unexpected url: %s", c.image, c.arch, url)
+		}
+	}
+
+	entry, err := reg.LookupEntry("ubuntu-noble")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := ImageDefaults{SSHUser: "ubuntu", MinMemory: "2GiB", Firmware: "efi", SecureBoot: true, DiskBus: "scsi"}
+	if entry.Defaults != expected {
+		t.Fatalf("unexpected defaults: %+v", entry.Defaults)
+	}
+}
+
+func TestLegacyVersion(t *testing.T) {
+	dir := t.TempDir()
+	path := writeRegistryFile(t, dir, "images.toml", `
+version = 1
+
+[images.ubuntu-noble]
+url = "https://example.com/ubuntu-noble.qcow2"
+`)
+
+	reg := New(path)
+
+	url, err := reg.Lookup("ubuntu-noble", "amd64")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if url != "https://example.com/ubuntu-noble.qcow2" {
+		t.Fatalf("unexpected url: %s", url)
+	}
+
+	_, err = reg.Lookup("ubuntu-noble", "arm64")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for other architecture, got: %v", err)
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	dir := t.TempDir()
+	original := `
+version = 1
+
+[images.ubuntu-noble]
+url = "https://example.com/ubuntu-noble.qcow2"
+sha256 = "abc"
+`
+	path := writeRegistryFile(t, dir, "images.toml", original)
+
+	migrated, err := MigrateFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !migrated {
+		t.Fatal("expected file to be migrated")
+	}
+
+	backup, err := os.ReadFile(path + ".v1")
+	if err != nil {
+		t.Fatalf("failed to read backup: %v", err)
+	}
+	if string(backup) != original {
+		t.Fatalf("unexpected backup content: %s", backup)
+	}
+
+	rf, err := readRegistryFile(path)
+	if err != nil {
+		t.Fatalf("failed to read migrated file: %v", err)
+	}
+	if rf.Version != CurrentRegistryFileVersion {
+		t.Fatalf("unexpected version: %d", rf.Version)
+	}
+
+	expected := ImageSource{URL: "https://example.com/ubuntu-noble.qcow2", SHA256: "abc"}
+	entry := rf.Images["ubuntu-noble"]
+	if entry.Arch["amd64"] != expected || entry.URL != "" {
+		t.Fatalf("unexpected migrated entry: %+v", entry)
+	}
+
+	migrated, err = MigrateFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if migrated {
+		t.Fatal("expected current file not to be migrated again")
+	}
+}
@@ -0,0 +1,197 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	log "github.com/sirupsen/logrus"
+)
+
+// checksumFileMaxSize limits the size of checksum and signature files
+const checksumFileMaxSize = 1 << 20
+
+var (
+	ErrUnverified = errors.New("no checksum available")
+
+	bsdChecksumRegex = regexp.MustCompile(`^(SHA256|SHA512) \((.+)\) = ([0-9a-fA-F]+)$`)
+	gnuChecksumRegex = regexp.MustCompile(`^([0-9a-fA-F]+) [ *](.+)$`)
+)
+
+// Checksum is the expected checksum of a downloaded image.
+type Checksum struct {
+	// Algorithm is either "sha256" or "sha512"
+	Algorithm string
+	Hex       string
+}
+
+// Checksum returns the expected checksum of the file at the URL of the source.
+//
+// Checksums given directly in the source are preferred. Otherwise, the checksum file is downloaded and, if a signing
+// key is configured, its signature is verified. Returns ErrUnverified if the source does not specify any checksum.
+func (e ImageSource) Checksum(ctx context.Context, client *http.Client) (*Checksum, error) {
+	switch {
+	case e.SHA512 != "":
+		return &Checksum{Algorithm: "sha512", Hex: strings.ToLower(e.SHA512)}, nil
+	case e.SHA256 != "":
+		return &Checksum{Algorithm: "sha256", Hex: strings.ToLower(e.SHA256)}, nil
+	case e.Checksums == "":
+		return nil, ErrUnverified
+	}
+
+	content, err := fetch(ctx, client, e.Checksums)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch checksum file: %w", err)
+	}
+
+	content, err = e.verifyChecksumFile(ctx, client, content)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image URL: %w", err)
+	}
+
+	return parseChecksumFile(content, path.Base(u.Path))
+}
+
+// verifyChecksumFile checks the signature of the checksum file and returns the signed content. If no signing key is
+// configured, the content is returned as is.
+func (e ImageSource) verifyChecksumFile(ctx context.Context, client *http.Client, content []byte) ([]byte, error) {
+	block, _ := clearsign.Decode(content)
+
+	if e.SigningKey == "" {
+		if e.Signature != "" {
+			return nil, fmt.Errorf("checksum file has a signature, but no signing_key is configured to verify it")
+		}
+
+		if block != nil {
+			log.WithField("checksums", e.Checksums).Debug("not verifying signature of clearsigned checksum file without signing_key")
+			return block.Plaintext, nil
+		}
+
+		return content, nil
+	}
+
+	keyring, err := readKeyRing(e.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if block != nil {
+		_, err := block.VerifySignature(keyring, nil)
+		if err != nil {
+			return nil, fmt.Errorf("bad signature of checksum file %s: %w", e.Checksums, err)
+		}
+
+		return block.Plaintext, nil
+	}
+
+	if e.Signature == "" {
+		return nil, fmt.Errorf("signing_key is configured, but checksum file %s is not signed", e.Checksums)
+	}
+
+	signature, err := fetch(ctx, client, e.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signature: %w", err)
+	}
+
+	check := openpgp.CheckDetachedSignature
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+
+	if _, err := check(keyring, bytes.NewReader(content), bytes.NewReader(signature), nil); err != nil {
+		return nil, fmt.Errorf("bad signature of checksum file %s: %w", e.Checksums, err)
+	}
+
+	return content, nil
+}
+
+// readKeyRing reads an armored or binary GPG keyring.
+func readKeyRing(file string) (openpgp.EntityList, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key '%s': %w", file, err)
+	}
+
+	return keyring, nil
+}
+
+// parseChecksumFile finds the checksum of filename in a checksum file in GNU coreutils format
+// ("<hex>  <filename>") or BSD format ("SHA256 (<filename>) = <hex>").
+func parseChecksumFile(content []byte, filename string) (*Checksum, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if m := bsdChecksumRegex.FindStringSubmatch(line); m != nil {
+			if m[2] == filename {
+				return &Checksum{Algorithm: strings.ToLower(m[1]), Hex: strings.ToLower(m[3])}, nil
+			}
+			continue
+		}
+
+		if m := gnuChecksumRegex.FindStringSubmatch(line); m != nil {
+			if m[2] != filename {
+				continue
+			}
+
+			switch len(m[1]) {
+			case 64:
+				return &Checksum{Algorithm: "sha256", Hex: strings.ToLower(m[1])}, nil
+			case 128:
+				return &Checksum{Algorithm: "sha512", Hex: strings.ToLower(m[1])}, nil
+			default:
+				return nil, fmt.Errorf("unsupported checksum for %s in checksum file", filename)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read checksum file: %w", err)
+	}
+
+	return nil, fmt.Errorf("no checksum for %s in checksum file", filename)
+}
+
+func fetch(ctx context.Context, client *http.Client, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad http status fetching %s: %v", u, resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, checksumFileMaxSize))
+}
@@ -0,0 +1,208 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+const (
+	testSHA256 = "a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447"
+	testSHA512 = "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"
+)
+
+func TestParseChecksumFile(t *testing.T) {
+	content := []byte(`# comment
+` + testSHA256 + ` *other.img
+` + testSHA256 + `  disk.img
+SHA512 (bsd.img) = ` + testSHA512 + `
+`)
+
+	cases := []struct {
+		file      string
+		algorithm string
+		hex       string
+		wantErr   bool
+	}{
+		{file: "disk.img", algorithm: "sha256", hex: testSHA256},
+		{file: "other.img", algorithm: "sha256", hex: testSHA256},
+		{file: "bsd.img", algorithm: "sha512", hex: testSHA512},
+		{file: "missing.img", wantErr: true},
+	}
+
+	for _, c := range cases {
+		checksum, err := parseChecksumFile(content, c.file)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", c.file)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.file, err)
+			continue
+		}
+
+		if checksum.Algorithm != c.algorithm || checksum.Hex != c.hex {
+			t.Errorf("%s: unexpected checksum %s:%s", c.file, checksum.Algorithm, checksum.Hex)
+		}
+	}
+}
+
+func TestChecksumFromSource(t *testing.T) {
+	checksum, err := ImageSource{URL: "https://example.com/disk.img", SHA512: testSHA512}.Checksum(context.Background(), http.DefaultClient)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if checksum.Algorithm != "sha512" || checksum.Hex != testSHA512 {
+		t.Fatalf("unexpected checksum %s:%s", checksum.Algorithm, checksum.Hex)
+	}
+
+	_, err = ImageSource{URL: "https://example.com/disk.img"}.Checksum(context.Background(), http.DefaultClient)
+	if !errors.Is(err, ErrUnverified) {
+		t.Fatalf("expected ErrUnverified, got: %v", err)
+	}
+}
+
+func TestChecksumSigned(t *testing.T) {
+	signer, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sums := []byte(testSHA256 + "  disk.img\n")
+
+	var signature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&signature, signer, bytes.NewReader(sums), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var clearsigned bytes.Buffer
+	w, err := clearsign.Encode(&clearsigned, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(sums); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"/SHA256SUMS":     sums,
+		"/SHA256SUMS.gpg": signature.Bytes(),
+		"/CHECKSUM":       clearsigned.Bytes(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	signerKey := writeTestKey(t, dir, "signer.asc", signer)
+	otherKey := writeTestKey(t, dir, "other.asc", other)
+
+	cases := []struct {
+		name    string
+		source  ImageSource
+		wantErr bool
+	}{
+		{
+			name:   "unsigned",
+			source: ImageSource{Checksums: server.URL + "/SHA256SUMS"},
+		},
+		{
+			name:   "detached signature",
+			source: ImageSource{Checksums: server.URL + "/SHA256SUMS", Signature: server.URL + "/SHA256SUMS.gpg", SigningKey: signerKey},
+		},
+		{
+			name:   "clearsigned",
+			source: ImageSource{Checksums: server.URL + "/CHECKSUM", SigningKey: signerKey},
+		},
+		{
+			name:   "clearsigned without key",
+			source: ImageSource{Checksums: server.URL + "/CHECKSUM"},
+		},
+		{
+			name:    "wrong key",
+			source:  ImageSource{Checksums: server.URL + "/SHA256SUMS", Signature: server.URL + "/SHA256SUMS.gpg", SigningKey: otherKey},
+			wantErr: true,
+		},
+		{
+			name:    "signature without key",
+			source:  ImageSource{Checksums: server.URL + "/SHA256SUMS", Signature: server.URL + "/SHA256SUMS.gpg"},
+			wantErr: true,
+		},
+		{
+			name:    "key without signature",
+			source:  ImageSource{Checksums: server.URL + "/SHA256SUMS", SigningKey: signerKey},
+			wantErr: true,
+		},
+		{
+			name:    "missing checksum file",
+			source:  ImageSource{Checksums: server.URL + "/missing"},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		c.source.URL = "https://example.com/images/disk.img"
+		checksum, err := c.source.Checksum(context.Background(), server.Client())
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", c.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+
+		if checksum.Algorithm != "sha256" || checksum.Hex != testSHA256 {
+			t.Errorf("%s: unexpected checksum %s:%s", c.name, checksum.Algorithm, checksum.Hex)
+		}
+	}
+}
+
+func writeTestKey(t *testing.T, dir, name string, entity *openpgp.Entity) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}